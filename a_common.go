@@ -307,6 +307,25 @@ func bootstrap() (done bool, servers []*http.Server) {
 		if LoadBalancers, err = BuildPools(); err != nil {
 			panic(fmt.Errorf("%s: '%w'", ErrPoolBuild.Error(), err))
 		}
+
+		// Bring back the membership changes made before we restarted
+		if sf := Conf.GetString(ConfigPoolsStateFile); sf != "" {
+			if PoolState, err = NewPoolMembershipState(sf, Conf.GetString(ConfigPoolsStatePolicy)); err != nil {
+				panic(fmt.Errorf("%s: '%w'", ErrPoolBuild.Error(), err))
+			}
+			if err = PoolState.Replay(LoadBalancers); err != nil {
+				ErrorOut.Printf("Error writing pool state file %s: %s\n", sf, err)
+			}
+		}
+
+		// Keep our peers' membership in sync with ours
+		if Conf.GetBool(ConfigPoolsSync) {
+			peers := StringToCleanList(Conf.GetString(ConfigGroupCachePeers), ",")
+			PoolSync = NewPoolSyncer(peers[0], peers, LoadBalancers)
+			Caches.Handle(PoolSyncPath, PoolSync)
+			PoolSync.Start()
+			StopFuncs.Add(PoolSync.Stop)
+		}
 	}
 
 	// Paths in JAR, are like <location> maps
@@ -485,6 +504,14 @@ func bootstrap() (done bool, servers []*http.Server) {
 		//WriteTimeout: Conf.GetDuration(ConfigTimeout),
 	}
 
+	// Cleartext HTTP/2 (e.g. gRPC) on the plain listener
+	if Conf.GetBool(ConfigH2C) && tlscfg == nil {
+		DebugOut.Println("H2C: true")
+		s.Protocols = new(http.Protocols)
+		s.Protocols.SetHTTP1(true)
+		s.Protocols.SetUnencryptedHTTP2(true)
+	}
+
 	// We don't requre tls.enabled=true here, because it's a backdoor to disabling keepalives
 	// even if TLS isn't being used, albeit clumsy.
 	if Conf.GetBool(ConfigTLSKeepaliveDisabled) {
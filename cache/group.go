@@ -32,6 +32,7 @@ type GroupCache struct {
 	addr     string
 	caches   map[string]*groupcache.Group
 	pool     *groupcache.HTTPPool
+	mux      *http.ServeMux
 	configs  map[string]*Config
 	close    func() error
 	debugOut *log.Logger
@@ -59,6 +60,7 @@ func NewGroupCache(config Config, fillfunc BackFillFunc) (*GroupCache, error) {
 		addr:     config.ListenAddress,
 		debugOut: log.New(io.Discard, "[DEBUG] ", 0),
 		pool:     pool,
+		mux:      mux,
 		configs:  make(map[string]*Config),
 		caches:   make(map[string]*groupcache.Group),
 		close:    srv.Close,
@@ -204,6 +206,11 @@ func (gc *GroupCache) SetDebugOut(logger *log.Logger) {
 	gc.debugOut = logger
 }
 
+// Handle registers the handler for the pattern on the cluster listener, so other things can talk to their peers too
+func (gc *GroupCache) Handle(pattern string, handler http.Handler) {
+	gc.mux.Handle(pattern, handler)
+}
+
 // SetPeers allows the dynamic [re]setting of the peerlist
 func (gc *GroupCache) SetPeers(peers ...string) {
 	gc.pool.Set(peers...)
@@ -0,0 +1,344 @@
+package jar
+
+import (
+	"github.com/gorilla/mux"
+
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Constants for configuration key strings
+const (
+	ConfigCanaryCookieName     = ConfigKey("canary.cookiename")
+	ConfigCanaryOverrideCookie = ConfigKey("canary.overridecookie")
+	ConfigCanaryOverrideHeader = ConfigKey("canary.overrideheader")
+)
+
+var (
+	// Canaries are the Canary splits built from Paths with Pools
+	Canaries = NewCanaryMap()
+)
+
+func init() {
+	ConfigAdditions[ConfigCanaryCookieName] = "JARCANARY"
+	ConfigAdditions[ConfigCanaryOverrideCookie] = "JARCANARYOVERRIDE"
+	ConfigAdditions[ConfigCanaryOverrideHeader] = "X-JAR-Canary"
+
+	Finishers["canaryweights"] = CanaryWeights
+}
+
+// CanaryVariant is one of the Pools a Canary splits traffic between
+type CanaryVariant struct {
+	// Pool is the name of the Pool
+	Pool string
+	// Weight is the share of new clients sent to the Pool, relative to the other variants
+	Weight int
+
+	handler http.Handler
+}
+
+// Canary is an http.Handler that splits traffic between several Pools by weight. Once a client is sent to a
+// variant, a cookie keeps it there for as long as the variant has any weight, so a session doesn't flip between
+// versions. Testers may force a variant, regardless of its weight, with the override header or cookie.
+type Canary struct {
+	// Name is the name of the Path the Canary was built for
+	Name string
+	// Cookie is the name of the cookie that pins clients to a variant
+	Cookie string
+
+	spec     string
+	lock     sync.RWMutex
+	variants []*CanaryVariant
+}
+
+// NewCanary returns a Canary from a list of "poolname weight" strings. The Pools are materialized.
+func NewCanary(name string, pools []string) (*Canary, error) {
+	c := Canary{
+		Name:   name,
+		Cookie: fmt.Sprintf("%s_%s", Conf.GetString(ConfigCanaryCookieName), canaryCookieSafe(name)),
+		spec:   strings.Join(pools, ","),
+	}
+
+	var total int
+	for _, p := range pools {
+		parts := strings.Fields(p)
+		if len(parts) != 2 {
+			return nil, ErrConfigurationError{fmt.Sprintf("canary '%s' pool '%s' must be 'poolname weight'", name, p)}
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return nil, ErrConfigurationError{fmt.Sprintf("canary '%s' pool '%s' weight must be a whole number, 0 or more", name, parts[0])}
+		}
+		if c.variant(parts[0]) != nil {
+			return nil, ErrConfigurationError{fmt.Sprintf("canary '%s' lists pool '%s' more than once", name, parts[0])}
+		}
+
+		pool, ok := LoadBalancers.Get(parts[0])
+		if !ok {
+			return nil, ErrConfigurationError{fmt.Sprintf("pool '%s' is not a listed pool", parts[0])}
+		}
+		handler, err := pool.GetPool()
+		if err != nil {
+			return nil, ErrConfigurationError{fmt.Sprintf("pool '%s' had an error materializing: %s", parts[0], err)}
+		}
+		id := PoolID{parts[0]}
+		c.variants = append(c.variants, &CanaryVariant{Pool: parts[0], Weight: weight, handler: id.Handler(handler)})
+		total += weight
+	}
+
+	if len(c.variants) < 2 {
+		return nil, ErrConfigurationError{fmt.Sprintf("canary '%s' must list at least two pools", name)}
+	} else if total == 0 {
+		return nil, ErrConfigurationError{fmt.Sprintf("canary '%s' weights must not all be 0", name)}
+	}
+	return &c, nil
+}
+
+// ServeHTTP sends the request to the overridden, pinned, or a weighted-random variant
+func (c *Canary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Testers first
+	if name := r.Header.Get(Conf.GetString(ConfigCanaryOverrideHeader)); name != "" {
+		if v := c.variant(name); v != nil {
+			v.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	if cookie, err := r.Cookie(Conf.GetString(ConfigCanaryOverrideCookie)); err == nil {
+		if v := c.variant(cookie.Value); v != nil {
+			v.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	// Pinned clients stay put, unless their variant has been turned off
+	if cookie, err := r.Cookie(c.Cookie); err == nil {
+		if v := c.variant(cookie.Value); v != nil && c.weight(v) > 0 {
+			v.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	v := c.pick()
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.Cookie,
+		Value:    v.Pool,
+		Path:     "/",
+		HttpOnly: Conf.GetBool(ConfigStickyCookieHTTPOnly),
+		Secure:   Conf.GetBool(ConfigStickyCookieSecure),
+	})
+	v.handler.ServeHTTP(w, r)
+}
+
+// Weights returns a copy of the variants, with their current weights
+func (c *Canary) Weights() []CanaryVariant {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	l := make([]CanaryVariant, len(c.variants))
+	for i, v := range c.variants {
+		l[i] = CanaryVariant{Pool: v.Pool, Weight: v.Weight}
+	}
+	return l
+}
+
+// SetWeights changes the weights of the named Pools, leaving the others alone. The weights must be 0 or more, and
+// must not all be 0 afterwards. Either all of the changes are made, or none are.
+func (c *Canary) SetWeights(weights map[string]int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	total := 0
+	for _, v := range c.variants {
+		weight := v.Weight
+		if nw, ok := weights[v.Pool]; ok {
+			weight = nw
+		}
+		total += weight
+	}
+	for pool, weight := range weights {
+		if c.indexOf(pool) < 0 {
+			return ErrConfigurationError{fmt.Sprintf("pool '%s' is not part of canary '%s'", pool, c.Name)}
+		} else if weight < 0 {
+			return ErrConfigurationError{fmt.Sprintf("pool '%s' weight must be 0 or more", pool)}
+		}
+	}
+	if total == 0 {
+		return ErrConfigurationError{fmt.Sprintf("canary '%s' weights must not all be 0", c.Name)}
+	}
+
+	for pool, weight := range weights {
+		c.variants[c.indexOf(pool)].Weight = weight
+	}
+	return nil
+}
+
+// String returns the variants and their weights
+func (c *Canary) String() string {
+	var s strings.Builder
+	for _, v := range c.Weights() {
+		fmt.Fprintf(&s, "%s %d\n", v.Pool, v.Weight)
+	}
+	return s.String()
+}
+
+// pick returns a variant at random, by weight
+func (c *Canary) pick() *CanaryVariant {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	total := 0
+	for _, v := range c.variants {
+		total += v.Weight
+	}
+	n := rand.IntN(total)
+	for _, v := range c.variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return c.variants[len(c.variants)-1] // not reached
+}
+
+// variant returns the variant for the named Pool, or nil
+func (c *Canary) variant(pool string) *CanaryVariant {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if i := c.indexOf(pool); i >= 0 {
+		return c.variants[i]
+	}
+	return nil
+}
+
+// weight returns the current weight of the variant
+func (c *Canary) weight(v *CanaryVariant) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return v.Weight
+}
+
+// indexOf returns the index of the variant for the named Pool, or -1. The lock must be held.
+func (c *Canary) indexOf(pool string) int {
+	for i, v := range c.variants {
+		if v.Pool == pool {
+			return i
+		}
+	}
+	return -1
+}
+
+// canaryCookieSafe replaces characters that aren't allowed in cookie names
+func canaryCookieSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 128 && (r == '-' || r == '_' || r == '.' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// CanaryMap is a goro-safe map of Canaries, by the Path they were built for, that may be looked up by name
+type CanaryMap struct {
+	lock     sync.RWMutex
+	canaries map[string]*Canary
+	names    map[string]string
+}
+
+// NewCanaryMap returns an initialized CanaryMap
+func NewCanaryMap() *CanaryMap {
+	return &CanaryMap{canaries: make(map[string]*Canary), names: make(map[string]string)}
+}
+
+// Get returns the named Canary, and true, or nil and false. If several Canaries share a name, the last one
+// built is returned.
+func (m *CanaryMap) Get(name string) (*Canary, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	c, ok := m.canaries[m.names[name]]
+	return c, ok
+}
+
+// Build returns the Canary for the key, named name, for the list of "poolname weight" strings. If a Canary for
+// the same key was already built from the identical list, it is reused, so weights changed at runtime survive
+// configuration reloads. Any change to the list, even reordering it, builds a new Canary with the configured weights.
+func (m *CanaryMap) Build(key, name string, pools []string) (*Canary, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if c, ok := m.canaries[key]; ok && c.spec == strings.Join(pools, ",") {
+		m.names[name] = key
+		return c, nil
+	}
+	c, err := NewCanary(name, pools)
+	if err != nil {
+		return nil, err
+	}
+	m.canaries[key] = c
+	m.names[name] = key
+	return c, nil
+}
+
+// List returns the names of the Canaries
+func (m *CanaryMap) List() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	l := make([]string, 0, len(m.names))
+	for name := range m.names {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// canaryKey returns a key that tells Paths apart by what they route, rather than by where they are in the
+// configuration, so a Canary's runtime weights don't pass to an unrelated Path that shifted into its place. A
+// Path's Hosts share one key, and so one Canary.
+func canaryKey(path *Path) string {
+	return fmt.Sprintf("%s|%s|%t|%s|%s", path.Name, path.Path, path.Absolute, strings.Join(path.Methods, ","), strings.Join(path.Headers, ","))
+}
+
+// CanaryWeights is a Finisher that lists the weights of the Canary named by the "canaryname" path variable, after
+// changing any that are given as "poolname=weight" query parameters. Without a "canaryname", the Canaries are listed.
+func CanaryWeights(w http.ResponseWriter, r *http.Request) {
+	name, ok := mux.Vars(r)["canaryname"]
+	if !ok {
+		for _, n := range Canaries.List() {
+			c, _ := Canaries.Get(n)
+			fmt.Fprintf(w, "%s:\n%s", n, c)
+		}
+		return
+	}
+
+	c, ok := Canaries.Get(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Canary '%s' does not exist", name), http.StatusNotFound)
+		return
+	}
+
+	if q := r.URL.Query(); len(q) > 0 {
+		weights := make(map[string]int, len(q))
+		for pool := range q {
+			weight, err := strconv.Atoi(q.Get(pool))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Weight of '%s' is not a whole number", pool), http.StatusBadRequest)
+				return
+			}
+			weights[pool] = weight
+		}
+		if err := c.SetWeights(weights); err != nil {
+			http.Error(w, fmt.Sprintf("Error changing weights: %s", err), http.StatusBadRequest)
+			return
+		}
+		DebugOut.Printf("Canary %s weights changed: %v\n", name, c.Weights())
+	}
+
+	fmt.Fprint(w, c.String())
+}
@@ -0,0 +1,213 @@
+package jar
+
+import (
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanary(t *testing.T) {
+
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.Header.Get(Conf.GetString(ConfigPoolHeaderName))))
+		}))
+	}
+	v1 := backend("v1")
+	defer v1.Close()
+	v2 := backend("v2")
+	defer v2.Close()
+
+	oldLB, oldCanaries := LoadBalancers, Canaries
+	defer func() { LoadBalancers, Canaries = oldLB, oldCanaries }()
+
+	var err error
+	LoadBalancers, err = NewPools(map[string]*PoolConfig{
+		"canaryv1": {Name: "canaryv1", Members: []string{v1.URL}},
+		"canaryv2": {Name: "canaryv2", Members: []string{v2.URL}},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h http.Handler, cookies ...*http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest("GET", "/app/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		So(rr.Code, ShouldEqual, http.StatusOK)
+
+		body, _ := io.ReadAll(rr.Body)
+		var cookie *http.Cookie
+		if c := rr.Result().Cookies(); len(c) > 0 {
+			cookie = c[0]
+		}
+		return string(body), cookie
+	}
+
+	Convey("When a Path has weighted Pools, new clients are split between them, and pinned", t, func() {
+		Canaries = NewCanaryMap()
+		router := mux.NewRouter()
+		path := Path{Name: "canary test", Path: "/app/", Pools: []string{"canaryv1 75", "canaryv2 25"}}
+		_, err := BuildPath(&path, 0, router)
+		So(err, ShouldBeNil)
+
+		counts := make(map[string]int)
+		for range 400 {
+			body, cookie := get(router)
+			So(cookie, ShouldNotBeNil)
+			So(cookie.Name, ShouldEqual, "JARCANARY_canary_test")
+			So(body, ShouldEqual, map[string]string{"canaryv1": "v1 canaryv1", "canaryv2": "v2 canaryv2"}[cookie.Value])
+			counts[cookie.Value]++
+		}
+		So(counts["canaryv1"], ShouldBeBetween, 240, 360)
+		So(counts["canaryv2"], ShouldBeBetween, 40, 160)
+
+		pinned := &http.Cookie{Name: "JARCANARY_canary_test", Value: "canaryv2"}
+		for range 20 {
+			body, cookie := get(router, pinned)
+			So(body, ShouldEqual, "v2 canaryv2")
+			So(cookie, ShouldBeNil)
+		}
+
+		Convey("... unless their variant is turned off", func() {
+			c, ok := Canaries.Get("canary test")
+			So(ok, ShouldBeTrue)
+			So(c.SetWeights(map[string]int{"canaryv2": 0}), ShouldBeNil)
+			body, cookie := get(router, pinned)
+			So(body, ShouldEqual, "v1 canaryv1")
+			So(cookie.Value, ShouldEqual, "canaryv1")
+		})
+
+		Convey("... and testers may force a variant, even one that is turned off", func() {
+			c, _ := Canaries.Get("canary test")
+			So(c.SetWeights(map[string]int{"canaryv2": 0}), ShouldBeNil)
+
+			req := httptest.NewRequest("GET", "/app/", nil)
+			req.Header.Set("X-JAR-Canary", "canaryv2")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			So(rr.Body.String(), ShouldEqual, "v2 canaryv2")
+			So(rr.Result().Cookies(), ShouldBeEmpty)
+
+			body, _ := get(router, &http.Cookie{Name: "JARCANARYOVERRIDE", Value: "canaryv2"})
+			So(body, ShouldEqual, "v2 canaryv2")
+		})
+
+		Convey("... and rebuilding the Path keeps runtime weights, unless the Pools changed", func() {
+			c, _ := Canaries.Get("canary test")
+			So(c.SetWeights(map[string]int{"canaryv1": 1}), ShouldBeNil)
+
+			_, err := BuildPath(&path, 0, mux.NewRouter())
+			So(err, ShouldBeNil)
+			again, _ := Canaries.Get("canary test")
+			So(again, ShouldEqual, c)
+
+			path.Pools = []string{"canaryv1 50", "canaryv2 50"}
+			_, err = BuildPath(&path, 0, mux.NewRouter())
+			So(err, ShouldBeNil)
+			again, _ = Canaries.Get("canary test")
+			So(again, ShouldNotEqual, c)
+		})
+	})
+
+	Convey("When distinct Paths have the same Pools, they don't share a Canary", t, func() {
+		Canaries = NewCanaryMap()
+		pools := []string{"canaryv1 75", "canaryv2 25"}
+
+		a := Path{Path: "/a/", Pools: pools}
+		_, err := BuildPath(&a, 0, mux.NewRouter())
+		So(err, ShouldBeNil)
+		ca, _ := Canaries.Get("0")
+		So(ca.SetWeights(map[string]int{"canaryv2": 0}), ShouldBeNil)
+
+		// A different Path shifts into the first one's place
+		b := Path{Path: "/b/", Pools: pools}
+		_, err = BuildPath(&b, 0, mux.NewRouter())
+		So(err, ShouldBeNil)
+		cb, _ := Canaries.Get("0")
+		So(cb, ShouldNotEqual, ca)
+		So(cb.Weights(), ShouldResemble, []CanaryVariant{{Pool: "canaryv1", Weight: 75}, {Pool: "canaryv2", Weight: 25}})
+
+		// The first comes back, with its weights
+		_, err = BuildPath(&a, 0, mux.NewRouter())
+		So(err, ShouldBeNil)
+		again, _ := Canaries.Get("0")
+		So(again, ShouldEqual, ca)
+
+		Convey("... but the Hosts of one Path do", func() {
+			Canaries = NewCanaryMap()
+			router := mux.NewRouter()
+			path := Path{Path: "/app/", Hosts: []string{"a.example.com", "b.example.com"}, Pools: pools}
+			_, err := BuildPath(&path, 0, router)
+			So(err, ShouldBeNil)
+
+			c, _ := Canaries.Get("0")
+			other, _ := Canaries.Get("1")
+			So(other, ShouldEqual, c)
+			So(c.SetWeights(map[string]int{"canaryv1": 0}), ShouldBeNil)
+			for _, host := range []string{"a.example.com", "b.example.com"} {
+				req := httptest.NewRequest("GET", "http://"+host+"/app/", nil)
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				So(rr.Body.String(), ShouldEqual, "v2 canaryv2")
+			}
+		})
+	})
+
+	Convey("When a Path has badly configured Pools, it isn't built", t, func() {
+		Canaries = NewCanaryMap()
+		for _, pools := range [][]string{
+			{"canaryv1 100"},
+			{"canaryv1 0", "canaryv2 0"},
+			{"canaryv1 50", "canaryv1 50"},
+			{"canaryv1 50", "canaryv2"},
+			{"canaryv1 50", "canaryv2 -1"},
+			{"canaryv1 50", "nosuchpool 50"},
+		} {
+			path := Path{Path: "/app/", Pools: pools}
+			_, err := BuildPath(&path, 0, mux.NewRouter())
+			So(err, ShouldNotBeNil)
+		}
+
+		path := Path{Path: "/app/", Pool: "canaryv1", Pools: []string{"canaryv1 50", "canaryv2 50"}}
+		_, err := BuildPath(&path, 0, mux.NewRouter())
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When the CanaryWeights finisher is called, weights are listed and changed", t, func() {
+		Canaries = NewCanaryMap()
+		_, err := Canaries.Build("weights", "weights", []string{"canaryv1 90", "canaryv2 10"})
+		So(err, ShouldBeNil)
+
+		finish := func(target string, vars map[string]string) *httptest.ResponseRecorder {
+			req := mux.SetURLVars(httptest.NewRequest("GET", target, nil), vars)
+			rr := httptest.NewRecorder()
+			CanaryWeights(rr, req)
+			return rr
+		}
+		vars := map[string]string{"canaryname": "weights"}
+
+		rr := finish("/", vars)
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "canaryv1 90\ncanaryv2 10\n")
+
+		rr = finish("/?canaryv1=50&canaryv2=50", vars)
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "canaryv1 50\ncanaryv2 50\n")
+
+		So(finish("/", nil).Body.String(), ShouldEqual, "weights:\ncanaryv1 50\ncanaryv2 50\n")
+
+		So(finish("/?canaryv1=0&canaryv2=0", vars).Code, ShouldEqual, http.StatusBadRequest)
+		So(finish("/?nosuchpool=5", vars).Code, ShouldEqual, http.StatusBadRequest)
+		So(finish("/?canaryv1=lots", vars).Code, ShouldEqual, http.StatusBadRequest)
+		So(finish("/", map[string]string{"canaryname": "nope"}).Code, ShouldEqual, http.StatusNotFound)
+		So(finish("/", vars).Body.String(), ShouldEqual, "canaryv1 50\ncanaryv2 50\n")
+	})
+}
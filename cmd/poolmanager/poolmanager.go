@@ -25,7 +25,7 @@ var (
 	command    string
 	pool       string
 
-	commands = []string{"add", "lose", "list"}
+	commands = []string{"add", "lose", "drain", "list"}
 )
 
 const (
@@ -129,7 +129,11 @@ func main() {
 		// Wasn't in list
 		fmt.Printf("Invalid --command '%s'\n", commandFields[0])
 		os.Exit(1)
-	} else if commandFields[0] != "list" && len(commandFields) != 2 {
+	} else if commandFields[0] == "drain" && (len(commandFields) < 2 || len(commandFields) > 3) {
+		// Needs unprovided argument, and maybe a timeout
+		fmt.Printf("Command '%s' requires an additional argument, and optionally a timeout\n", commandFields[0])
+		os.Exit(1)
+	} else if commandFields[0] != "list" && commandFields[0] != "drain" && len(commandFields) != 2 {
 		// Needs unprovided argument
 		fmt.Printf("Command '%s' requires an additional argument\n", commandFields[0])
 		os.Exit(1)
@@ -149,6 +153,10 @@ func main() {
 		// The second command argument needs base64-encoding
 		b64thing := base64.StdEncoding.EncodeToString([]byte(commandFields[1]))
 		uri = fmt.Sprintf("%s/%s/%s/%s", baseURI, pool, commandFields[0], b64thing)
+		if len(commandFields) == 3 {
+			// drain timeout
+			uri = fmt.Sprintf("%s?timeout=%s", uri, commandFields[2])
+		}
 	}
 
 	for _, jard := range jards {
@@ -22,6 +22,7 @@ const (
 	ConfigDebugTimings         = ConfigKey("debugtimings")
 	ConfigDumpConfig           = ConfigKey("dumpconfig")
 	ConfigErrorLog             = ConfigKey("errorlog")
+	ConfigH2C                  = ConfigKey("h2c")
 	ConfigHandlers             = ConfigKey("handlers")
 	ConfigHotConfig            = ConfigKey("hotconfig")
 	ConfigKeepaliveTimeout     = ConfigKey("keepalivetimeout")
@@ -31,6 +32,7 @@ const (
 	ConfigLogBackups           = ConfigKey("logbackups")
 	ConfigLogSize              = ConfigKey("logsize")
 	ConfigMaxConnections       = ConfigKey("maxconnections")
+	ConfigMirrorLog            = ConfigKey("mirrorlog")
 	ConfigPaths                = ConfigKey("paths")
 	ConfigPools                = ConfigKey("pools")
 	ConfigRequestIDHeaderName  = ConfigKey("requestidheadername")
@@ -117,10 +119,12 @@ func loadDefaults(v *viper.Viper) error {
 	v.SetDefault(ConfigDebugRequests, false)                    // Enable vociferous output of requests
 	v.SetDefault(ConfigDebugResponses, false)                   // Enable vociferous output of responses
 	v.SetDefault(ConfigListen, ":8080")                         // ip:port or :port to listen on
+	v.SetDefault(ConfigH2C, false)                              // Accept cleartext HTTP/2 on the listen address
 	v.SetDefault(ConfigAccessLog, "")                           // Path to file where accesslog, else stdout
 	v.SetDefault(ConfigDebugLog, "")                            // Path to file where debug should log to, else stderr
 	v.SetDefault(ConfigErrorLog, "")                            // Path to file where errorlog should log to, else stderr
 	v.SetDefault(ConfigSlowLog, "")                             // Path to file where the slow requests should log to
+	v.SetDefault(ConfigMirrorLog, "")                           // Path to file where mirrored requests that differ should log to
 	v.SetDefault(ConfigLogSize, 100)                            // Maximum size, in MB, that the currently log can be before rolling
 	v.SetDefault(ConfigLogBackups, 3)                           // Maximum number of rolled logs to keep
 	v.SetDefault(ConfigLogAge, 28)                              // Maximum age, in days, to keep rolled logs
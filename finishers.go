@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -29,6 +30,7 @@ func init() {
 	Finishers["forbidden"] = Forbidden
 	Finishers["poolmemberadder"] = PoolMemberAdder
 	Finishers["poolmemberloser"] = PoolMemberLoser
+	Finishers["poolmemberdrainer"] = PoolMemberDrainer
 	Finishers["poolmemberlister"] = PoolMemberLister
 	Finishers["poollister"] = PoolLister
 }
@@ -194,10 +196,39 @@ func PoolMemberLister(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		var draining []DrainingMember
+		if pool.ListDrainingMembers != nil {
+			draining = pool.ListDrainingMembers()
+		}
+		isDraining := make(map[string]bool, len(draining))
+		for _, d := range draining {
+			isDraining[d.URL.String()] = true
+		}
+
 		members := pool.ListMembers()
 		for _, m := range members {
+			if isDraining[m.String()] {
+				// Listed below
+				continue
+			}
 			w.Write([]byte(m.String() + "\n"))
 		}
+
+		if pool.ListBackupMembers != nil {
+			// Backups are listed separately
+			w.Write([]byte("\nBackup members:\n"))
+			for _, m := range pool.ListBackupMembers() {
+				w.Write([]byte(m.String() + "\n"))
+			}
+		}
+
+		if len(draining) > 0 {
+			// Draining members are on their way out
+			w.Write([]byte("\nDraining members:\n"))
+			for _, d := range draining {
+				w.Write([]byte(fmt.Sprintf("%s (draining until %s)\n", d.URL.String(), d.Deadline.Format(time.RFC3339))))
+			}
+		}
 	} else {
 		http.Error(w, "Pool not found", http.StatusNotFound)
 		return
@@ -253,6 +284,10 @@ func PoolMemberAdder(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, ErrRequestError{r, fmt.Sprintf("Error adding member: %s", err.Error())}.String(), http.StatusBadRequest)
 			return
 		}
+		PoolSync.Record(poolName, mus, PoolSyncAdd, 0)
+		if serr := PoolState.Added(poolName, mus); serr != nil {
+			ErrorOut.Println(ErrRequestError{r, fmt.Sprintf("Error saving pool state: %s", serr.Error())})
+		}
 	} else {
 		http.Error(w, "Pool not found", http.StatusNotFound)
 		return
@@ -308,6 +343,10 @@ func PoolMemberLoser(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprintf("Error removing member: %s", err.Error()), http.StatusBadRequest)
 			return
 		}
+		PoolSync.Record(poolName, mus, PoolSyncRemove, 0)
+		if serr := PoolState.Removed(poolName, mus); serr != nil {
+			ErrorOut.Println(ErrRequestError{r, fmt.Sprintf("Error saving pool state: %s", serr.Error())})
+		}
 	} else {
 		http.Error(w, "Pool not found", http.StatusNotFound)
 		return
@@ -315,3 +354,78 @@ func PoolMemberLoser(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte("Removed"))
 }
+
+// PoolMemberDrainer is a finisher to drain a member from an existing pool: it gets no new clients, and is removed
+// once its existing ones are finished. An optional "timeout" query parameter overrides the default deadline.
+func PoolMemberDrainer(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		poolName  string
+		memberURL string
+		timeout   time.Duration
+	)
+
+	mvars := mux.Vars(r)
+	if v, ok := mvars["poolname"]; ok {
+		poolName = v
+	} else {
+		// Not OK
+		http.Error(w, "Value of 'poolname' not found", http.StatusBadRequest)
+		return
+	}
+
+	if v, ok := mvars["b64memberurl"]; ok {
+		memberURL = v
+	} else {
+		// Not OK
+		http.Error(w, "Value of 'member' not found", http.StatusBadRequest)
+		return
+	}
+
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		t, terr := time.ParseDuration(v)
+		if terr != nil || t < 0 {
+			http.Error(w, "Value of 'timeout' is not a valid duration", http.StatusBadRequest)
+			return
+		}
+		timeout = t
+	}
+
+	if pool, ok := LoadBalancers.Get(poolName); ok {
+		if !pool.IsMaterialized() {
+			_, err := pool.GetPool() // Materializes if not already
+			if err != nil {
+				ErrorOut.Println(ErrRequestError{r, fmt.Sprintf("%s failed to materialize pool %s: %s", "PoolMemberDrainer", poolName, err.Error())})
+				http.Error(w, "Pool management error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if pool.DrainMember == nil {
+			http.Error(w, "Error draining member: this Pool does not support draining of members", http.StatusBadRequest)
+			return
+		}
+
+		mu, derr := base64.StdEncoding.DecodeString(memberURL)
+		if derr != nil {
+			http.Error(w, ErrRequestError{r, fmt.Sprintf("Error decoding memberURL: %s", derr.Error())}.String(), http.StatusBadRequest)
+			return
+		}
+		mus := strings.TrimSpace(string(mu))
+
+		err := pool.DrainMember(mus, timeout)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error draining member: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		PoolSync.Record(poolName, mus, PoolSyncDrain, timeout)
+		if serr := PoolState.Removed(poolName, mus); serr != nil {
+			ErrorOut.Println(ErrRequestError{r, fmt.Sprintf("Error saving pool state: %s", serr.Error())})
+		}
+	} else {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	}
+
+	w.Write([]byte("Draining"))
+}
@@ -31,7 +31,7 @@ require (
 	github.com/spf13/viper v1.21.0
 	github.com/xeipuuv/gojsonschema v1.2.0 // indirect
 	golang.org/x/crypto v0.45.0
-	golang.org/x/net v0.47.0 // indirect
+	golang.org/x/net v0.47.0
 	golang.org/x/sync v0.18.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
@@ -45,7 +45,6 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/ec2 v1.272.0
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.91.0
 	github.com/bdragon300/tusgo v0.1.2
-	github.com/buraksezer/consistent v0.10.0
 	github.com/cespare/xxhash v1.1.0
 	github.com/cognusion/go-dictionary v1.0.1
 	github.com/cognusion/go-health v1.1.0
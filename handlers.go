@@ -27,6 +27,7 @@ const (
 	poolIDKey
 	// PathOptionsKey is a keyid for setting/getting PathOptions to/from a Context
 	PathOptionsKey
+	upstreamAttemptsKey
 
 	// ErrAborted is only used during panic recovery, if http.ErrAbortHandler was called
 	ErrAborted = Error("client aborted connection, or connection closed")
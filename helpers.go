@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -162,13 +163,13 @@ func FlashEncoding(src string) string {
 	return strings.Replace(uenc, "+", "%2B", -1)
 }
 
+// ipOnly returns the address from an "address:port" string, IPv4 or IPv6, or the string sans brackets if there is no port
 func ipOnly(ip string) string {
-	if strings.Contains(ip, ":") {
-		iparts := strings.Split(ip, ":")
-		ip = iparts[0]
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
 	}
 
-	return ip
+	return strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
 }
 
 // ReaderToString reads from a Reader into a Buffer, and then returns the string value of that
@@ -150,6 +150,12 @@ func TestIpOnly(t *testing.T) {
 		So(ipOnly("1.2.3.4:1234"), ShouldEqual, "1.2.3.4")
 	})
 
+	Convey("When ipOnly is passed an IPv6 address, with or without a port, the IP address is returned", t, func() {
+		So(ipOnly("[2001:db8::1]:1234"), ShouldEqual, "2001:db8::1")
+		So(ipOnly("2001:db8::1"), ShouldEqual, "2001:db8::1")
+		So(ipOnly("[::1]"), ShouldEqual, "::1")
+	})
+
 	Convey("When ipOnly is passed and empty string, and empty string is returned", t, func() {
 		So(ipOnly(""), ShouldEqual, "")
 	})
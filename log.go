@@ -5,6 +5,7 @@ import (
 	"github.com/rcrowley/go-metrics"
 	"gopkg.in/natefinch/lumberjack.v2"
 
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -31,6 +33,8 @@ var (
 	CommonOut = log.New(io.Discard, "", 0)
 	// SlowOut is a log.Logger for slow request information
 	SlowOut = log.New(io.Discard, "", 0)
+	// MirrorOut is a log.Logger for mirrored requests whose shadow responses differ
+	MirrorOut = log.New(io.Discard, "", 0)
 
 	// RequestTimer is a function to allow Durations to be added to the Timer Metric
 	RequestTimer func(time.Duration)
@@ -66,6 +70,7 @@ func LogInit() error {
 		ErrorOut = GetErrorLog(Conf.GetString(ConfigErrorLog), "", OutFormat, Conf.GetInt(ConfigLogSize), Conf.GetInt(ConfigLogBackups), Conf.GetInt(ConfigLogAge))
 		AccessOut = GetLog(Conf.GetString(ConfigAccessLog), "", 0, Conf.GetInt(ConfigLogSize), Conf.GetInt(ConfigLogBackups), Conf.GetInt(ConfigLogAge))
 		CommonOut = GetLogOrDiscard(Conf.GetString(ConfigCommonLog), "", 0, Conf.GetInt(ConfigLogSize), Conf.GetInt(ConfigLogBackups), Conf.GetInt(ConfigLogAge))
+		MirrorOut = GetLogOrDiscard(Conf.GetString(ConfigMirrorLog), "", 0, Conf.GetInt(ConfigLogSize), Conf.GetInt(ConfigLogBackups), Conf.GetInt(ConfigLogAge))
 	}
 
 	// Set the DebugOut, maybe
@@ -154,6 +159,34 @@ type AccessLog interface {
 	RequestFiller(r *http.Request)
 }
 
+// UpstreamAttempts is placed in the request context by AccessLogHandler, so that Pools that retry requests
+// can note each member tried, for the access log
+type UpstreamAttempts struct {
+	lock    sync.Mutex
+	members []string
+}
+
+// Add notes an attempt against the member
+func (u *UpstreamAttempts) Add(member string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.members = append(u.members, member)
+}
+
+// Attempts returns the number of attempts noted
+func (u *UpstreamAttempts) Attempts() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return len(u.members)
+}
+
+// Members returns the members attempted, in order
+func (u *UpstreamAttempts) Members() []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return append([]string{}, u.members...)
+}
+
 // JSONAccessLog is an AccessLog uberstruct for JSONifying log data
 type JSONAccessLog struct {
 	Timestamp     string `json:"timestamp"`
@@ -173,6 +206,9 @@ type JSONAccessLog struct {
 	RequestID     string `json:"requestid"`
 	Proto         string `json:"proto"`
 	TLSVersion    string `json:"tlsversion"`
+	Attempts      string `json:"attempts,omitempty"`
+	Upstreams     string `json:"upstreams,omitempty"`
+	GRPCStatus    string `json:"grpcstatus,omitempty"`
 	clfTimestamp  string
 }
 
@@ -223,6 +259,9 @@ func (a *JSONAccessLog) Reset() {
 	a.clfTimestamp = ""
 	a.Proto = ""
 	a.TLSVersion = ""
+	a.Attempts = ""
+	a.Upstreams = ""
+	a.GRPCStatus = ""
 }
 
 // ResponseFiller adds response information to the AccessLog entry
@@ -266,6 +305,12 @@ func (a *JSONAccessLog) RequestFiller(r *http.Request) {
 	if r.TLS != nil {
 		a.TLSVersion = SslVersions.Suite(r.TLS.Version)
 	}
+
+	// Retried?
+	if ua, ok := r.Context().Value(upstreamAttemptsKey).(*UpstreamAttempts); ok && ua.Attempts() > 0 {
+		a.Attempts = strconv.Itoa(ua.Attempts())
+		a.Upstreams = strings.Join(ua.Members(), ",")
+	}
 }
 
 // AccessLogHandler is a middleware that times how long requests takes, assembled an AccessLog, and logs accordingly
@@ -281,6 +326,9 @@ func AccessLogHandler(next http.Handler) http.Handler {
 		rw, _ := prw.NewPluggableResponseWriterIfNot(w)
 		defer rw.Flush()
 
+		// Give Pools somewhere to note their attempts
+		r = r.WithContext(context.WithValue(r.Context(), upstreamAttemptsKey, &UpstreamAttempts{}))
+
 		// Immediately pass on, and we'll handle the response headers at the end, tyvm
 		next.ServeHTTP(rw, r)
 
@@ -301,6 +349,10 @@ func AccessLogHandler(next http.Handler) http.Handler {
 		logEntry.Reset()
 		logEntry.ResponseFiller(endtime, duration, rw.Code(), rw.Length())
 		logEntry.RequestFiller(r)
+		if a, ok := logEntry.(*JSONAccessLog); ok {
+			// gRPC calls are "200 OK" even when they aren't
+			a.GRPCStatus = grpcStatus(rw.Header())
+		}
 
 		if Conf.GetBool(ConfigDebug) && Conf.GetBool(ConfigDebugResponses) {
 			// dump the response, yo
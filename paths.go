@@ -43,9 +43,11 @@ type Path struct {
 	Headers []string
 	// Handlers is an ordered list of http.Handlers to apply
 	Handlers []string
-	// Pool is an actual Pool to handle the proxying. Mutually exclusive with Finisher
+	// Pool is an actual Pool to handle the proxying. Mutually exclusive with Pools and Finisher
 	Pool string
-	// Finisher is the final handler. Mutually exclusive with Pool
+	// Pools is a list of "poolname weight" Pools to split the proxying between. Mutually exclusive with Pool and Finisher
+	Pools []string
+	// Finisher is the final handler. Mutually exclusive with Pool and Pools
 	Finisher string
 	// CacheName is the name of the cache to use, and should match a CachePool
 	CacheName string
@@ -582,6 +584,10 @@ func BuildPath(path *Path, index int, router *mux.Router) (int, error) {
 	// Load endpoint handlers
 	var pathHandler http.Handler
 
+	if path.Pool != "" && len(path.Pools) > 0 {
+		return 0, ErrConfigurationError{"path may have Pool or Pools defined, not both"}
+	}
+
 	switch {
 	case path.Redirect != "":
 		// path will be redirected
@@ -635,6 +641,15 @@ func BuildPath(path *Path, index int, router *mux.Router) (int, error) {
 			return 0, ErrConfigurationError{fmt.Sprintf("pool '%s' is not a listed pool", path.Pool)}
 		}
 
+	case len(path.Pools) > 0:
+		// path will be proxied, with the Pools split by weight
+		DebugOut.Printf("\tAdding Canary %s: %+v\n", b.Path, path.Pools)
+		c, err := Canaries.Build(canaryKey(path), b.Path, path.Pools)
+		if err != nil {
+			return 0, err
+		}
+		pathHandler = hchain.Then(c)
+
 	case path.Finisher != "":
 		// path will be handled by Finisher
 		if l, err := HandleFinisher(path.Finisher, path); err == nil {
@@ -650,7 +665,7 @@ func BuildPath(path *Path, index int, router *mux.Router) (int, error) {
 
 	default:
 		// No Pool, no Finisher? Problem.
-		return 0, ErrConfigurationError{"path must have Redirect, ErrorMessage, Pool, or Finisher defined"}
+		return 0, ErrConfigurationError{"path must have Redirect, ErrorMessage, Pool, Pools, or Finisher defined"}
 	}
 
 	pathRouter.Handler(pathHandler)
@@ -5,8 +5,8 @@ import (
 	"github.com/vulcand/oxy/v2/forward"
 	"github.com/vulcand/oxy/v2/roundrobin"
 
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -45,6 +45,15 @@ const (
 	// ErrPoolConfigConsistentAndSticky is returned when a Pool has both Sticky and ConsistentHashing set
 	ErrPoolConfigConsistentAndSticky = Error("a Pool cannot have Sticky and ConsistentHashing set")
 
+	// ErrPoolConfigBalancersExclusive is returned when a Pool has more than one of Sticky, ConsistentHashing, LeastRequests, or PeakEWMA set
+	ErrPoolConfigBalancersExclusive = Error("a Pool may only have one of Sticky, ConsistentHashing, LeastRequests, or PeakEWMA set")
+
+	// ErrPoolConfigBufferedAndRetries is returned when a Pool has both Buffered and Retries set
+	ErrPoolConfigBufferedAndRetries = Error("a Pool cannot have Buffered and Retries set")
+
+	// ErrPoolConfigOverflowWithoutFailover is returned when a Pool has OverflowConcurrency set, but not FailoverPool
+	ErrPoolConfigOverflowWithoutFailover = Error("a Pool cannot have OverflowConcurrency set without FailoverPool")
+
 	// ErrPoolConfigMissing is returned when an operation on a Pool is requested, but no config is set
 	ErrPoolConfigMissing = Error("no Config present for Pool")
 )
@@ -88,20 +97,11 @@ func init() {
 	Materializers["http"] = materializeHTTP
 	Materializers["https"] = materializeHTTP
 	Materializers["ws"] = materializeHTTP
+	Materializers["wss"] = materializeHTTP
 
 	InitFuncs.Add(func() {
 		// Defaults for any subrequests
-		DefaultTransport := &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   Conf.GetDuration(ConfigTimeout),
-				KeepAlive: Conf.GetDuration(ConfigKeepaliveTimeout),
-				DualStack: false,
-			}).DialContext,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       3 * Conf.GetDuration(ConfigTimeout),
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}
+		DefaultTransport := newTransport()
 
 		// Register with StrainFuncs, so we can free up resources if needed
 		StrainFuncs.Add(DefaultTransport.CloseIdleConnections)
@@ -160,8 +160,17 @@ type Pool struct {
 	Config *PoolConfig
 
 	members                sync.Map
+	backupMembers          sync.Map
 	poolMaterializer       PoolMaterializer
+	transport              http.RoundTripper
+	websockets             *WebSocketTracker
+	drainer                *MemberDrainer
 	healthCheckErrorStatus HealthCheckStatus
+	observers              []MemberObserver
+	discoveryLock          sync.Mutex
+	discovered             map[string]map[string]DiscoveredMember
+	ejectionLock           sync.Mutex
+	ejections              map[string]map[string]bool
 
 	// AddMember adds a URI to the loadbalancer. An error is returned if the URI doesn't parse properly
 	AddMember func(string) error
@@ -175,6 +184,22 @@ type Pool struct {
 	DeleteMember func(string) error
 	// ListMembers returns a list of URIs for existing members
 	ListMembers func() []*url.URL
+	// DrainMember stops sending new clients to a URI, and deletes it from the Pool once its existing clients
+	// are finished, or the timeout passes (the global default if zero).
+	// ErrNoSuchMemberError is returned if the requested member doesn't exist,
+	// or another error if the URI provided doesn't parse properly.
+	DrainMember func(string, time.Duration) error
+	// ListDrainingMembers returns a list of the members being drained
+	ListDrainingMembers func() []DrainingMember
+
+	// AddBackupMember adds a URI to the backup members. An error is returned if the URI doesn't parse properly.
+	// Nil unless the Pool has BackupMembers.
+	AddBackupMember func(string) error
+	// RemoveBackupMember removes a URI from the backup members, but not from the backup member cache.
+	// Nil unless the Pool has BackupMembers.
+	RemoveBackupMember func(string) error
+	// ListBackupMembers returns a list of URIs for existing backup members. Nil unless the Pool has BackupMembers.
+	ListBackupMembers func() []*url.URL
 
 	// Materialized pool
 	poollock sync.RWMutex
@@ -229,8 +254,18 @@ func (p *Pool) GetPool() (http.Handler, error) {
 
 // GetMember interacts with an internal cache, returning a Member from the cache or crafting a new one (and adding it to the cache)
 func (p *Pool) GetMember(u *url.URL) *Member {
+	return p.getMember(&p.members, u)
+}
+
+// GetBackupMember is GetMember for backup members, which are cached separately
+func (p *Pool) GetBackupMember(u *url.URL) *Member {
+	return p.getMember(&p.backupMembers, u)
+}
 
-	if v, ok := p.members.Load(*u); ok {
+// getMember returns a Member from the specified cache, or crafts a new one (and adds it to the cache)
+func (p *Pool) getMember(cache *sync.Map, u *url.URL) *Member {
+
+	if v, ok := cache.Load(*u); ok {
 		// We already have one
 		return v.(*Member)
 	}
@@ -244,7 +279,7 @@ func (p *Pool) GetMember(u *url.URL) *Member {
 		}
 	} // else we just use the default
 
-	p.members.Store(*u, m)
+	cache.Store(*u, m)
 	return m
 }
 
@@ -274,12 +309,17 @@ func (p *Pool) Materialize() (http.Handler, error) {
 		}
 
 		// Grab the URL scheme, and switch on it
-		if v, ok := Materializers[memberURL.Scheme]; ok {
+		scheme := memberURL.Scheme
+		if isDiscoveryURL(memberURL) {
+			// Discovered members have their own scheme
+			scheme = discoveredScheme(memberURL)
+		}
+		if v, ok := Materializers[scheme]; ok {
 			p.poolMaterializer = v
 		} else {
 			// Um... no supported scheme?
-			ErrorOut.Printf("FATAL: Materialization of Pool failed, Member scheme was %s", memberURL.Scheme)
-			panic(fmt.Errorf("materialization of Pool failed, Member scheme was %s", memberURL.Scheme))
+			ErrorOut.Printf("FATAL: Materialization of Pool failed, Member scheme was %s", scheme)
+			panic(fmt.Errorf("materialization of Pool failed, Member scheme was %s", scheme))
 		}
 	}
 
@@ -302,6 +342,23 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 		pool http.Handler
 	)
 
+	if p.Config.Sticky && p.Config.ConsistentHashing {
+		// Mutually exclusive
+		return nil, ErrPoolConfigConsistentAndSticky
+	} else if countTrue(p.Config.Sticky || p.Config.ConsistentHashing, p.Config.LeastRequests, p.Config.PeakEWMA) > 1 {
+		// Also mutually exclusive
+		return nil, ErrPoolConfigBalancersExclusive
+	} else if p.Config.Buffered && p.Config.Retries > 0 {
+		// Pick one
+		return nil, ErrPoolConfigBufferedAndRetries
+	} else if p.Config.OverflowConcurrency > 0 && p.Config.FailoverPool == "" {
+		// Overflow to where?
+		return nil, ErrPoolConfigOverflowWithoutFailover
+	} else if p.Config.MirrorPool != "" && p.Config.MirrorPool == p.Config.Name {
+		// Hall of mirrors
+		return nil, ErrPoolConfigMirrorSelf
+	}
+
 	if p.Config.ReplacePath != "" {
 		DebugOut.Printf("\t\tReplacePath: %s\n", p.Config.ReplacePath)
 	}
@@ -314,16 +371,81 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 	}
 	rw := reqRewriter{Headers: pheaders, To: p.Config.ReplacePath, StripPrefix: p.Config.StripPrefix}
 
+	if p.Config.CircuitBreaker {
+		cb := NewCircuitBreakers(p)
+		DebugOut.Printf("\t\tCircuitBreaker: ratio %.2f latency %s open %s probes %d\n", cb.ErrorRatio, cb.Latency, cb.OpenDuration, cb.Probes)
+		p.AddObserver(cb.Observe)
+	}
+	if p.Config.OutlierDetection {
+		od := NewOutlierDetector(p)
+		DebugOut.Printf("\t\tOutlierDetection: consecutive %d rate %.2f ejection %s max %d%%\n", od.ConsecutiveFailures, od.FailureRate, od.EjectionTime, od.MaxEjectionPercent)
+		p.AddObserver(od.Observe)
+	}
+
 	fwd = forward.New(true)
 	fwd.ErrorLog = ErrorOut
 	fwd.ModifyResponse = ResponseModifierChain.ToProxyResponseModifier()
-	fwd.Transport = DefaultTrip
+	transport, terr := NewPoolTransport(p.Config)
+	if terr != nil {
+		return nil, terr
+	}
+	p.transport = transport
+	fwd.Transport = transport
+	if p.isFCGI() {
+		// FastCGI, over connections from the Pool transport
+		ft, ferr := NewFCGITransport(p.Config, transport.DialContext)
+		if ferr != nil {
+			return nil, ferr
+		}
+		DebugOut.Printf("\t\tFastCGI: root '%s' script '%s'\n", ft.DocumentRoot, ft.ScriptFilename)
+		p.transport = ft
+		fwd.Transport = ft
+	}
 
-	urlcapture := URLCaptureHandler(rw.Handler(fwd))
+	var proxy = unixHandler(fwd)
+	if p.isH2C() {
+		// Cleartext HTTP/2, streamed as it comes
+		DebugOut.Printf("\t\tH2C: true\n")
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		fwd.FlushInterval = -1
+		fwd.ErrorHandler = grpcErrorHandler
+		proxy = h2cHandler(proxy)
+	}
 
-	if p.Config.Sticky && p.Config.ConsistentHashing {
-		// Mutually exclusive
-		return nil, ErrPoolConfigConsistentAndSticky
+	// Keep track of which sockets belong to whom
+	p.websockets = NewWebSocketTracker(p)
+	proxy = p.websockets.MemberHandler(proxy)
+
+	if len(p.observers) > 0 {
+		// Let the observers know how things went
+		prm := fwd.ModifyResponse
+		fwd.ModifyResponse = func(resp *http.Response) error {
+			p.observeResponse(resp)
+			return prm(resp)
+		}
+		fwd.ErrorHandler = p.observeError(fwd.ErrorHandler)
+	}
+
+	urlcapture := p.observeHandler(URLCaptureHandler(rw.Handler(proxy)))
+	if p.Config.Retries > 0 || p.Config.Hedge {
+		// Note the member chosen for each attempt
+		urlcapture = attemptHandler(urlcapture)
+	}
+
+	// Keep track of what draining members are still doing
+	drainer, derr := NewMemberDrainer(p)
+	if derr != nil {
+		return nil, derr
+	}
+	p.drainer = drainer
+	urlcapture = drainer.MemberHandler(urlcapture)
+
+	var cl *ConnLimiter
+	if p.Config.MaxConnsPerMember > 0 {
+		// Keep busy members from getting busier
+		cl = NewConnLimiter(p)
+		urlcapture = cl.MemberHandler(urlcapture)
 	}
 
 	// Build a PoolManager
@@ -337,6 +459,12 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 	} else if p.Config.ConsistentHashing {
 		// Pool is using a consistent hash to direct traffics
 		pm, pmErr = p.materializeConsistent(urlcapture)
+	} else if p.Config.LeastRequests {
+		// Pool is directing traffic to the least-busy members
+		pm, pmErr = p.materializeLeastRequests(urlcapture)
+	} else if p.Config.PeakEWMA {
+		// Pool is directing traffic to the least-latent members
+		pm, pmErr = p.materializePeakEWMA(urlcapture)
 	} else {
 		// Pool is not not sticky nor consistent, so standard rrlb
 		pm, pmErr = roundrobin.New(urlcapture, roundrobin.Logger(&oxyLogger))
@@ -344,6 +472,11 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 	if pmErr != nil {
 		return nil, pmErr
 	}
+	// Draining members leave the PoolManager
+	drainer.pm = pm
+
+	// ss is set once the configured members are added, so only later additions ramp
+	var ss *slowStarter
 
 	// Define ListMembers
 	p.ListMembers = func() []*url.URL {
@@ -357,7 +490,19 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 			return uerr
 		}
 
+		// Changed our minds
+		drainer.Cancel(u)
+
 		m := p.GetMember(u)
+		if p.Config.SlowStart > 0 {
+			// Weights are scaled so ramping members can be lighter than everyone else
+			weight := serverOptionsToWeight(m.Weight) * slowStartScale
+			if ss != nil {
+				return ss.Upsert(u, weight)
+			}
+			return pm.UpsertServer(u, roundrobin.Weight(weight))
+		}
+
 		uerr = pm.UpsertServer(u, m.Weight)
 		if uerr != nil {
 			return uerr
@@ -374,18 +519,55 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 
 		// If the member has been materialized, remove it from the cache
 		p.members.Delete(*u)
+		p.ejectionLock.Lock()
+		delete(p.ejections, u.String())
+		p.ejectionLock.Unlock()
+
+		if ss != nil {
+			ss.Cancel(u)
+		}
+		// A draining member has already left the PoolManager, unless it is consistently hashed
+		drained := drainer.Cancel(u)
 
 		uerr = pm.RemoveServer(u)
+		if uerr != nil && uerr.Error() == "server not found" { // Bad, M@. BAD. M@.
+			uerr = ErrNoSuchMemberError
+		}
+		if uerr != nil && !(drained && errors.Is(uerr, ErrNoSuchMemberError)) {
+			return uerr
+		}
+
+		// Say goodbye to its WebSockets
+		if n := p.websockets.Drain(u); n > 0 {
+			DebugOut.Printf("Pool %s draining %d WebSockets from %s\n", p.Config.Name, n, memberHost(u))
+		}
+
+		return nil
+	}
+
+	// Define DrainMember
+	p.DrainMember = func(member string, timeout time.Duration) error {
+		u, uerr := url.Parse(member)
 		if uerr != nil {
-			if uerr.Error() == "server not found" { // Bad, M@. BAD. M@.
-				return ErrNoSuchMemberError
-			}
 			return uerr
 		}
 
+		if ss != nil {
+			ss.Cancel(u)
+		}
+
+		if uerr = drainer.Drain(u, timeout); uerr != nil {
+			return uerr
+		}
+
+		// Out of the cache, so healthchecks don't add it back
+		p.members.Delete(*u)
 		return nil
 	}
 
+	// Define ListDrainingMembers
+	p.ListDrainingMembers = drainer.List
+
 	// Define RemoveMember
 	p.RemoveMember = func(member string) error {
 		u, uerr := url.Parse(member)
@@ -393,6 +575,10 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 			return uerr
 		}
 
+		if ss != nil {
+			ss.Cancel(u)
+		}
+
 		uerr = pm.RemoveServer(u)
 		if uerr != nil {
 			if uerr.Error() == "server not found" { // Bad, M@. BAD. M@.
@@ -405,29 +591,99 @@ func materializeHTTP(p *Pool) (http.Handler, error) {
 	}
 
 	// Add members
+	var sources []*url.URL
 	for _, member := range p.Config.Members {
+		if u, uerr := url.Parse(member); uerr == nil && isDiscoveryURL(u) {
+			// Not a member, but where to find them
+			sources = append(sources, u)
+			continue
+		}
 		DebugOut.Printf("\t\tAdding member '%s'\n", member)
 		err = p.AddMember(member)
 		if err != nil {
 			return nil, err
 		}
 	}
+	if err = p.startDiscovery(sources); err != nil {
+		return nil, err
+	}
+
+	if p.Config.SlowStart > 0 {
+		DebugOut.Printf("\t\tSlowStart: %s\n", p.Config.SlowStart.String())
+		ss = newSlowStarter(p.Config.Name, pm, p.Config.SlowStart, p.Config.SlowStartAggression)
+	}
+
+	// lb is what requests are balanced by, while membership changes go to pm
+	lb := pm
+	if len(p.Config.BackupMembers) > 0 {
+		backup, berr := p.materializeBackups(urlcapture)
+		if berr != nil {
+			return nil, berr
+		}
+		lb = NewBackupTier(pm, backup)
+	}
+	pool = lb
+
+	// Hedge slow requests
+	if p.Config.Hedge {
+		h := NewHedger(p, lb)
+		DebugOut.Printf("\t\tHedging: %s\n", h.String())
+		pool = h
+	}
+
+	// Queue requests when the members are all busy
+	if cl != nil {
+		DebugOut.Printf("\t\tConnLimiter: %s\n", cl.String())
+		pool = cl.Wrap(lb, pool)
+	}
 
 	// Buffer all the requests
 	if p.Config.Buffered {
 		DebugOut.Printf("\t\tBuffering with %d retries.\n", p.Config.BufferedFails)
-		buff, err := buffer.New(pm, buffer.Retry(fmt.Sprintf("IsNetworkError() && Attempts() < %d", p.Config.BufferedFails)), buffer.Logger(&oxyLogger))
+		buff, err := buffer.New(pool, buffer.Retry(fmt.Sprintf("IsNetworkError() && Attempts() < %d", p.Config.BufferedFails)), buffer.Logger(&oxyLogger))
 		if err != nil {
 			return nil, err
 		}
 		pool = buff
-	} else {
-		pool = pm
+	} else if p.Config.Retries > 0 {
+		rp := NewRetryPolicy(p.Config, pool)
+		DebugOut.Printf("\t\tRetryPolicy: %s\n", rp.String())
+		pool = rp
+	}
+
+	// Send requests elsewhere if we can't handle them
+	if p.Config.FailoverPool != "" {
+		f := NewFailover(p, lb, pool)
+		DebugOut.Printf("\t\tFailover: %s\n", f.String())
+		pool = f
+	}
+
+	// Clients of draining members go straight to them
+	pool = drainer.Wrap(pool, urlcapture)
+
+	// Show the shadow Pool what it's missing
+	if p.Config.MirrorPool != "" {
+		m := NewMirror(p, pool)
+		DebugOut.Printf("\t\tMirror: %s\n", m.String())
+		pool = m
 	}
 
+	// Nothing can fail now, so the transport can replace any previous one
+	registerPoolTransport(p.Config.Name, transport)
 	return pool, nil
 }
 
+// countTrue returns the number of bools that are true
+func countTrue(bools ...bool) int {
+	var c int
+	for _, b := range bools {
+		if b {
+			c++
+		}
+	}
+	return c
+}
+
 // reqRewriter is a forward.ReqRewriter, that removes headers and/or mangles the request URI
 type reqRewriter struct {
 	// Headers is a list of headers to remove from the request
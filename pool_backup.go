@@ -0,0 +1,120 @@
+package jar
+
+import (
+	"github.com/vulcand/oxy/v2/roundrobin"
+
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// BackupTier is a PoolManager that sends requests to its primary PoolManager, unless the primary has no members,
+// in which case they are sent to the backup PoolManager. Membership changes and weights apply to the primary.
+type BackupTier struct {
+	primary PoolManager
+	backup  PoolManager
+}
+
+// NewBackupTier returns a BackupTier over the primary and backup PoolManagers
+func NewBackupTier(primary, backup PoolManager) *BackupTier {
+	return &BackupTier{
+		primary: primary,
+		backup:  backup,
+	}
+}
+
+// active returns the PoolManager that should handle requests
+func (bt *BackupTier) active() PoolManager {
+	if len(bt.primary.Servers()) == 0 {
+		return bt.backup
+	}
+	return bt.primary
+}
+
+// ServeHTTP handles its part of the request
+func (bt *BackupTier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pm := bt.active()
+	if pm == bt.backup {
+		DebugOut.Print(ErrRequestError{r, "No primary members, using backup members"}.String())
+	}
+	pm.ServeHTTP(w, r)
+}
+
+// ServeMember sends the request to the specified member of whichever tier is handling requests
+func (bt *BackupTier) ServeMember(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	serveMember(bt.active(), w, r, u)
+}
+
+// Servers returns the members currently handling requests
+func (bt *BackupTier) Servers() []*url.URL {
+	return bt.active().Servers()
+}
+
+// ServerWeight returns the weight of the primary member
+func (bt *BackupTier) ServerWeight(u *url.URL) (int, bool) {
+	return bt.primary.ServerWeight(u)
+}
+
+// RemoveServer removes the primary member
+func (bt *BackupTier) RemoveServer(u *url.URL) error {
+	return bt.primary.RemoveServer(u)
+}
+
+// UpsertServer adds or updates the primary member
+func (bt *BackupTier) UpsertServer(u *url.URL, options ...roundrobin.ServerOption) error {
+	return bt.primary.UpsertServer(u, options...)
+}
+
+// NextServer returns the next member from whichever tier is handling requests
+func (bt *BackupTier) NextServer() (*url.URL, error) {
+	return bt.active().NextServer()
+}
+
+// Next returns the next http.Handler
+func (bt *BackupTier) Next() http.Handler {
+	return bt.primary.Next()
+}
+
+// materializeBackups builds a round-robin PoolManager of the BackupMembers, and defines the Pool's backup member
+// functions. The backups share the primary's handler chain, but not its balancing strategy.
+func (p *Pool) materializeBackups(next http.Handler) (PoolManager, error) {
+	backup, err := roundrobin.New(next, roundrobin.Logger(&oxyLogger))
+	if err != nil {
+		return nil, err
+	}
+
+	p.ListBackupMembers = func() []*url.URL {
+		return backup.Servers()
+	}
+
+	p.AddBackupMember = func(member string) error {
+		u, uerr := url.Parse(member)
+		if uerr != nil {
+			return uerr
+		}
+		return backup.UpsertServer(u, p.GetBackupMember(u).Weight)
+	}
+
+	p.RemoveBackupMember = func(member string) error {
+		u, uerr := url.Parse(member)
+		if uerr != nil {
+			return uerr
+		}
+		if uerr = backup.RemoveServer(u); uerr != nil {
+			if uerr.Error() == "server not found" {
+				return ErrNoSuchMemberError
+			}
+			return uerr
+		}
+		return nil
+	}
+
+	for _, member := range p.Config.BackupMembers {
+		DebugOut.Printf("\t\tAdding backup member '%s'\n", member)
+		if err := p.AddBackupMember(member); err != nil {
+			return nil, fmt.Errorf("error adding backup member '%s': %w", member, err)
+		}
+	}
+
+	return backup, nil
+}
@@ -0,0 +1,71 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPoolBackupMembers(t *testing.T) {
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backup"))
+	}))
+	defer backup.Close()
+
+	Convey("When a Pool has BackupMembers, they only get traffic when there are no primary members", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:          "backuptest",
+			Members:       []string{primary.URL},
+			BackupMembers: []string{backup.URL},
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(len(pool.ListMembers()), ShouldEqual, 1)
+		So(len(pool.ListBackupMembers()), ShouldEqual, 1)
+
+		get := func() string {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			return rr.Body.String()
+		}
+
+		for i := 0; i < 5; i++ {
+			So(get(), ShouldEqual, "primary")
+		}
+
+		So(pool.RemoveMember(primary.URL), ShouldBeNil)
+		for i := 0; i < 5; i++ {
+			So(get(), ShouldEqual, "backup")
+		}
+
+		So(pool.AddMember(primary.URL), ShouldBeNil)
+		So(get(), ShouldEqual, "primary")
+
+		Convey("... and backups are pruned separately from the primaries", func() {
+			So(pool.RemoveBackupMember(backup.URL), ShouldBeNil)
+			So(pool.ListBackupMembers(), ShouldBeEmpty)
+			So(len(pool.ListMembers()), ShouldEqual, 1)
+			So(pool.RemoveBackupMember(backup.URL), ShouldEqual, ErrNoSuchMemberError)
+			So(pool.AddBackupMember(backup.URL), ShouldBeNil)
+			So(len(pool.ListBackupMembers()), ShouldEqual, 1)
+		})
+	})
+
+	Convey("When a Pool has no BackupMembers, the backup functions are not defined", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:    "nobackuptest",
+			Members: []string{primary.URL},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(pool.ListBackupMembers, ShouldBeNil)
+		So(pool.AddBackupMember, ShouldBeNil)
+	})
+}
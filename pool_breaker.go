@@ -0,0 +1,233 @@
+package jar
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultCircuitBreakerErrorRatio] = 0.5
+	ConfigAdditions[ConfigPoolsDefaultCircuitBreakerOpenDuration] = 30 * time.Second
+	ConfigAdditions[ConfigPoolsDefaultCircuitBreakerProbes] = 5
+	ConfigAdditions[ConfigPoolsCircuitBreakerWindow] = 10 * time.Second
+	ConfigAdditions[ConfigPoolsCircuitBreakerMinRequests] = 10
+}
+
+// breakerState is the state of a member's circuit
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// String returns the string representation of the state
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// memberBreaker is the circuit for a single Pool member
+type memberBreaker struct {
+	lock        sync.Mutex
+	member      *url.URL
+	state       breakerState
+	windowStart time.Time
+	total       int
+	failures    int
+	probes      int
+}
+
+// CircuitBreakers is a MemberObserver factory that tracks the outcomes of requests to each member of a Pool,
+// removing members whose error ratio exceeds the threshold, and returning them after a while to be probed
+type CircuitBreakers struct {
+	// ErrorRatio is the ratio (0.0-1.0) of failed requests that will open a member's circuit
+	ErrorRatio float64
+	// Latency is how long a member may take to respond before the request is considered failed. Zero disables.
+	Latency time.Duration
+	// OpenDuration is how long a member's circuit stays open before it is half-opened
+	OpenDuration time.Duration
+	// Probes is the number of consecutive successes a half-open member must serve before its circuit is closed
+	Probes int
+	// Window is how long requests are counted before the counts are reset
+	Window time.Duration
+	// MinRequests is the number of requests that must be counted in a Window before a circuit may be opened
+	MinRequests int
+
+	pool     *Pool
+	breakers sync.Map // string -> *memberBreaker
+	lock     sync.Mutex
+}
+
+// NewCircuitBreakers returns CircuitBreakers for the specified Pool, configured from the PoolConfig
+// and global defaults
+func NewCircuitBreakers(pool *Pool) *CircuitBreakers {
+	cb := CircuitBreakers{
+		ErrorRatio:   Conf.GetFloat64(ConfigPoolsDefaultCircuitBreakerErrorRatio),
+		OpenDuration: Conf.GetDuration(ConfigPoolsDefaultCircuitBreakerOpenDuration),
+		Probes:       Conf.GetInt(ConfigPoolsDefaultCircuitBreakerProbes),
+		Window:       Conf.GetDuration(ConfigPoolsCircuitBreakerWindow),
+		MinRequests:  Conf.GetInt(ConfigPoolsCircuitBreakerMinRequests),
+		pool:         pool,
+	}
+
+	if pool.Config.CircuitBreakerErrorRatio > 0 {
+		cb.ErrorRatio = pool.Config.CircuitBreakerErrorRatio
+	}
+	if pool.Config.CircuitBreakerOpenDuration > 0 {
+		cb.OpenDuration = pool.Config.CircuitBreakerOpenDuration
+	}
+	if pool.Config.CircuitBreakerProbes > 0 {
+		cb.Probes = pool.Config.CircuitBreakerProbes
+	}
+	cb.Latency = pool.Config.CircuitBreakerLatency
+
+	return &cb
+}
+
+// Observe is a MemberObserver that counts the outcome against the member's circuit
+func (cb *CircuitBreakers) Observe(member *url.URL, code int, latency time.Duration, err error) {
+	failed := err != nil || code >= 500 || (cb.Latency > 0 && latency > cb.Latency)
+
+	v, _ := cb.breakers.LoadOrStore(member.String(), &memberBreaker{member: CopyURL(member), windowStart: time.Now()})
+	b := v.(*memberBreaker)
+
+	b.lock.Lock()
+	var trip bool
+	switch b.state {
+	case breakerOpen:
+		// Stragglers that were in-flight when the circuit opened
+		b.lock.Unlock()
+		return
+	case breakerHalfOpen:
+		if failed {
+			trip = true
+		} else if b.probes++; b.probes >= cb.Probes {
+			b.state = breakerClosed
+			b.total = 0
+			b.failures = 0
+			b.windowStart = time.Now()
+			b.lock.Unlock()
+			cb.transition(b, breakerClosed, "probes succeeded")
+			return
+		}
+	case breakerClosed:
+		if time.Since(b.windowStart) > cb.Window {
+			b.windowStart = time.Now()
+			b.total = 0
+			b.failures = 0
+		}
+		b.total++
+		if failed {
+			b.failures++
+		}
+		trip = b.total >= cb.MinRequests && float64(b.failures)/float64(b.total) >= cb.ErrorRatio
+	}
+
+	if !trip {
+		b.lock.Unlock()
+		return
+	}
+	reason := fmt.Sprintf("%d of %d requests failed", b.failures, b.total)
+	if b.state == breakerHalfOpen {
+		reason = fmt.Sprintf("probe failed after %d successes", b.probes)
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	var others int
+	for _, u := range cb.pool.ListMembers() {
+		if u.String() != b.member.String() {
+			others++
+		}
+	}
+	if others == 0 {
+		// Never empty the Pool. Start over, so we don't re-evaluate on every subsequent request
+		b.windowStart = time.Now()
+		b.total = 0
+		b.failures = 0
+		b.probes = 0
+		b.lock.Unlock()
+		DebugOut.Printf("CircuitBreaker %s: not opening %s (%s), as it is the last member\n", cb.pool.Config.Name, b.member.String(), reason)
+		return
+	}
+	b.state = breakerOpen
+	b.lock.Unlock()
+
+	cb.transition(b, breakerOpen, reason)
+	if rerr := cb.pool.ejectMember(b.member.String(), ejectorCircuitBreaker); rerr != nil {
+		ErrorOut.Printf("CircuitBreaker %s: error removing %s: %s\n", cb.pool.Config.Name, b.member.String(), rerr)
+	}
+	time.AfterFunc(cb.OpenDuration, func() { cb.halfOpen(b) })
+}
+
+// State returns the state of the member's circuit as a string, and true, or an empty string and false
+// if the member has never been observed
+func (cb *CircuitBreakers) State(member *url.URL) (string, bool) {
+	v, ok := cb.breakers.Load(member.String())
+	if !ok {
+		return "", false
+	}
+	b := v.(*memberBreaker)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state.String(), true
+}
+
+// halfOpen returns the member to the Pool to be probed, unless the member has since been deleted from the Pool,
+// or is still ejected by the healthchecks or an OutlierDetector, in which case the circuit stays open for another
+// OpenDuration
+func (cb *CircuitBreakers) halfOpen(b *memberBreaker) {
+	if _, ok := cb.pool.members.Load(*b.member); !ok {
+		// Deleted while we were open, so we forget about it
+		cb.breakers.Delete(b.member.String())
+		Status.Remove(cb.statusName(b.member))
+		DebugOut.Printf("CircuitBreaker %s: %s was deleted while open, forgetting it\n", cb.pool.Config.Name, b.member.String())
+		return
+	}
+
+	if others := cb.pool.ejectors(b.member.String(), ejectorCircuitBreaker); len(others) > 0 {
+		// They'll leave it to us to return it, and we'll probe it then
+		DebugOut.Printf("CircuitBreaker %s: %s is still ejected by %s, staying open\n", cb.pool.Config.Name, b.member.String(), strings.Join(others, ", "))
+		time.AfterFunc(cb.OpenDuration, func() { cb.halfOpen(b) })
+		return
+	}
+
+	b.lock.Lock()
+	b.state = breakerHalfOpen
+	b.probes = 0
+	b.lock.Unlock()
+
+	cb.transition(b, breakerHalfOpen, "open duration elapsed")
+	if _, aerr := cb.pool.returnMember(b.member.String(), ejectorCircuitBreaker); aerr != nil {
+		ErrorOut.Printf("CircuitBreaker %s: error re-adding %s: %s\n", cb.pool.Config.Name, b.member.String(), aerr)
+	}
+}
+
+// transition logs the state change, and publishes it to Status
+func (cb *CircuitBreakers) transition(b *memberBreaker, to breakerState, reason string) {
+	msg := fmt.Sprintf("Circuit %s: %s", to.String(), reason)
+	ErrorOut.Printf("CircuitBreaker %s: %s %s\n", cb.pool.Config.Name, b.member.String(), msg)
+
+	if to == breakerClosed {
+		Status.Add(cb.statusName(b.member), "OK", nil, nil)
+	} else {
+		Status.Add(cb.statusName(b.member), "WARNING", msg, nil)
+	}
+}
+
+// statusName returns the Status name for the member's circuit
+func (cb *CircuitBreakers) statusName(u *url.URL) string {
+	return fmt.Sprintf("%s_%s_CircuitBreaker", cb.pool.Config.Name, u.String())
+}
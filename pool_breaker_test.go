@@ -0,0 +1,219 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolCircuitBreaker(t *testing.T) {
+
+	mr := Conf.GetInt(ConfigPoolsCircuitBreakerMinRequests)
+	Conf.Set(ConfigPoolsCircuitBreakerMinRequests, 4)
+	defer Conf.Set(ConfigPoolsCircuitBreakerMinRequests, mr)
+
+	Convey("When a CircuitBreaker Pool has a member that errors, its circuit opens, half-opens, and closes appropriately", t, func() {
+		var broken atomic.Bool
+		broken.Store(true)
+
+		good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer good.Close()
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if broken.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("OK"))
+		}))
+		defer bad.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:                       "breakertest",
+			Members:                    []string{good.URL, bad.URL},
+			CircuitBreaker:             true,
+			CircuitBreakerOpenDuration: 100 * time.Millisecond,
+			CircuitBreakerProbes:       2,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		var fails int
+		for i := 0; i < 20; i++ {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			if rr.Code != http.StatusOK {
+				fails++
+			}
+		}
+		So(fails, ShouldEqual, 4)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		So(pool.ListMembers()[0].String(), ShouldEqual, good.URL)
+
+		s, err := Status.Get("breakertest_" + bad.URL + "_CircuitBreaker")
+		So(err, ShouldBeNil)
+		So(s.Status, ShouldEqual, "WARNING")
+
+		broken.Store(false)
+		So(waitFor(time.Second, func() bool { return len(pool.ListMembers()) == 2 }), ShouldBeTrue)
+
+		for i := 0; i < 10; i++ {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			So(rr.Code, ShouldEqual, http.StatusOK)
+		}
+		So(pool.ListMembers(), ShouldHaveLength, 2)
+		s, _ = Status.Get("breakertest_" + bad.URL + "_CircuitBreaker")
+		So(s.Status, ShouldEqual, "OK")
+	})
+
+	Convey("When a CircuitBreaker member is deleted while open, it is not returned to the Pool", t, func() {
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer bad.Close()
+		good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer good.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:                       "breakerdeletetest",
+			Members:                    []string{good.URL, bad.URL},
+			CircuitBreaker:             true,
+			CircuitBreakerOpenDuration: 50 * time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 20; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		So(pool.DeleteMember(bad.URL), ShouldEqual, ErrNoSuchMemberError)
+
+		time.Sleep(150 * time.Millisecond)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+	})
+
+	Convey("When a CircuitBreaker member is pruned by the healthchecks while open, it stays open until they return it", t, func() {
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer bad.Close()
+		good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer good.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:                       "breakerhealthtest",
+			Members:                    []string{good.URL, bad.URL},
+			CircuitBreaker:             true,
+			CircuitBreakerOpenDuration: 50 * time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 20; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		So(pool.healthCheckRemove(bad.URL), ShouldEqual, ErrNoSuchMemberError)
+
+		time.Sleep(150 * time.Millisecond)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		s, err := Status.Get("breakerhealthtest_" + bad.URL + "_CircuitBreaker")
+		So(err, ShouldBeNil)
+		So(s.Status, ShouldEqual, "WARNING")
+
+		// Left for the CircuitBreaker to return
+		So(pool.healthCheckAdd(bad.URL), ShouldBeNil)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		So(waitFor(time.Second, func() bool { return len(pool.ListMembers()) == 2 }), ShouldBeTrue)
+	})
+
+	Convey("When a CircuitBreaker Pool's last member errors, its circuit stays closed", t, func() {
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer bad.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:           "breakerlasttest",
+			Members:        []string{bad.URL},
+			CircuitBreaker: true,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 20; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+	})
+}
+
+func TestPoolCircuitBreakerObserve(t *testing.T) {
+
+	member, _ := url.Parse("http://one:8080/")
+
+	Convey("When CircuitBreakers observe slow responses and errors, they count as failures", t, func() {
+		var removed []string
+		pool := &Pool{Config: &PoolConfig{Name: "breakerobservetest"}}
+		pool.RemoveMember = func(m string) error {
+			removed = append(removed, m)
+			return nil
+		}
+		pool.ListMembers = func() []*url.URL {
+			other, _ := url.Parse("http://two:8080/")
+			return []*url.URL{member, other}
+		}
+
+		cb := CircuitBreakers{
+			ErrorRatio:   0.5,
+			Latency:      10 * time.Millisecond,
+			OpenDuration: time.Hour,
+			Probes:       1,
+			Window:       time.Minute,
+			MinRequests:  4,
+			pool:         pool,
+		}
+
+		cb.Observe(member, 200, time.Millisecond, nil)
+		cb.Observe(member, 200, time.Millisecond, nil)
+		cb.Observe(member, 200, time.Second, nil)
+		s, ok := cb.State(member)
+		So(ok, ShouldBeTrue)
+		So(s, ShouldEqual, "closed")
+		So(removed, ShouldBeEmpty)
+
+		cb.Observe(member, 0, time.Millisecond, errors.New("connection refused"))
+		s, _ = cb.State(member)
+		So(s, ShouldEqual, "open")
+		So(removed, ShouldResemble, []string{member.String()})
+
+		// Stragglers don't re-open
+		cb.Observe(member, 500, time.Millisecond, nil)
+		So(removed, ShouldHaveLength, 1)
+	})
+}
+
+// waitFor polls the condition until it is true, or the timeout elapses, returning the last result
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return condition()
+}
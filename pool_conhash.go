@@ -3,12 +3,13 @@ package jar
 import (
 	"bytes"
 
-	"github.com/buraksezer/consistent"
 	"github.com/cespare/xxhash"
 	"github.com/vulcand/oxy/v2/roundrobin"
 
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -16,9 +17,12 @@ const (
 	// ErrConsistentHashNextServerUnsupported is returned if NextServer is called
 	ErrConsistentHashNextServerUnsupported = Error("Consistent Hash Pools don't support NextServer")
 
-	// ErrConsistentHashInvalidSource is returned the source is not one of "request", "header", or "cookie"
+	// ErrConsistentHashInvalidSource is returned the source is not one of "request", "header", "cookie", "query", "path", or "claim"
 	ErrConsistentHashInvalidSource = Error("the consistent hash source provided is not valid")
 
+	// ErrConsistentHashInvalidName is returned when a "path" name is neither a segment index nor a valid regular expression
+	ErrConsistentHashInvalidName = Error("the consistent hash name provided is not valid for its source")
+
 	// ErrConsistentHashSourceNameImbalance is returned when the configured lists are not of the same lengths
 	ErrConsistentHashSourceNameImbalance = Error("ConsistentHashSources and ConsistentHashNames are not balanced lists")
 )
@@ -28,6 +32,9 @@ const (
 	requestSource
 	headerSource
 	cookieSource
+	querySource
+	pathSource
+	claimSource
 )
 
 func init() {
@@ -45,7 +52,27 @@ func (p *Pool) materializeConsistent(next http.Handler) (PoolManager, error) {
 		return nil, err
 	}
 
-	DebugOut.Printf("\t\tConsistentHash with '%+v'\n", hashSources)
+	var fallbacks []hashSource
+	if len(p.Config.ConsistentHashFallbackSources) > 0 || len(p.Config.ConsistentHashFallbackNames) > 0 {
+		if fallbacks, err = makeHashSources(p.Config.ConsistentHashFallbackSources, p.Config.ConsistentHashFallbackNames); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Config.ConsistentHashJWTKey != "" {
+		verifier, err := newJWTVerifier(p.Config.ConsistentHashJWTKey)
+		if err != nil {
+			return nil, err
+		}
+		for i := range hashSources {
+			hashSources[i].jwt = verifier
+		}
+		for i := range fallbacks {
+			fallbacks[i].jwt = verifier
+		}
+	}
+
+	DebugOut.Printf("\t\tConsistentHash with '%+v', falling back to '%+v'\n", hashSources, fallbacks)
 
 	// Set defaults
 	partitions := Conf.GetInt(ConfigPoolsDefaultConsistentHashPartitions)
@@ -65,12 +92,24 @@ func (p *Pool) materializeConsistent(next http.Handler) (PoolManager, error) {
 		load = v
 	}
 
-	return NewConsistentHashPoolOpts(hashSources, partitions, replication, load, p, next)
+	chp, err := NewConsistentHashPoolOpts(hashSources, partitions, replication, load, p, next)
+	if err != nil {
+		return nil, err
+	}
+	chp.fallbacks = fallbacks
+	return chp, nil
 }
 
 type hashSource struct {
 	Source hashKeySource
 	Key    string
+
+	// segment is the index of the path segment for a "path" source, or -1 to use pattern
+	segment int
+	// pattern is the regular expression for a "path" source, whose first group (or whole match) is used
+	pattern *regexp.Regexp
+	// jwt verifies tokens for a "claim" source, or is nil to trust them
+	jwt *jwtVerifier
 }
 
 // makeHashSources takes lists of source and name strings, and returns a list of hashSources or an error
@@ -88,18 +127,29 @@ func makeHashSources(sources, names []string) ([]hashSource, error) {
 		if s == invalidSource {
 			return nil, ErrConsistentHashInvalidSource
 		}
-		hs[i] = hashSource{s, strings.TrimSpace(names[i])}
+		hs[i] = hashSource{Source: s, Key: strings.TrimSpace(names[i]), segment: -1}
+
+		if s == pathSource {
+			if n, err := strconv.Atoi(hs[i].Key); err == nil && n >= 0 {
+				hs[i].segment = n
+			} else if re, err := regexp.Compile(hs[i].Key); err == nil && hs[i].Key != "" {
+				hs[i].pattern = re
+			} else {
+				return nil, ErrConsistentHashInvalidName
+			}
+		}
 	}
 	return hs, nil
 }
 
 // ConsistentHashPool is a PoolManager that implements a consistent hash on a key to return
-// the proper member consistently
+// the proper member consistently. Members receive a share of the keyspace proportional to their weight.
 type ConsistentHashPool struct {
-	conhash *consistent.Consistent
-	sources []hashSource
-	pool    *Pool
-	next    http.Handler
+	conhash   *weightedRing
+	sources   []hashSource
+	fallbacks []hashSource
+	pool      *Pool
+	next      http.Handler
 }
 
 // NewConsistentHashPool returns a primed ConsistentHashPool
@@ -114,16 +164,8 @@ func NewConsistentHashPool(source, key string, pool *Pool, next http.Handler) (*
 // NewConsistentHashPoolOpts exposes some internal tunables, but still returns a ConsistentHashPool
 func NewConsistentHashPoolOpts(sourceKeys []hashSource, partitionCount, replicationFactor int, load float64, pool *Pool, next http.Handler) (*ConsistentHashPool, error) {
 
-	cfg := consistent.Config{
-		PartitionCount:    partitionCount,
-		ReplicationFactor: replicationFactor,
-		Load:              load,
-		Hasher:            hasher{},
-	}
-	c := consistent.New(nil, cfg)
-
 	chp := ConsistentHashPool{
-		conhash: c,
+		conhash: newWeightedRing(partitionCount, replicationFactor, load),
 		sources: sourceKeys,
 		pool:    pool,
 		next:    next,
@@ -139,10 +181,10 @@ func (m *Member) String() string {
 
 // Servers returns a list of member URLs
 func (ch *ConsistentHashPool) Servers() []*url.URL {
-	ml := ch.conhash.GetMembers()
+	ml := ch.conhash.Members()
 	sl := make([]*url.URL, len(ml))
 	for i, m := range ml {
-		sl[i] = m.(*Member).URL
+		sl[i] = m.URL
 	}
 	return sl
 }
@@ -153,21 +195,25 @@ func (ch *ConsistentHashPool) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	newReq := *r
 
 	b := getAllHashKeysFromReq(ch.sources, &newReq)
+	for i := 0; len(b) == 0 && i < len(ch.fallbacks); i++ {
+		// Primary key is empty, so work down the fallbacks until one isn't
+		b = getHashKeyFromReq(ch.fallbacks[i], &newReq)
+	}
 	DebugOut.Printf("CH: %s\n", string(b))
-	m := ch.conhash.LocateKey(b)
+	m := ch.conhash.Locate(b)
 	if m == nil {
 		// frick, pool is probably empty
 		RequestErrorResponse(r, w, "Pool faulted, and likely is empty", http.StatusServiceUnavailable)
 		return
 	}
-	newReq.URL = m.(*Member).URL
+	newReq.URL = m.URL
 
 	ch.next.ServeHTTP(w, &newReq)
 }
 
-// ServerWeight is a noop to implement PoolManager
+// ServerWeight returns the weight of the specified member, and true, or -1 and false if it is not a member
 func (ch *ConsistentHashPool) ServerWeight(u *url.URL) (int, bool) {
-	return 0, false
+	return ch.conhash.Weight(u.String())
 }
 
 // RemoveServer removes the specified member from the pool
@@ -176,19 +222,24 @@ func (ch *ConsistentHashPool) RemoveServer(u *url.URL) error {
 	return nil
 }
 
-// UpsertServer adds or updates the member to the pool
+// UpsertServer adds or updates the member to the pool. If no options are provided, and there is a Pool
+// attached, the Member weight is used. Updating the weight of an existing member only moves the keys
+// necessary to honor it.
 func (ch *ConsistentHashPool) UpsertServer(u *url.URL, options ...roundrobin.ServerOption) error {
 	var m *Member
 	if ch.pool != nil {
 		// We have a pool, so let it render a Member for us
 		m = ch.pool.GetMember(u)
+		if len(options) == 0 {
+			options = append(options, m.Weight)
+		}
 	} else {
 		// Render a trivial Member
 		m = &Member{
 			URL: u,
 		}
 	}
-	ch.conhash.Add(m)
+	ch.conhash.Add(m, serverOptionsToWeight(options...))
 	return nil
 }
 
@@ -211,6 +262,12 @@ func stringToHashKeySource(source string) hashKeySource {
 		return headerSource
 	case "cookie":
 		return cookieSource
+	case "query":
+		return querySource
+	case "path":
+		return pathSource
+	case "claim":
+		return claimSource
 	default:
 		return invalidSource
 	}
@@ -220,18 +277,19 @@ func stringToHashKeySource(source string) hashKeySource {
 func getAllHashKeysFromReq(sourceKeys []hashSource, req *http.Request) []byte {
 	var b bytes.Buffer
 	for _, v := range sourceKeys {
-		b.Write(getHashKeyFromReq(v.Key, v.Source, req))
+		b.Write(getHashKeyFromReq(v, req))
 	}
 	return b.Bytes()
 }
 
 // getHashKeyFromReq follows the hashKey rules to return the proper []byte
-func getHashKeyFromReq(key string, source hashKeySource, req *http.Request) []byte {
+func getHashKeyFromReq(source hashSource, req *http.Request) []byte {
+	key := source.Key
 	lkey := strings.ToLower(key)
-	switch source {
+	switch source.Source {
 	case requestSource:
 		if lkey == "remoteaddr" {
-			return []byte(strings.SplitN(req.RemoteAddr, ":", 2)[0])
+			return []byte(ipOnly(req.RemoteAddr))
 		} else if lkey == "url" {
 			return []byte(req.URL.String())
 		} else if lkey == "host" {
@@ -245,13 +303,29 @@ func getHashKeyFromReq(key string, source hashKeySource, req *http.Request) []by
 			break
 		}
 		return []byte(cookie.Value)
+	case querySource:
+		return []byte(req.URL.Query().Get(key))
+	case pathSource:
+		if source.pattern == nil {
+			segments := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+			if source.segment < len(segments) {
+				return []byte(segments[source.segment])
+			}
+			break
+		}
+		if m := source.pattern.FindStringSubmatch(req.URL.Path); len(m) > 1 {
+			return []byte(m[1])
+		} else if len(m) == 1 {
+			return []byte(m[0])
+		}
+	case claimSource:
+		return []byte(jwtClaim(req, key, source.jwt))
 	}
 
 	return []byte("")
 }
 
-// consistent package doesn't provide a default hashing function.
-// You should provide a proper one to distribute keys/members uniformly.
+// hasher distributes keys and members uniformly around the ring
 type hasher struct{}
 
 func (h hasher) Sum64(data []byte) uint64 {
@@ -0,0 +1,184 @@
+package jar
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA256
+	_ "crypto/sha512" // registers SHA384 and SHA512
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ErrJWTMalformed is returned when a token isn't a JWT
+	ErrJWTMalformed = Error("the token is not a well-formed JWT")
+
+	// ErrJWTUnverified is returned when a JWT's signature doesn't verify, or its algorithm isn't supported
+	ErrJWTUnverified = Error("the JWT signature could not be verified")
+
+	// ErrJWTExpired is returned when a verified JWT has expired, or is not yet valid
+	ErrJWTExpired = Error("the JWT has expired, or is not yet valid")
+
+	// ErrJWTInvalidKey is returned when a JWT verification key can't be used
+	ErrJWTInvalidKey = Error("the JWT key is not a shared secret, or a PEM RSA or ECDSA public key")
+)
+
+// jwtVerifier verifies JWT signatures with a shared secret (HS256, HS384, HS512), or a public key (RS256, RS384,
+// RS512, ES256, ES384, ES512). A nil *jwtVerifier trusts every token.
+type jwtVerifier struct {
+	secret []byte
+	public crypto.PublicKey
+}
+
+// newJWTVerifier returns a jwtVerifier for the key, which is either a PEM-encoded public key, or a shared secret
+func newJWTVerifier(key string) (*jwtVerifier, error) {
+	if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		return &jwtVerifier{secret: []byte(key)}, nil
+	}
+
+	block, _ := pem.Decode([]byte(strings.TrimSpace(key)))
+	if block == nil {
+		return nil, ErrJWTInvalidKey
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		if pub, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, ErrJWTInvalidKey
+		}
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return &jwtVerifier{public: pub}, nil
+	default:
+		return nil, ErrJWTInvalidKey
+	}
+}
+
+// verify checks the signature of the signed part of a JWT with the named algorithm
+func (v *jwtVerifier) verify(alg, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return ErrJWTUnverified
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS") && v.secret != nil:
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(signed))
+		if hmac.Equal(mac.Sum(nil), sig) {
+			return nil
+		}
+	case strings.HasPrefix(alg, "RS"):
+		if pub, ok := v.public.(*rsa.PublicKey); ok {
+			h := hash.New()
+			h.Write([]byte(signed))
+			if rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig) == nil {
+				return nil
+			}
+		}
+	case strings.HasPrefix(alg, "ES"):
+		if pub, ok := v.public.(*ecdsa.PublicKey); ok && len(sig)%2 == 0 {
+			h := hash.New()
+			h.Write([]byte(signed))
+			r := new(big.Int).SetBytes(sig[:len(sig)/2])
+			s := new(big.Int).SetBytes(sig[len(sig)/2:])
+			if ecdsa.Verify(pub, h.Sum(nil), r, s) {
+				return nil
+			}
+		}
+	}
+	return ErrJWTUnverified
+}
+
+// jwtClaims returns the claims of the JWT. If v is not nil, the signature is verified, and "exp" and "nbf" are
+// enforced.
+func jwtClaims(token string, v *jwtVerifier) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	var claims map[string]interface{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	if v == nil {
+		return claims, nil
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hb, &header) != nil {
+		return nil, ErrJWTMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(header.Alg) != 5 {
+		return nil, ErrJWTUnverified
+	}
+	if err = v.verify(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, ErrJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, ErrJWTExpired
+	}
+	return claims, nil
+}
+
+// jwtClaim returns the named claim from the bearer token in the Authorization header, or an empty string. Nested
+// claims may be named with dots, e.g. "org.id".
+func jwtClaim(req *http.Request, name string, v *jwtVerifier) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+
+	claims, err := jwtClaims(strings.TrimSpace(auth[7:]), v)
+	if err != nil {
+		DebugOut.Printf("CH: ignoring JWT: %s\n", err)
+		return ""
+	}
+
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[part]
+	}
+	switch c := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	default:
+		b, _ := json.Marshal(c)
+		return string(b)
+	}
+}
@@ -0,0 +1,123 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testJWT returns a JWT with the claims, signed with the algorithm and key (a []byte secret, or a private key)
+func testJWT(t *testing.T, alg string, key interface{}, claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	signed := enc([]byte(fmt.Sprintf(`{"alg":"%s","typ":"JWT"}`, alg))) + "." + enc([]byte(claims))
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, h.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return signed + "." + enc(sig)
+}
+
+// testPEM returns the PEM encoding of the public key
+func testPEM(t *testing.T, pub crypto.PublicKey) string {
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}))
+}
+
+func TestJWTClaims(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claim := func(token string, v *jwtVerifier) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "bearer "+token)
+		return jwtClaim(req, "sub", v)
+	}
+
+	Convey("When there is no key, claims are used unverified", t, func() {
+		So(claim(testJWT(t, "HS256", []byte("whatever"), `{"sub":"bob"}`), nil), ShouldEqual, "bob")
+		So(claim("not.a.jwt", nil), ShouldBeEmpty)
+		So(claim("nope", nil), ShouldBeEmpty)
+	})
+
+	Convey("When there is a shared secret, only tokens signed with it are used", t, func() {
+		v, err := newJWTVerifier("sekrit")
+		So(err, ShouldBeNil)
+		for _, alg := range []string{"HS256", "HS384", "HS512"} {
+			So(claim(testJWT(t, alg, []byte("sekrit"), `{"sub":"bob"}`), v), ShouldEqual, "bob")
+			So(claim(testJWT(t, alg, []byte("wrong"), `{"sub":"bob"}`), v), ShouldBeEmpty)
+		}
+		So(claim(testJWT(t, "RS256", rsaKey, `{"sub":"bob"}`), v), ShouldBeEmpty)
+	})
+
+	Convey("When there is a public key, only tokens signed with its private key are used", t, func() {
+		v, err := newJWTVerifier(testPEM(t, &rsaKey.PublicKey))
+		So(err, ShouldBeNil)
+		So(claim(testJWT(t, "RS256", rsaKey, `{"sub":"bob"}`), v), ShouldEqual, "bob")
+		So(claim(testJWT(t, "RS512", rsaKey, `{"sub":"bob"}`), v), ShouldEqual, "bob")
+		So(claim(testJWT(t, "HS256", []byte(testPEM(t, &rsaKey.PublicKey)), `{"sub":"bob"}`), v), ShouldBeEmpty)
+
+		v, err = newJWTVerifier(testPEM(t, &ecKey.PublicKey))
+		So(err, ShouldBeNil)
+		So(claim(testJWT(t, "ES256", ecKey, `{"sub":"bob"}`), v), ShouldEqual, "bob")
+		So(claim(testJWT(t, "ES256", otherKey, `{"sub":"bob"}`), v), ShouldBeEmpty)
+
+		_, err = newJWTVerifier("-----BEGIN PUBLIC KEY-----\nnope\n-----END PUBLIC KEY-----\n")
+		So(err, ShouldEqual, ErrJWTInvalidKey)
+	})
+
+	Convey("When a verified token has expired, or isn't valid yet, it isn't used", t, func() {
+		v, _ := newJWTVerifier("sekrit")
+		now := time.Now().Unix()
+		So(claim(testJWT(t, "HS256", []byte("sekrit"), fmt.Sprintf(`{"sub":"bob","exp":%d}`, now+60)), v), ShouldEqual, "bob")
+		So(claim(testJWT(t, "HS256", []byte("sekrit"), fmt.Sprintf(`{"sub":"bob","exp":%d}`, now-60)), v), ShouldBeEmpty)
+		So(claim(testJWT(t, "HS256", []byte("sekrit"), fmt.Sprintf(`{"sub":"bob","nbf":%d}`, now+60)), v), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,247 @@
+package jar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// ringMaxVirtualNodes caps the number of places a single member may have on a weightedRing, so very large
+// weights don't make the ring unwieldy
+const ringMaxVirtualNodes = 4096
+
+// ringMember is a Member on a weightedRing, its weight, and how many places it has on the ring
+type ringMember struct {
+	member *Member
+	weight int
+	vnodes int
+}
+
+// weightedRing is a consistent hash ring with bounded loads, modelled after github.com/buraksezer/consistent,
+// but where each member's places on the ring, and share of partitions, are proportional to its weight. Keys are
+// hashed into partitions, and each partition is owned by the closest member on the ring that still has capacity
+// for it. When members or weights change, partitions stay with their owners unless the ring or the capacities
+// say otherwise, so only the partitions that need to move do.
+type weightedRing struct {
+	lock              sync.RWMutex
+	hasher            hasher
+	partitionCount    uint64
+	replicationFactor int
+	load              float64
+	members           map[string]*ringMember
+	ring              map[uint64]*ringMember
+	sortedSet         []uint64
+	partitions        []*ringMember
+}
+
+// newWeightedRing returns an empty weightedRing
+func newWeightedRing(partitionCount, replicationFactor int, load float64) *weightedRing {
+	if partitionCount < 1 {
+		partitionCount = 1
+	}
+	if replicationFactor < 1 {
+		replicationFactor = 1
+	}
+	return &weightedRing{
+		partitionCount:    uint64(partitionCount),
+		replicationFactor: replicationFactor,
+		load:              load,
+		members:           make(map[string]*ringMember),
+		ring:              make(map[uint64]*ringMember),
+		partitions:        make([]*ringMember, partitionCount),
+	}
+}
+
+// Add adds the Member to the ring with the specified weight, or updates the weight
+// of an existing Member
+func (w *weightedRing) Add(m *Member, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	name := m.String()
+	rm, ok := w.members[name]
+	if ok && rm.weight == weight {
+		// Nothing to do
+		return
+	} else if !ok {
+		rm = &ringMember{member: m}
+		w.members[name] = rm
+	}
+
+	rm.weight = weight
+	w.place(name, rm, min(w.replicationFactor*weight, max(w.replicationFactor, ringMaxVirtualNodes)))
+	w.distribute()
+}
+
+// Remove removes the named Member from the ring, returning false if it wasn't there
+func (w *weightedRing) Remove(name string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	rm, ok := w.members[name]
+	if !ok {
+		return false
+	}
+
+	w.place(name, rm, 0)
+	delete(w.members, name)
+	w.distribute()
+	return true
+}
+
+// place adds or removes the member's places on the ring until it has vnodes of them. Places are numbered, so
+// growing or shrinking a member only adds or removes its last places. The caller must hold the lock.
+func (w *weightedRing) place(name string, rm *ringMember, vnodes int) {
+	for i := rm.vnodes; i < vnodes; i++ {
+		w.ring[w.hasher.Sum64([]byte(fmt.Sprintf("%s%d", name, i)))] = rm
+	}
+	for i := vnodes; i < rm.vnodes; i++ {
+		delete(w.ring, w.hasher.Sum64([]byte(fmt.Sprintf("%s%d", name, i))))
+	}
+	rm.vnodes = vnodes
+
+	w.sortedSet = w.sortedSet[:0]
+	for h := range w.ring {
+		w.sortedSet = append(w.sortedSet, h)
+	}
+	sort.Slice(w.sortedSet, func(i, j int) bool {
+		return w.sortedSet[i] < w.sortedSet[j]
+	})
+}
+
+// Members returns a list of the Members on the ring
+func (w *weightedRing) Members() []*Member {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	ml := make([]*Member, 0, len(w.members))
+	for _, rm := range w.members {
+		ml = append(ml, rm.member)
+	}
+	return ml
+}
+
+// Weight returns the weight of the named Member, and true, or -1 and false if it isn't on the ring
+func (w *weightedRing) Weight(name string) (int, bool) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if rm, ok := w.members[name]; ok {
+		return rm.weight, true
+	}
+	return -1, false
+}
+
+// Loads returns a map of Member names to the number of partitions they own
+func (w *weightedRing) Loads() map[string]int {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	loads := make(map[string]int)
+	for _, rm := range w.partitions {
+		if rm != nil {
+			loads[rm.member.String()]++
+		}
+	}
+	return loads
+}
+
+// Locate returns the Member that owns the key, or nil if the ring is empty
+func (w *weightedRing) Locate(key []byte) *Member {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if rm := w.partitions[w.hasher.Sum64(key)%w.partitionCount]; rm != nil {
+		return rm.member
+	}
+	return nil
+}
+
+// distribute assigns each partition to the closest member on the ring that has capacity for it, preferring
+// to leave partitions with their current owners. A partition stays put if its owner is still the closest
+// member, moves if a different member is now the closest and has capacity for it, or else stays put if its
+// owner has capacity for it. The remainder go to the next closest member with capacity.
+// The caller must hold the lock.
+func (w *weightedRing) distribute() {
+	partitions := make([]*ringMember, w.partitionCount)
+	if len(w.members) == 0 {
+		w.partitions = partitions
+		return
+	}
+
+	var totalWeight int
+	for _, rm := range w.members {
+		totalWeight += rm.weight
+	}
+
+	var (
+		loads    = make(map[*ringMember]int)
+		capacity = func(rm *ringMember) int {
+			return int(math.Ceil(float64(w.partitionCount) * float64(rm.weight) / float64(totalWeight) * w.load))
+		}
+		closest = make([]int, w.partitionCount)
+		bs      = make([]byte, 8)
+	)
+
+	// Keep the partitions that are where they belong
+	for partID := uint64(0); partID < w.partitionCount; partID++ {
+		binary.LittleEndian.PutUint64(bs, partID)
+		key := w.hasher.Sum64(bs)
+		closest[partID] = sort.Search(len(w.sortedSet), func(i int) bool {
+			return w.sortedSet[i] >= key
+		})
+
+		owner := w.ring[w.sortedSet[closest[partID]%len(w.sortedSet)]]
+		if owner == w.partitions[partID] && loads[owner] < capacity(owner) {
+			partitions[partID] = owner
+			loads[owner]++
+		}
+	}
+
+	// Move the partitions that belong elsewhere, if there's room, or else keep them if there's room
+	for partID := uint64(0); partID < w.partitionCount; partID++ {
+		if partitions[partID] != nil {
+			continue
+		}
+		owner := w.ring[w.sortedSet[closest[partID]%len(w.sortedSet)]]
+		if loads[owner] >= capacity(owner) {
+			// Removed members have no places left on the ring
+			owner = w.partitions[partID]
+			if owner == nil || owner.vnodes == 0 || loads[owner] >= capacity(owner) {
+				continue
+			}
+		}
+		partitions[partID] = owner
+		loads[owner]++
+	}
+
+	// Walk the ring for the rest
+	for partID := uint64(0); partID < w.partitionCount; partID++ {
+		if partitions[partID] != nil {
+			continue
+		}
+		idx := closest[partID]
+
+		var owner *ringMember
+		for c := 0; c < len(w.sortedSet); c++ {
+			rm := w.ring[w.sortedSet[(idx+c)%len(w.sortedSet)]]
+			if loads[rm] < capacity(rm) {
+				owner = rm
+				break
+			}
+		}
+		if owner == nil {
+			// Load is set too low for everything to fit, so we overload the closest member
+			owner = w.ring[w.sortedSet[idx%len(w.sortedSet)]]
+		}
+		partitions[partID] = owner
+		loads[owner]++
+	}
+	w.partitions = partitions
+}
@@ -3,7 +3,9 @@ package jar
 import (
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/roundrobin"
 
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -293,3 +295,229 @@ func TestPoolConsistentHashNoHash(t *testing.T) {
 		So(*first, ShouldEqual, 40)
 	})
 }
+
+func TestPoolConsistentHashWeighted(t *testing.T) {
+
+	oneURL, _ := url.Parse("http://one:8080/")
+	twoURL, _ := url.Parse("http://two:8080/")
+	threeURL, _ := url.Parse("http://three:8080/")
+
+	Convey("When a three-member ch is created with weights, the keyspace is shared proportionally", t, func() {
+		sources, err := makeHashSources([]string{"request"}, []string{"url"})
+		So(err, ShouldBeNil)
+
+		lb, err := NewConsistentHashPoolOpts(sources, 271, 20, 1.25, nil, http.NotFoundHandler())
+		So(err, ShouldBeNil)
+
+		So(lb.UpsertServer(oneURL, roundrobin.Weight(4)), ShouldBeNil)
+		So(lb.UpsertServer(twoURL), ShouldBeNil)
+		So(lb.UpsertServer(threeURL), ShouldBeNil)
+		So(len(lb.Servers()), ShouldEqual, 3)
+
+		w, ok := lb.ServerWeight(oneURL)
+		So(ok, ShouldBeTrue)
+		So(w, ShouldEqual, 4)
+		w, ok = lb.ServerWeight(twoURL)
+		So(ok, ShouldBeTrue)
+		So(w, ShouldEqual, 1)
+
+		loads := lb.conhash.Loads()
+		So(loads[oneURL.String()]+loads[twoURL.String()]+loads[threeURL.String()], ShouldEqual, 271)
+		So(loads[oneURL.String()], ShouldBeGreaterThan, 2*loads[twoURL.String()])
+		So(loads[oneURL.String()], ShouldBeGreaterThan, 2*loads[threeURL.String()])
+
+		Convey("... and when a weight is changed at runtime, most keys stay put", func() {
+			before := make([]string, 1000)
+			for i := range before {
+				before[i] = lb.conhash.Locate([]byte(fmt.Sprintf("key%d", i))).String()
+			}
+
+			So(lb.UpsertServer(twoURL, roundrobin.Weight(2)), ShouldBeNil)
+			w, _ := lb.ServerWeight(twoURL)
+			So(w, ShouldEqual, 2)
+			So(len(lb.Servers()), ShouldEqual, 3)
+
+			var moved int
+			for i := range before {
+				if lb.conhash.Locate([]byte(fmt.Sprintf("key%d", i))).String() != before[i] {
+					moved++
+				}
+			}
+			So(moved, ShouldBeGreaterThan, 0)
+			So(moved, ShouldBeLessThan, 300)
+		})
+	})
+
+	Convey("When a ch has members with different weights, each member's share of keys tracks its weight", t, func() {
+		sources, err := makeHashSources([]string{"request"}, []string{"url"})
+		So(err, ShouldBeNil)
+
+		lb, err := NewConsistentHashPoolOpts(sources, 271, 20, 1.25, nil, http.NotFoundHandler())
+		So(err, ShouldBeNil)
+
+		for w := 1; w <= 4; w++ {
+			u, _ := url.Parse(fmt.Sprintf("http://weight%d:8080/", w))
+			So(lb.UpsertServer(u, roundrobin.Weight(w)), ShouldBeNil)
+		}
+
+		shares := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			shares[lb.conhash.Locate([]byte(fmt.Sprintf("key%d", i))).String()]++
+		}
+		for w := 1; w <= 4; w++ {
+			// 10000 keys, and a total weight of 10
+			So(shares[fmt.Sprintf("http://weight%d:8080/", w)], ShouldBeBetween, w*750, w*1250)
+		}
+	})
+
+	Convey("When a member is added to a ch, only about its share of keys move, and most of them to it", t, func() {
+		sources, err := makeHashSources([]string{"request"}, []string{"url"})
+		So(err, ShouldBeNil)
+
+		lb, err := NewConsistentHashPoolOpts(sources, 271, 20, 1.25, nil, http.NotFoundHandler())
+		So(err, ShouldBeNil)
+
+		for i := 1; i <= 4; i++ {
+			u, _ := url.Parse(fmt.Sprintf("http://m%d:8080/", i))
+			So(lb.UpsertServer(u), ShouldBeNil)
+		}
+		before := make([]string, 10000)
+		for i := range before {
+			before[i] = lb.conhash.Locate([]byte(fmt.Sprintf("key%d", i))).String()
+		}
+
+		fifth, _ := url.Parse("http://m5:8080/")
+		So(lb.UpsertServer(fifth), ShouldBeNil)
+
+		var moved, toFifth int
+		after := make([]string, len(before))
+		for i := range before {
+			after[i] = lb.conhash.Locate([]byte(fmt.Sprintf("key%d", i))).String()
+			if after[i] != before[i] {
+				moved++
+				if after[i] == fifth.String() {
+					toFifth++
+				}
+			}
+		}
+		// 1/N is 2000
+		So(moved, ShouldBeBetween, 1000, 3000)
+		So(toFifth, ShouldBeGreaterThan, moved*8/10)
+
+		Convey("... and when it is removed, only its keys move", func() {
+			So(lb.RemoveServer(fifth), ShouldBeNil)
+
+			var moved int
+			for i := range after {
+				if after[i] != fifth.String() && lb.conhash.Locate([]byte(fmt.Sprintf("key%d", i))).String() != after[i] {
+					moved++
+				}
+			}
+			So(moved, ShouldEqual, 0)
+		})
+	})
+
+	Convey("When a ch has more members than partitions, it doesn't fall over", t, func() {
+		lb, err := NewConsistentHashPool("request", "url", nil, http.NotFoundHandler())
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 20; i++ {
+			u, _ := url.Parse(fmt.Sprintf("http://member%d:8080/", i))
+			So(lb.UpsertServer(u), ShouldBeNil)
+		}
+		So(len(lb.Servers()), ShouldEqual, 20)
+		So(lb.conhash.Locate([]byte("key")), ShouldNotBeNil)
+	})
+}
+
+func TestPoolConsistentHashSources(t *testing.T) {
+
+	key := func(source, name, target string, mod ...func(*http.Request)) string {
+		sources, err := makeHashSources([]string{source}, []string{name})
+		So(err, ShouldBeNil)
+		req := httptest.NewRequest("GET", target, nil)
+		for _, m := range mod {
+			m(req)
+		}
+		return string(getAllHashKeysFromReq(sources, req))
+	}
+
+	Convey("When the source is a query parameter, its value is the key", t, func() {
+		So(key("query", "tenant", "/api/things?tenant=acme&x=1"), ShouldEqual, "acme")
+		So(key("query", "tenant", "/api/things"), ShouldBeEmpty)
+	})
+
+	Convey("When the source is the path, a segment or a regular expression group is the key", t, func() {
+		So(key("path", "1", "/tenants/acme/things/12"), ShouldEqual, "acme")
+		So(key("path", "9", "/tenants/acme/things/12"), ShouldBeEmpty)
+		So(key("path", "^/tenants/([^/]+)/", "/tenants/acme/things/12"), ShouldEqual, "acme")
+		So(key("path", "/things/[0-9]+", "/tenants/acme/things/12"), ShouldEqual, "/things/12")
+		So(key("path", "^/tenants/([^/]+)/", "/other"), ShouldBeEmpty)
+
+		_, err := makeHashSources([]string{"path"}, []string{"(unclosed"})
+		So(err, ShouldEqual, ErrConsistentHashInvalidName)
+	})
+
+	Convey("When the source is a claim, its value from the bearer JWT is the key", t, func() {
+		token := testJWT(t, "HS256", []byte("sekrit"), `{"sub":"bob","org":{"id":42}}`)
+		bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+		So(key("claim", "sub", "/", bearer), ShouldEqual, "bob")
+		So(key("claim", "org.id", "/", bearer), ShouldEqual, "42")
+		So(key("claim", "nope", "/", bearer), ShouldBeEmpty)
+		So(key("claim", "sub", "/"), ShouldBeEmpty)
+	})
+
+	Convey("When the source is the remote address, IPv6 addresses are kept whole", t, func() {
+		So(key("request", "remoteaddr", "/", func(r *http.Request) { r.RemoteAddr = "[2001:db8::1]:4321" }), ShouldEqual, "2001:db8::1")
+		So(key("request", "remoteaddr", "/", func(r *http.Request) { r.RemoteAddr = "10.1.2.3:4321" }), ShouldEqual, "10.1.2.3")
+	})
+
+	Convey("When a Pool's primary key is empty, the fallbacks are tried in order", t, func() {
+		members := make(map[string]string)
+		backend := func(name string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name))
+			}))
+		}
+		for _, n := range []string{"one", "two", "three", "four"} {
+			s := backend(n)
+			defer s.Close()
+			members[s.URL] = n
+		}
+		var urls []string
+		for u := range members {
+			urls = append(urls, u)
+		}
+
+		pool := NewPool(&PoolConfig{
+			Name:                          "chfallbacktest",
+			Members:                       urls,
+			ConsistentHashing:             true,
+			ConsistentHashSources:         []string{"path"},
+			ConsistentHashNames:           []string{"^/tenants/([^/]+)"},
+			ConsistentHashFallbackSources: []string{"header", "query"},
+			ConsistentHashFallbackNames:   []string{"X-Tenant", "tenant"},
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		serve := func(target, header string) string {
+			req := httptest.NewRequest("GET", target, nil)
+			if header != "" {
+				req.Header.Set("X-Tenant", header)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			return rr.Body.String()
+		}
+
+		for _, tenant := range []string{"acme", "initech", "hooli", "globex", "umbrella"} {
+			want := serve("/tenants/"+tenant+"/a", "")
+			So(serve("/tenants/"+tenant+"/b/c?x=y", ""), ShouldEqual, want)
+			So(serve("/other", tenant), ShouldEqual, want)
+			So(serve("/other?tenant="+tenant, ""), ShouldEqual, want)
+			So(serve("/other?tenant=nope", tenant), ShouldEqual, want)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultQueueTimeout] = 5 * time.Second
+}
+
+// ConnLimiter limits the number of concurrent requests to each member of a Pool. Requests that arrive when every
+// member is at its limit wait in a bounded FIFO queue, and are rejected with a 503 if the queue is full, or they
+// wait too long.
+//
+// ConnLimiter is both the http.Handler in front of the PoolManager that admits requests, and via MemberHandler,
+// the http.Handler behind it that steers admitted requests away from members that are at their limit.
+type ConnLimiter struct {
+	// MaxConnsPerMember is the number of concurrent requests each member may handle
+	MaxConnsPerMember int
+	// MaxQueue is the number of requests that may wait for a member. Zero rejects requests immediately.
+	MaxQueue int
+	// QueueTimeout is how long a request may wait for a member
+	QueueTimeout time.Duration
+
+	name     string
+	pm       PoolManager
+	next     http.Handler
+	lock     sync.Mutex
+	admitted int
+	conns    map[string]int
+	queue    *list.List // of chan struct{}
+	depth    metrics.Gauge
+	wait     metrics.Timer
+	rejected metrics.Counter
+}
+
+// NewConnLimiter returns a ConnLimiter configured from the PoolConfig and global defaults.
+// Its queue depth, wait time, and rejections are registered with Metrics.
+func NewConnLimiter(pool *Pool) *ConnLimiter {
+	cl := ConnLimiter{
+		MaxConnsPerMember: pool.Config.MaxConnsPerMember,
+		MaxQueue:          pool.Config.MaxQueue,
+		QueueTimeout:      Conf.GetDuration(ConfigPoolsDefaultQueueTimeout),
+		name:              pool.Config.Name,
+		conns:             make(map[string]int),
+		queue:             list.New(),
+		depth:             metrics.GetOrRegisterGauge(fmt.Sprintf("%s_QueueDepth", pool.Config.Name), Metrics),
+		wait:              metrics.GetOrRegisterTimer(fmt.Sprintf("%s_QueueWait", pool.Config.Name), Metrics),
+		rejected:          metrics.GetOrRegisterCounter(fmt.Sprintf("%s_QueueRejected", pool.Config.Name), Metrics),
+	}
+
+	if pool.Config.QueueTimeout > 0 {
+		cl.QueueTimeout = pool.Config.QueueTimeout
+	}
+
+	return &cl
+}
+
+// String returns a summary of the ConnLimiter
+func (cl *ConnLimiter) String() string {
+	return fmt.Sprintf("%d per member, queue %d for %s", cl.MaxConnsPerMember, cl.MaxQueue, cl.QueueTimeout)
+}
+
+// Wrap sets the PoolManager whose members are limited, and the http.Handler that admitted requests are
+// passed to, returning the ConnLimiter
+func (cl *ConnLimiter) Wrap(pm PoolManager, next http.Handler) *ConnLimiter {
+	cl.pm = pm
+	cl.next = next
+	return cl
+}
+
+// ServeHTTP admits the request if a member is available, or queues it until one is
+func (cl *ConnLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if ok, reason := cl.admit(r); !ok {
+		cl.rejected.Inc(1)
+		DebugOut.Print(ErrRequestError{r, fmt.Sprintf("ConnLimiter %s rejecting request: %s", cl.name, reason)}.String())
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Max(1, math.Ceil(cl.QueueTimeout.Seconds())))))
+		RequestErrorResponse(r, w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	cl.wait.UpdateSince(start)
+	defer cl.release()
+
+	cl.next.ServeHTTP(w, r)
+}
+
+// capacity returns the number of requests the members may handle. The caller must hold the lock.
+func (cl *ConnLimiter) capacity() int {
+	return cl.MaxConnsPerMember * len(cl.pm.Servers())
+}
+
+// admit returns true when the request may proceed, or false and the reason it may not
+func (cl *ConnLimiter) admit(r *http.Request) (bool, string) {
+	cl.lock.Lock()
+	if cl.admitted < cl.capacity() && cl.queue.Len() == 0 {
+		cl.admitted++
+		cl.lock.Unlock()
+		return true, ""
+	}
+	if cl.queue.Len() >= cl.MaxQueue {
+		cl.lock.Unlock()
+		return false, "queue full"
+	}
+	ready := make(chan struct{})
+	e := cl.queue.PushBack(ready)
+	cl.depth.Update(int64(cl.queue.Len()))
+	cl.lock.Unlock()
+
+	timer := time.NewTimer(cl.QueueTimeout)
+	defer timer.Stop()
+
+	var reason string
+	select {
+	case <-ready:
+		return true, ""
+	case <-timer.C:
+		reason = "queue timeout"
+	case <-r.Context().Done():
+		reason = "client gave up"
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	select {
+	case <-ready:
+		// We were admitted while giving up, so we may as well go
+		return true, ""
+	default:
+	}
+	cl.queue.Remove(e)
+	cl.depth.Update(int64(cl.queue.Len()))
+	return false, reason
+}
+
+// release frees an admitted request's slot, admitting queued requests in order
+func (cl *ConnLimiter) release() {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.admitted--
+	for cl.queue.Len() > 0 && cl.admitted < cl.capacity() {
+		e := cl.queue.Front()
+		cl.queue.Remove(e)
+		cl.admitted++
+		close(e.Value.(chan struct{}))
+	}
+	cl.depth.Update(int64(cl.queue.Len()))
+}
+
+// MemberHandler returns an http.Handler to go between the PoolManager and the members, which counts the requests
+// to each member, and if the chosen member is at its limit, sends the request to the least-busy member instead
+func (cl *ConnLimiter) MemberHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		member := cl.claim(r.URL)
+		defer cl.unclaim(member)
+
+		if memberHost(member) != memberHost(r.URL) {
+			DebugOut.Print(ErrRequestError{r, fmt.Sprintf("ConnLimiter %s: %s is busy, using %s", cl.name, memberHost(r.URL), memberHost(member))}.String())
+			// make shallow copy of request, and send it to the other member
+			newReq := *r
+			newReq.URL = member
+			r = &newReq
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// claim counts a request against the member, or the least-busy member if it is at its limit, and returns
+// whichever was claimed
+func (cl *ConnLimiter) claim(u *url.URL) *url.URL {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if cl.conns[memberHost(u)] >= cl.MaxConnsPerMember && cl.pm != nil {
+		least := cl.conns[memberHost(u)]
+		for _, s := range cl.pm.Servers() {
+			if c := cl.conns[memberHost(s)]; c < least {
+				least = c
+				u = CopyURL(s)
+			}
+		}
+	}
+	cl.conns[memberHost(u)]++
+	return u
+}
+
+// unclaim uncounts a request against the member
+func (cl *ConnLimiter) unclaim(u *url.URL) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if cl.conns[memberHost(u)]--; cl.conns[memberHost(u)] <= 0 {
+		delete(cl.conns, memberHost(u))
+	}
+}
@@ -0,0 +1,197 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPoolConnLimiter(t *testing.T) {
+
+	var (
+		gate    = make(chan struct{})
+		entered = make(chan struct{}, 10)
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-gate
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	Convey("When a Pool has MaxConnsPerMember set, and its members are busy, requests queue, and are rejected if the queue is full", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:              "connlimittest",
+			Members:           []string{backend.URL},
+			MaxConnsPerMember: 1,
+			MaxQueue:          1,
+			QueueTimeout:      time.Second,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		results := make(chan int, 2)
+		serve := func() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			results <- rr.Code
+		}
+
+		go serve()
+		<-entered // first is busy
+		go serve()
+		So(waitFor(time.Second, func() bool {
+			return Metrics.Get("connlimittest_QueueDepth").(metrics.Gauge).Value() == 1
+		}), ShouldBeTrue)
+
+		// Third is rejected
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusServiceUnavailable)
+		So(rr.Header().Get("Retry-After"), ShouldEqual, "1")
+		So(Metrics.Get("connlimittest_QueueRejected").(metrics.Counter).Count(), ShouldEqual, 1)
+
+		gate <- struct{}{} // first finishes, second goes
+		<-entered
+		gate <- struct{}{}
+		So(<-results, ShouldEqual, http.StatusOK)
+		So(<-results, ShouldEqual, http.StatusOK)
+		So(Metrics.Get("connlimittest_QueueDepth").(metrics.Gauge).Value(), ShouldEqual, 0)
+	})
+
+	Convey("When a Pool has MaxConnsPerMember set, and a request waits too long in the queue, it is rejected", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:              "connlimittimeouttest",
+			Members:           []string{backend.URL},
+			MaxConnsPerMember: 1,
+			MaxQueue:          5,
+			QueueTimeout:      50 * time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		done := make(chan int)
+		go func() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			done <- rr.Code
+		}()
+		<-entered
+
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusServiceUnavailable)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+
+		gate <- struct{}{}
+		So(<-done, ShouldEqual, http.StatusOK)
+	})
+}
+
+func TestPoolConnLimiterMembers(t *testing.T) {
+
+	Convey("When a ConnLimiter is asked for a member at its limit, it chooses the least-busy member instead", t, func() {
+		cl := NewConnLimiter(&Pool{Config: &PoolConfig{Name: "connlimitmembertest", MaxConnsPerMember: 1}})
+
+		ch, err := NewConsistentHashPool("request", "remoteaddr", nil, http.NotFoundHandler())
+		So(err, ShouldBeNil)
+		one, _ := url.Parse("http://one:80")
+		two, _ := url.Parse("http://two:80")
+		So(ch.UpsertServer(one), ShouldBeNil)
+		So(ch.UpsertServer(two), ShouldBeNil)
+		cl.Wrap(ch, http.NotFoundHandler())
+
+		So(cl.claim(one).Host, ShouldEqual, "one:80")
+		So(cl.claim(one).Host, ShouldEqual, "two:80")
+		// Everyone is busy, so it goes where it was sent
+		So(cl.claim(one).Host, ShouldEqual, "one:80")
+
+		cl.unclaim(one)
+		cl.unclaim(one)
+		cl.unclaim(two)
+		So(cl.conns, ShouldBeEmpty)
+	})
+}
+
+func TestPoolConnLimiterUnix(t *testing.T) {
+
+	// Socket paths must be short, so not t.TempDir
+	dir, err := os.MkdirTemp("", "jarcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		gate    = make(chan struct{})
+		entered = make(chan struct{}, 10)
+	)
+	listen := func(name string) string {
+		path := filepath.Join(dir, name+".sock")
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("wait") != "" {
+				entered <- struct{}{}
+				<-gate
+			}
+			w.Write([]byte(name))
+		}))
+		s.Listener = l
+		s.Start()
+		t.Cleanup(s.Close)
+		return "unix://" + path
+	}
+	members := map[string]string{"one": listen("one"), "two": listen("two")}
+
+	Convey("When unix members are at their limit, requests go to the least-busy member's socket", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:                  "connlimitunixtest",
+			Members:               []string{members["one"], members["two"]},
+			MaxConnsPerMember:     1,
+			ConsistentHashing:     true,
+			ConsistentHashSources: []string{"header"},
+			ConsistentHashNames:   []string{"X-User"},
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		serve := func(target string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", target, nil)
+			req.Header.Set("X-User", "bob")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			return rr
+		}
+
+		busy := make(chan string)
+		go func() { busy <- serve("/?wait=1").Body.String() }()
+		<-entered
+
+		// Bob's member is busy, so he goes to the other one
+		rr := serve("/")
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		other := rr.Body.String()
+
+		gate <- struct{}{}
+		So(<-busy, ShouldNotEqual, other)
+	})
+
+	Convey("When unix members are unclaimed, their counters are removed", t, func() {
+		cl := NewConnLimiter(&Pool{Config: &PoolConfig{Name: "connlimitunixunclaimtest", MaxConnsPerMember: 1}})
+		one, _ := url.Parse(members["one"])
+		cl.unclaim(cl.claim(one))
+		So(cl.conns, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,163 @@
+package jar
+
+import (
+	"github.com/vulcand/oxy/v2/roundrobin"
+
+	"fmt"
+	"net/url"
+)
+
+// MemberDiscoverer is a function responsible for keeping a materialized Pool's members in sync with a
+// source of truth, such as DNS. It is called once per source during materialization, should perform an
+// initial sync, and should schedule any subsequent ones. An error is returned if the source is unusable.
+type MemberDiscoverer func(*Pool, *url.URL) error
+
+const (
+	// ErrPoolDiscoveryEmpty is returned when a discovery source yields no members. The existing members are kept.
+	ErrPoolDiscoveryEmpty = Error("discovery source returned no members")
+)
+
+var (
+	// MemberDiscoverers is a map of available MemberDiscoverers, keyed by the URL scheme of the Pool member they handle
+	MemberDiscoverers = make(map[string]MemberDiscoverer)
+)
+
+// DiscoveredMember is a Pool member as described by a discovery source
+type DiscoveredMember struct {
+	// URL is the member URL
+	URL string
+	// Weight, if non-zero, overrides the member weight
+	Weight int
+	// AZ, if set, is the zone the member is in. If it is our zone, and Weight is not set, LocalMemberWeight is used.
+	AZ string
+}
+
+// localAZ returns the AZ we are running in, or an empty string if we don't know
+func localAZ() string {
+	if AWSSession == nil || AWSSession.Me == nil {
+		return ""
+	}
+	return AWSSession.Me.AvailabilityZone
+}
+
+// isDiscoveryURL returns true if the URL is handled by a MemberDiscoverer
+func isDiscoveryURL(u *url.URL) bool {
+	_, ok := MemberDiscoverers[u.Scheme]
+	return ok
+}
+
+// discoveredScheme returns the scheme of the members a discovery source will yield, which may be set with the
+// "scheme" query parameter, and defaults to "http"
+func discoveredScheme(u *url.URL) string {
+	if s := u.Query().Get("scheme"); s != "" {
+		return s
+	}
+	return "http"
+}
+
+// startDiscovery calls the MemberDiscoverer for each discovery source
+func (p *Pool) startDiscovery(sources []*url.URL) error {
+	for _, source := range sources {
+		DebugOut.Printf("\t\tDiscovering members from '%s'\n", source.String())
+		if err := MemberDiscoverers[source.Scheme](p, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncMembers makes the members previously discovered from the named source match the ones provided, adding new
+// members, updating the weights of changed ones, and deleting ones that are no longer present, as PoolMemberAdder
+// and PoolMemberLoser would. Members from other sources, or configured statically, are not touched.
+// ErrPoolDiscoveryEmpty is returned, and nothing is changed, if no members are provided.
+func (p *Pool) SyncMembers(source string, members []DiscoveredMember) error {
+	if len(members) == 0 {
+		return ErrPoolDiscoveryEmpty
+	}
+	if p.AddMember == nil || p.DeleteMember == nil {
+		return ErrPoolAddMemberNotSupported
+	}
+
+	p.discoveryLock.Lock()
+	defer p.discoveryLock.Unlock()
+
+	if p.discovered == nil {
+		p.discovered = make(map[string]map[string]DiscoveredMember)
+	}
+	old := p.discovered[source]
+	current := make(map[string]DiscoveredMember)
+
+	for _, dm := range members {
+		u, err := url.Parse(dm.URL)
+		if err != nil {
+			ErrorOut.Printf("Pool %s: discovered member '%s' from %s is invalid: %s\n", p.Config.Name, dm.URL, source, err)
+			continue
+		}
+		dm.URL = u.String()
+
+		if prev, ok := old[dm.URL]; ok && prev == dm {
+			// Nothing to do
+			current[dm.URL] = dm
+			continue
+		}
+
+		m := p.GetMember(u)
+		if dm.AZ != "" {
+			m.AZ = dm.AZ
+		}
+		if dm.Weight > 0 {
+			m.Weight = roundrobin.Weight(dm.Weight)
+		} else if dm.AZ != "" && dm.AZ == localAZ() {
+			m.Weight = roundrobin.Weight(LocalMemberWeight)
+		}
+
+		DebugOut.Printf("Pool %s: adding discovered member '%s' from %s\n", p.Config.Name, dm.URL, source)
+		if err := p.AddMember(dm.URL); err != nil {
+			ErrorOut.Printf("Pool %s: error adding discovered member '%s' from %s: %s\n", p.Config.Name, dm.URL, source, err)
+			continue
+		}
+		current[dm.URL] = dm
+	}
+
+	for member := range old {
+		if _, ok := current[member]; ok {
+			continue
+		}
+		DebugOut.Printf("Pool %s: deleting member '%s' no longer discovered from %s\n", p.Config.Name, member, source)
+		if err := p.DeleteMember(member); err != nil && err != ErrNoSuchMemberError {
+			ErrorOut.Printf("Pool %s: error deleting member '%s' no longer discovered from %s: %s\n", p.Config.Name, member, source, err)
+			// Try again next time
+			current[member] = old[member]
+		}
+	}
+
+	p.discovered[source] = current
+	return nil
+}
+
+// DiscoveredMembers returns the members currently discovered from the named source
+func (p *Pool) DiscoveredMembers(source string) []string {
+	p.discoveryLock.Lock()
+	defer p.discoveryLock.Unlock()
+
+	members := make([]string, 0, len(p.discovered[source]))
+	for m := range p.discovered[source] {
+		members = append(members, m)
+	}
+	return members
+}
+
+// discoveryStatus publishes the outcome of a discovery sync to Status, returning the error
+func (p *Pool) discoveryStatus(source string, err error) error {
+	name := fmt.Sprintf("%s_%s_Discovery", p.Config.Name, source)
+	if err != nil {
+		ErrorOut.Printf("Pool %s: discovery from %s failed, keeping existing members: %s\n", p.Config.Name, source, err)
+		Status.Add(name, "WARNING", fmt.Sprintf("Discovery failed, keeping existing members: %s", err), nil)
+		return err
+	}
+	if _, serr := Status.Get(name); serr == nil {
+		// We had a problem, but it's all over now
+		Status.Remove(name)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package jar
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// dnsLookupTimeout is the longest a single discovery lookup may take
+	dnsLookupTimeout = 10 * time.Second
+)
+
+func init() {
+	MemberDiscoverers["dns"] = discoverDNS
+	MemberDiscoverers["dns+srv"] = discoverDNS
+
+	ConfigAdditions[ConfigPoolsDNSInterval] = 30 * time.Second
+}
+
+// dnsDiscovery keeps a Pool's members in sync with DNS.
+//
+// dns://name:port resolves the A/AAAA records for name, and adds each address with the port.
+// dns+srv://_service._proto.name resolves the SRV records for the name, and adds each target and port
+// of the highest priority, weighted by the record weight.
+//
+// The "scheme" query parameter sets the scheme of the members (default "http"), "interval" overrides
+// pools.dnsinterval, and "resolver" overrides pools.dnsresolver.
+type dnsDiscovery struct {
+	pool     *Pool
+	source   *url.URL
+	name     string
+	scheme   string
+	interval time.Duration
+	resolver *net.Resolver
+}
+
+// discoverDNS is a MemberDiscoverer for dns:// and dns+srv:// members
+func discoverDNS(p *Pool, source *url.URL) error {
+	d := dnsDiscovery{
+		pool:     p,
+		source:   source,
+		name:     source.Scheme + "://" + source.Host,
+		scheme:   discoveredScheme(source),
+		interval: Conf.GetDuration(ConfigPoolsDNSInterval),
+	}
+
+	q := source.Query()
+	if i := q.Get("interval"); i != "" {
+		interval, err := time.ParseDuration(i)
+		if err != nil {
+			return fmt.Errorf("invalid interval for %s: %w", d.name, err)
+		}
+		d.interval = interval
+	}
+	if d.interval <= 0 {
+		return fmt.Errorf("invalid interval for %s: %s", d.name, d.interval)
+	}
+
+	resolver := Conf.GetString(ConfigPoolsDNSResolver)
+	if r := q.Get("resolver"); r != "" {
+		resolver = r
+	}
+	d.resolver = newDNSResolver(resolver)
+
+	if source.Hostname() == "" {
+		return fmt.Errorf("no name to resolve for %s", source.String())
+	}
+	if source.Scheme == "dns" && source.Port() == "" && d.defaultPort() == "" {
+		return fmt.Errorf("no port for %s, and no default for scheme %s", d.name, d.scheme)
+	}
+
+	// A failure here isn't fatal, as DNS may recover
+	d.sync()
+	TaskRegistry.AddEvery(fmt.Sprintf("Pool %s discovery %s", p.Config.Name, d.name), d.sync, d.interval)
+	DebugOut.Printf("\t\tDNS discovery of %s every %s\n", d.name, d.interval)
+	return nil
+}
+
+// newDNSResolver returns a Resolver that queries the specified address, or the system resolver if it is empty.
+// If the address has no port, 53 is assumed.
+func newDNSResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// sync resolves the members, and applies them to the Pool
+func (d *dnsDiscovery) sync() error {
+	members, err := d.resolve()
+	if err == nil {
+		err = d.pool.SyncMembers(d.name, members)
+	}
+	return d.pool.discoveryStatus(d.name, err)
+}
+
+// resolve returns the members currently in DNS
+func (d *dnsDiscovery) resolve() ([]DiscoveredMember, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), min(d.interval, dnsLookupTimeout))
+	defer cancel()
+
+	var members []DiscoveredMember
+	if d.source.Scheme == "dns+srv" {
+		_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.source.Hostname())
+		if err != nil {
+			return nil, err
+		}
+
+		// LookupSRV sorts by priority, and we only want the best
+		for _, srv := range srvs {
+			if srv.Priority != srvs[0].Priority {
+				break
+			}
+			host := strings.TrimSuffix(srv.Target, ".")
+			members = append(members, DiscoveredMember{
+				URL:    fmt.Sprintf("%s://%s", d.scheme, net.JoinHostPort(host, fmt.Sprint(srv.Port))),
+				Weight: int(srv.Weight),
+			})
+		}
+	} else {
+		addrs, err := d.resolver.LookupHost(ctx, d.source.Hostname())
+		if err != nil {
+			return nil, err
+		}
+
+		port := d.source.Port()
+		if port == "" {
+			port = d.defaultPort()
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			members = append(members, DiscoveredMember{
+				URL: fmt.Sprintf("%s://%s", d.scheme, net.JoinHostPort(addr, port)),
+			})
+		}
+	}
+	return members, nil
+}
+
+// defaultPort returns the well-known port for the member scheme, or an empty string
+func (d *dnsDiscovery) defaultPort() string {
+	switch d.scheme {
+	case "http", "ws", "h2c", "grpc":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
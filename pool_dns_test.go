@@ -0,0 +1,228 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnsStub is a tiny UDP DNS server that answers A and SRV questions from its maps
+type dnsStub struct {
+	lock sync.Mutex
+	conn net.PacketConn
+	a    map[string][]net.IP
+	srv  map[string][]net.SRV
+}
+
+func newDNSStub() *dnsStub {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &dnsStub{
+		conn: conn,
+		a:    make(map[string][]net.IP),
+		srv:  make(map[string][]net.SRV),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *dnsStub) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *dnsStub) Close() {
+	s.conn.Close()
+}
+
+func (s *dnsStub) SetA(name string, ips ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.a[name+"."] = nil
+	for _, ip := range ips {
+		s.a[name+"."] = append(s.a[name+"."], net.ParseIP(ip))
+	}
+}
+
+func (s *dnsStub) SetSRV(name string, srvs ...net.SRV) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.srv[name+"."] = srvs
+}
+
+func (s *dnsStub) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+			continue
+		}
+		q := req.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeNameError},
+			Questions: req.Questions,
+		}
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1}
+
+		s.lock.Lock()
+		if ips, ok := s.a[q.Name.String()]; ok {
+			resp.RCode = dnsmessage.RCodeSuccess
+			if q.Type == dnsmessage.TypeA {
+				for _, ip := range ips {
+					var a dnsmessage.AResource
+					copy(a.A[:], ip.To4())
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &a})
+				}
+			}
+		}
+		if srvs, ok := s.srv[q.Name.String()]; ok {
+			resp.RCode = dnsmessage.RCodeSuccess
+			if q.Type == dnsmessage.TypeSRV {
+				for _, srv := range srvs {
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.SRVResource{
+						Priority: srv.Priority,
+						Weight:   srv.Weight,
+						Port:     srv.Port,
+						Target:   dnsmessage.MustNewName(srv.Target),
+					}})
+				}
+			}
+		}
+		s.lock.Unlock()
+
+		if b, err := resp.Pack(); err == nil {
+			s.conn.WriteTo(b, addr)
+		}
+	}
+}
+
+func TestPoolDNSDiscovery(t *testing.T) {
+
+	stub := newDNSStub()
+	defer stub.Close()
+
+	members := func(p *Pool) []string {
+		var ms []string
+		for _, u := range p.ListMembers() {
+			ms = append(ms, u.String())
+		}
+		sort.Strings(ms)
+		return ms
+	}
+
+	Convey("When a Pool has a dns:// member, the resolved addresses become members, and follow DNS", t, func() {
+		stub.SetA("api.jartest", "127.0.0.1", "127.0.0.2")
+
+		pool := NewPool(&PoolConfig{
+			Name:    "dnstest",
+			Members: []string{"dns://api.jartest:8080?interval=50ms&resolver=" + stub.Addr()},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(members(pool), ShouldResemble, []string{"http://127.0.0.1:8080", "http://127.0.0.2:8080"})
+
+		stub.SetA("api.jartest", "127.0.0.2", "127.0.0.3")
+		So(waitFor(2*time.Second, func() bool {
+			return strings.Join(members(pool), ",") == "http://127.0.0.2:8080,http://127.0.0.3:8080"
+		}), ShouldBeTrue)
+
+		Convey("... and if the name stops resolving, the existing members are kept, and a warning published", func() {
+			stub.SetA("api.jartest")
+			stub.lock.Lock()
+			delete(stub.a, "api.jartest.")
+			stub.lock.Unlock()
+
+			So(waitFor(2*time.Second, func() bool {
+				_, serr := Status.Get("dnstest_dns://api.jartest:8080_Discovery")
+				return serr == nil
+			}), ShouldBeTrue)
+			So(members(pool), ShouldResemble, []string{"http://127.0.0.2:8080", "http://127.0.0.3:8080"})
+		})
+	})
+
+	Convey("When a Pool has a dns+srv:// member, the best targets become weighted members, alongside static ones", t, func() {
+		stub.SetSRV("_http._tcp.api.jartest",
+			net.SRV{Target: "one.jartest.", Port: 8081, Priority: 10, Weight: 5},
+			net.SRV{Target: "two.jartest.", Port: 8082, Priority: 10, Weight: 1},
+			net.SRV{Target: "backup.jartest.", Port: 8083, Priority: 20, Weight: 1},
+		)
+
+		pool := NewPool(&PoolConfig{
+			Name:    "dnssrvtest",
+			Members: []string{"http://static.jartest:80", "dns+srv://_http._tcp.api.jartest?interval=1h&resolver=" + stub.Addr()},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(members(pool), ShouldResemble, []string{"http://one.jartest:8081", "http://static.jartest:80", "http://two.jartest:8082"})
+
+		one, _ := url.Parse("http://one.jartest:8081")
+		So(serverOptionsToWeight(pool.GetMember(one).Weight), ShouldEqual, 5)
+	})
+
+	Convey("When a Pool only has discovery members, the scheme parameter chooses the materializer", t, func() {
+		stub.SetA("www.jartest", "127.0.0.1")
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}))
+		defer backend.Close()
+		bu, _ := url.Parse(backend.URL)
+
+		pool := NewPool(&PoolConfig{
+			Name:    "dnsschemetest",
+			Members: []string{"dns://www.jartest:" + bu.Port() + "?scheme=http&interval=1h&resolver=" + stub.Addr()},
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Body.String(), ShouldEqual, "hello")
+	})
+
+	Convey("When a dns:// member has no port, and the scheme has no default, materialization fails", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:    "dnsbadtest",
+			Members: []string{"http://localhost:80", "dns://api.jartest?scheme=ftp"},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPoolSyncMembers(t *testing.T) {
+
+	Convey("When a Pool syncs members from a source, only that source's members are changed", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:    "synctest",
+			Members: []string{"http://static:80"},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		So(pool.SyncMembers("a", []DiscoveredMember{{URL: "http://a1:80"}, {URL: "http://a2:80", Weight: 3}}), ShouldBeNil)
+		So(pool.SyncMembers("b", []DiscoveredMember{{URL: "http://b1:80"}}), ShouldBeNil)
+		So(len(pool.ListMembers()), ShouldEqual, 4)
+
+		So(pool.SyncMembers("a", []DiscoveredMember{{URL: "http://a2:80", Weight: 3}}), ShouldBeNil)
+		So(len(pool.ListMembers()), ShouldEqual, 3)
+		So(pool.DiscoveredMembers("a"), ShouldResemble, []string{"http://a2:80"})
+
+		So(pool.SyncMembers("b", nil), ShouldEqual, ErrPoolDiscoveryEmpty)
+		So(len(pool.ListMembers()), ShouldEqual, 3)
+	})
+}
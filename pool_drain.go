@@ -0,0 +1,241 @@
+package jar
+
+import (
+	"github.com/vulcand/oxy/v2/roundrobin"
+
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultDrainTimeout] = 5 * time.Minute
+	ConfigAdditions[ConfigPoolsDrainIdleTime] = 30 * time.Second
+}
+
+// DrainingMember is a member of a Pool that is being drained
+type DrainingMember struct {
+	URL *url.URL
+	// Deadline is when the member will be deleted, whether or not its clients have finished
+	Deadline time.Time
+}
+
+// drainingMember is a member being drained, and its activity
+type drainingMember struct {
+	DrainingMember
+	inflight atomic.Int64
+	last     atomic.Int64 // UnixNano of the last request to start or finish
+	stop     chan struct{}
+}
+
+// MemberDrainer drains members of a Pool: a draining member receives no new clients, but the clients it already has
+// (via a sticky cookie, or consistent hashing) keep reaching it until they go quiet for IdleTime, or the deadline
+// passes, and then it is deleted from the Pool.
+type MemberDrainer struct {
+	// IdleTime is how long a draining member must go without requests, or open WebSockets, to be considered finished
+	IdleTime time.Duration
+
+	pool    *Pool
+	pm      PoolManager
+	sticky  *roundrobin.StickySession
+	member  http.Handler
+	next    http.Handler
+	lock    sync.Mutex
+	members map[string]*drainingMember // by URL
+}
+
+// NewMemberDrainer returns a MemberDrainer configured from the PoolConfig and global defaults. If the Pool is
+// Sticky, its cookie is used to find the clients of draining members.
+func NewMemberDrainer(pool *Pool) (*MemberDrainer, error) {
+	md := MemberDrainer{
+		IdleTime: Conf.GetDuration(ConfigPoolsDrainIdleTime),
+		pool:     pool,
+		members:  make(map[string]*drainingMember),
+	}
+
+	if pool.Config.Sticky {
+		ss, err := newStickySession(pool.Config.Name, pool.Config.StickyCookieName, pool.Config.StickyCookieType)
+		if err != nil {
+			return nil, err
+		}
+		md.sticky = ss
+	}
+	return &md, nil
+}
+
+// Wrap returns an http.Handler that sends requests from sticky clients of draining members directly to member,
+// and everything else to next. If the Pool isn't Sticky, there is nothing to do, and next is returned.
+func (md *MemberDrainer) Wrap(next, member http.Handler) http.Handler {
+	if md.sticky == nil {
+		return next
+	}
+	md.next = next
+	md.member = member
+	return md
+}
+
+// ServeHTTP sends requests from sticky clients of draining members to them, and everything else on
+func (md *MemberDrainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if drains := md.urls(); len(drains) > 0 {
+		if u, present, _ := md.sticky.GetBackend(r, drains); present {
+			// make shallow copy of request, and send it to its member
+			newReq := *r
+			newReq.URL = CopyURL(u)
+			md.member.ServeHTTP(w, &newReq)
+			return
+		}
+	}
+
+	md.next.ServeHTTP(w, r)
+}
+
+// MemberHandler returns an http.Handler to go between the PoolManager and the members, which notes the activity
+// of draining members
+func (md *MemberDrainer) MemberHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dm := md.get(r.URL)
+		if dm == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dm.inflight.Add(1)
+		dm.last.Store(time.Now().UnixNano())
+		defer func() {
+			dm.last.Store(time.Now().UnixNano())
+			dm.inflight.Add(-1)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Drain starts draining the member, which will be deleted from the Pool once its clients are finished, or the
+// timeout passes. If the timeout is zero, the global default is used. Consistently-hashed members stay in the ring
+// until they are deleted, so their clients keep reaching them, while others leave the PoolManager now.
+func (md *MemberDrainer) Drain(u *url.URL, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = Conf.GetDuration(ConfigPoolsDefaultDrainTimeout)
+	}
+
+	md.lock.Lock()
+	if dm, ok := md.members[u.String()]; ok {
+		// Already draining, so just move the deadline
+		dm.Deadline = time.Now().Add(timeout)
+		md.lock.Unlock()
+		return nil
+	}
+	if _, ok := md.pm.ServerWeight(u); !ok {
+		md.lock.Unlock()
+		return ErrNoSuchMemberError
+	}
+
+	dm := &drainingMember{
+		DrainingMember: DrainingMember{URL: CopyURL(u), Deadline: time.Now().Add(timeout)},
+		stop:           make(chan struct{}),
+	}
+	dm.last.Store(time.Now().UnixNano())
+	md.members[u.String()] = dm
+	md.lock.Unlock()
+
+	if !md.pool.Config.ConsistentHashing {
+		// No new clients
+		if err := md.pm.RemoveServer(u); err != nil {
+			md.Cancel(u)
+			return err
+		}
+	}
+
+	go md.watch(dm)
+	return nil
+}
+
+// Cancel stops draining the member, if it is, returning true if it was. The member is not returned to the
+// PoolManager.
+func (md *MemberDrainer) Cancel(u *url.URL) bool {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	dm, ok := md.members[u.String()]
+	if !ok {
+		return false
+	}
+	delete(md.members, u.String())
+	close(dm.stop)
+	return true
+}
+
+// List returns the draining members, in URL order
+func (md *MemberDrainer) List() []DrainingMember {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	l := make([]DrainingMember, 0, len(md.members))
+	for _, dm := range md.members {
+		l = append(l, DrainingMember{URL: CopyURL(dm.URL), Deadline: dm.Deadline})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].URL.String() < l[j].URL.String() })
+	return l
+}
+
+// get returns the draining member, or nil
+func (md *MemberDrainer) get(u *url.URL) *drainingMember {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	if len(md.members) == 0 {
+		return nil
+	}
+	return md.members[u.String()]
+}
+
+// urls returns the URLs of the draining members
+func (md *MemberDrainer) urls() []*url.URL {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	l := make([]*url.URL, 0, len(md.members))
+	for _, dm := range md.members {
+		l = append(l, dm.URL)
+	}
+	return l
+}
+
+// finished returns true if the draining member's deadline has passed, or its clients are done with it
+func (md *MemberDrainer) finished(dm *drainingMember, now time.Time) bool {
+	md.lock.Lock()
+	deadline := dm.Deadline
+	md.lock.Unlock()
+
+	if !now.Before(deadline) {
+		return true
+	}
+	return dm.inflight.Load() == 0 &&
+		md.pool.websockets.Count(dm.URL) == 0 &&
+		now.Sub(time.Unix(0, dm.last.Load())) >= md.IdleTime
+}
+
+// watch deletes the draining member from the Pool once it is finished, unless the drain is cancelled first
+func (md *MemberDrainer) watch(dm *drainingMember) {
+	ticker := time.NewTicker(max(min(md.IdleTime/4, time.Second), 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dm.stop:
+			return
+		case now := <-ticker.C:
+			if !md.finished(dm, now) {
+				continue
+			}
+
+			DebugOut.Printf("Pool %s finished draining %s\n", md.pool.Config.Name, dm.URL.String())
+			if err := md.pool.DeleteMember(dm.URL.String()); err != nil && err != ErrNoSuchMemberError {
+				ErrorOut.Printf("Pool %s error deleting drained member %s: %s\n", md.pool.Config.Name, dm.URL.String(), err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package jar
+
+import (
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolDrain(t *testing.T) {
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	one := newBackend("one")
+	defer one.Close()
+	two := newBackend("two")
+	defer two.Close()
+	names := map[string]string{"one": one.URL, "two": two.URL}
+
+	get := func(h http.Handler, cookie string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "DRAINSTICKY", Value: cookie})
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	serve := func(conf *PoolConfig) (*Pool, http.Handler) {
+		conf.Members = []string{one.URL, two.URL}
+		pool := NewPool(conf)
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		return pool, h
+	}
+
+	Convey("When a member of a sticky Pool is drained, its clients keep reaching it, but new clients do not", t, func() {
+		pool, h := serve(&PoolConfig{Name: "draintest", Sticky: true, StickyCookieName: "DRAINSTICKY"})
+		pool.drainer.IdleTime = 100 * time.Millisecond
+
+		So(pool.DrainMember(one.URL, 0), ShouldBeNil)
+		drains := pool.ListDrainingMembers()
+		So(drains, ShouldHaveLength, 1)
+		So(drains[0].URL.String(), ShouldEqual, one.URL)
+		So(drains[0].Deadline, ShouldHappenAfter, time.Now().Add(4*time.Minute))
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+
+		for range 5 {
+			So(get(h, ""), ShouldEqual, "two")
+			So(get(h, one.URL), ShouldEqual, "one")
+			time.Sleep(30 * time.Millisecond)
+		}
+
+		Convey("... until they go quiet, and then it is deleted", func() {
+			So(waitFor(time.Second, func() bool { return len(pool.ListDrainingMembers()) == 0 }), ShouldBeTrue)
+			So(pool.ListMembers(), ShouldHaveLength, 1)
+			So(get(h, one.URL), ShouldEqual, "two")
+		})
+	})
+
+	Convey("When a member is drained with a timeout, it is deleted at the deadline, even if its clients are still busy", t, func() {
+		pool, h := serve(&PoolConfig{Name: "draindeadlinetest", Sticky: true, StickyCookieName: "DRAINSTICKY"})
+
+		So(pool.DrainMember(two.URL, 100*time.Millisecond), ShouldBeNil)
+		So(get(h, two.URL), ShouldEqual, "two")
+		So(waitFor(time.Second, func() bool { return len(pool.ListDrainingMembers()) == 0 }), ShouldBeTrue)
+		So(get(h, two.URL), ShouldEqual, "one")
+	})
+
+	Convey("When a draining member is added again, the drain stops", t, func() {
+		pool, _ := serve(&PoolConfig{Name: "draincanceltest", Sticky: true, StickyCookieName: "DRAINSTICKY"})
+
+		So(pool.DrainMember(one.URL, 100*time.Millisecond), ShouldBeNil)
+		So(pool.AddMember(one.URL), ShouldBeNil)
+		So(pool.ListDrainingMembers(), ShouldBeEmpty)
+		time.Sleep(200 * time.Millisecond)
+		So(pool.ListMembers(), ShouldHaveLength, 2)
+	})
+
+	Convey("When a member that isn't there is drained, an error is returned", t, func() {
+		pool, _ := serve(&PoolConfig{Name: "drainmissingtest"})
+		So(pool.DrainMember("http://127.0.0.1:1", 0), ShouldEqual, ErrNoSuchMemberError)
+	})
+
+	Convey("When a member of a consistent-hash Pool is drained, it stays on the ring until it is deleted", t, func() {
+		pool, h := serve(&PoolConfig{Name: "drainconsistenttest", ConsistentHashing: true, ConsistentHashSources: []string{"header"}, ConsistentHashNames: []string{"X-Client"}})
+		pool.drainer.IdleTime = 100 * time.Millisecond
+
+		// Find a client of each member
+		clients := make(map[string]string)
+		for i := 0; len(clients) < 2 && i < 100; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			client := strings.Repeat("c", i+1)
+			req.Header.Set("X-Client", client)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			clients[rr.Body.String()] = client
+		}
+		So(clients, ShouldHaveLength, 2)
+
+		So(pool.DrainMember(one.URL, 0), ShouldBeNil)
+		So(pool.ListMembers(), ShouldHaveLength, 2)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Client", clients["one"])
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		So(rr.Body.String(), ShouldEqual, "one")
+
+		So(waitFor(time.Second, func() bool { return len(pool.ListMembers()) == 1 }), ShouldBeTrue)
+		So(pool.ListDrainingMembers(), ShouldBeEmpty)
+	})
+
+	Convey("When a member is drained by the PoolMemberDrainer finisher, it is listed as draining by PoolMemberLister", t, func() {
+		oldLB := LoadBalancers
+		defer func() { LoadBalancers = oldLB }()
+
+		var err error
+		LoadBalancers, err = NewPools(map[string]*PoolConfig{
+			"drainfinishertest": {
+				Name:    "drainfinishertest",
+				Members: []string{one.URL, two.URL},
+			},
+		}, 0)
+		So(err, ShouldBeNil)
+
+		finish := func(f http.HandlerFunc, target, member string) *httptest.ResponseRecorder {
+			req := mux.SetURLVars(httptest.NewRequest("GET", target, nil), map[string]string{
+				"poolname":     "drainfinishertest",
+				"b64memberurl": base64.StdEncoding.EncodeToString([]byte(member)),
+			})
+			rr := httptest.NewRecorder()
+			f(rr, req)
+			return rr
+		}
+
+		rr := finish(PoolMemberDrainer, "/?timeout=1h", names["two"])
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "Draining")
+
+		list := finish(PoolMemberLister, "/", "").Body.String()
+		So(list, ShouldStartWith, one.URL+"\n\nDraining members:\n"+two.URL+" (draining until ")
+		So(list, ShouldContainSubstring, time.Now().Add(time.Hour).Format("2006-01-02T"))
+
+		Convey("... and bad requests are refused", func() {
+			So(finish(PoolMemberDrainer, "/?timeout=soon", names["one"]).Code, ShouldEqual, http.StatusBadRequest)
+			So(finish(PoolMemberDrainer, "/", "http://127.0.0.1:1").Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestMemberDrainerDeleteWhileDraining(t *testing.T) {
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	Convey("When a draining member is deleted, it is gone, and the drain with it", t, func() {
+		pool := NewPool(&PoolConfig{Name: "draindeletetest", Members: []string{backend.URL, "http://127.0.0.1:1"}})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		So(pool.DrainMember(backend.URL, time.Hour), ShouldBeNil)
+		So(pool.DeleteMember(backend.URL), ShouldBeNil)
+		So(pool.ListDrainingMembers(), ShouldBeEmpty)
+		So(pool.DeleteMember(backend.URL), ShouldEqual, ErrNoSuchMemberError)
+
+		u, _ := url.Parse(backend.URL)
+		So(pool.drainer.Cancel(u), ShouldBeFalse)
+	})
+	Convey("When a draining member of a least-requests Pool is deleted, its WebSockets are told to go away", t, func() {
+		one := newWSBackend("one")
+		defer one.Close()
+		two := newWSBackend("two")
+		defer two.Close()
+		members := map[string]string{"one": wsMember(one), "two": wsMember(two)}
+
+		pool := NewPool(&PoolConfig{Name: "draindeletelrtest", Members: []string{wsMember(one), wsMember(two)}, LeastRequests: true})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		front := httptest.NewServer(h)
+		defer front.Close()
+
+		ws, name := wsDial(front)
+		defer ws.Close()
+		So(pool.DrainMember(members[name], time.Hour), ShouldBeNil)
+		So(pool.DeleteMember(members[name]), ShouldBeNil)
+		So(wsClosed(ws, time.Second), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,71 @@
+package jar
+
+import (
+	"sort"
+)
+
+// Names of the things that may eject members from a Pool
+const (
+	ejectorHealthCheck    = "healthcheck"
+	ejectorCircuitBreaker = "CircuitBreaker"
+	ejectorOutlier        = "Outlier"
+)
+
+// ejectMember removes the member from the Pool on behalf of the ejector. The member stays out of the Pool until
+// every ejector that removed it has returned it.
+func (p *Pool) ejectMember(member, ejector string) error {
+	p.ejectionLock.Lock()
+	defer p.ejectionLock.Unlock()
+
+	if p.ejections == nil {
+		p.ejections = make(map[string]map[string]bool)
+	}
+	if p.ejections[member] == nil {
+		p.ejections[member] = make(map[string]bool)
+	}
+	p.ejections[member][ejector] = true
+
+	return p.RemoveMember(member)
+}
+
+// returnMember returns the member to the Pool on behalf of the ejector, unless another ejector is still keeping
+// it out. Returns true if the member was returned.
+func (p *Pool) returnMember(member, ejector string) (bool, error) {
+	p.ejectionLock.Lock()
+	defer p.ejectionLock.Unlock()
+
+	delete(p.ejections[member], ejector)
+	if len(p.ejections[member]) > 0 {
+		return false, nil
+	}
+	delete(p.ejections, member)
+
+	return true, p.AddMember(member)
+}
+
+// ejectors returns the sorted list of ejectors, other than the specified one, keeping the member out of the Pool
+func (p *Pool) ejectors(member, except string) []string {
+	p.ejectionLock.Lock()
+	defer p.ejectionLock.Unlock()
+
+	var others []string
+	for ejector := range p.ejections[member] {
+		if ejector != except {
+			others = append(others, ejector)
+		}
+	}
+	sort.Strings(others)
+	return others
+}
+
+// healthCheckRemove is the PruneFunc healthchecks remove members with
+func (p *Pool) healthCheckRemove(member string) error {
+	return p.ejectMember(member, ejectorHealthCheck)
+}
+
+// healthCheckAdd is the PruneFunc healthchecks return members with. Members ejected by the passive healthchecks
+// are left for them to return.
+func (p *Pool) healthCheckAdd(member string) error {
+	_, err := p.returnMember(member, ejectorHealthCheck)
+	return err
+}
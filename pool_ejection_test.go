@@ -0,0 +1,80 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPoolEjections(t *testing.T) {
+
+	Convey("When a member is ejected by more than one ejector, it is only returned when all of them return it", t, func() {
+		pool := NewPool(&PoolConfig{Name: "ejectiontest", Members: []string{"http://one/", "http://two/"}})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		So(pool.ejectMember("http://one/", ejectorOutlier), ShouldBeNil)
+		So(pool.ejectMember("http://one/", ejectorHealthCheck), ShouldEqual, ErrNoSuchMemberError)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		So(pool.ejectors("http://one/", ejectorOutlier), ShouldResemble, []string{ejectorHealthCheck})
+
+		returned, err := pool.returnMember("http://one/", ejectorOutlier)
+		So(err, ShouldBeNil)
+		So(returned, ShouldBeFalse)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+
+		returned, err = pool.returnMember("http://one/", ejectorHealthCheck)
+		So(err, ShouldBeNil)
+		So(returned, ShouldBeTrue)
+		So(pool.ListMembers(), ShouldHaveLength, 2)
+		So(pool.ejectors("http://one/", ""), ShouldBeEmpty)
+
+		Convey("... and a deleted member's ejections are forgotten", func() {
+			So(pool.ejectMember("http://two/", ejectorCircuitBreaker), ShouldBeNil)
+			So(pool.DeleteMember("http://two/"), ShouldEqual, ErrNoSuchMemberError)
+			So(pool.ejectors("http://two/", ""), ShouldBeEmpty)
+		})
+	})
+
+	Convey("When a member is ejected by both an OutlierDetector and CircuitBreakers, the first to expire doesn't return it", t, func() {
+		good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer good.Close()
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer bad.Close()
+
+		pool := NewPool(&PoolConfig{Name: "ejectionobservertest", Members: []string{good.URL, bad.URL}})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		member, _ := url.Parse(bad.URL)
+
+		od := NewOutlierDetector(pool)
+		od.ConsecutiveFailures = 1
+		od.EjectionTime = 20 * time.Millisecond
+		od.MaxEjectionPercent = 100
+		cb := NewCircuitBreakers(pool)
+		cb.MinRequests = 1
+		cb.OpenDuration = 200 * time.Millisecond
+
+		// Each sees the member fail, before the other ejects it
+		od.Observe(member, http.StatusServiceUnavailable, 0, nil)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		cb.Observe(member, http.StatusServiceUnavailable, 0, nil)
+		s, _ := cb.State(member)
+		So(s, ShouldEqual, "open")
+
+		So(waitFor(time.Second, func() bool { return !od.Ejected(member) }), ShouldBeTrue)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+
+		So(waitFor(time.Second, func() bool { return len(pool.ListMembers()) == 2 }), ShouldBeTrue)
+		s, _ = cb.State(member)
+		So(s, ShouldEqual, "half-open")
+	})
+}
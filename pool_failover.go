@@ -0,0 +1,109 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
+)
+
+// failoverKey is a type for Failover context keys
+type failoverKey int
+
+const (
+	// failoverVisitedKey is the context key for the names of the Pools a request has failed over from
+	failoverVisitedKey failoverKey = iota
+)
+
+// Failover is an http.Handler that wraps a materialized Pool, sending requests to another Pool if it has no members,
+// or if OverflowConcurrency is set, while it is already handling that many requests
+type Failover struct {
+	// Pool is the name of the Pool to fail over to, from LoadBalancers
+	Pool string
+	// OverflowConcurrency is the number of concurrent requests above which requests overflow to Pool. Zero disables.
+	OverflowConcurrency int64
+
+	name      string
+	pm        PoolManager
+	next      http.Handler
+	active    int64
+	failovers metrics.Counter
+	overflows metrics.Counter
+}
+
+// NewFailover returns a Failover for the Pool, which balances with pm and is served by next.
+// Its counters are registered with Metrics.
+func NewFailover(pool *Pool, pm PoolManager, next http.Handler) *Failover {
+	return &Failover{
+		Pool:                pool.Config.FailoverPool,
+		OverflowConcurrency: int64(pool.Config.OverflowConcurrency),
+		name:                pool.Config.Name,
+		pm:                  pm,
+		next:                next,
+		failovers:           metrics.GetOrRegisterCounter(fmt.Sprintf("%s_Failovers", pool.Config.Name), Metrics),
+		overflows:           metrics.GetOrRegisterCounter(fmt.Sprintf("%s_Overflows", pool.Config.Name), Metrics),
+	}
+}
+
+// String returns a summary of the Failover
+func (f *Failover) String() string {
+	if f.OverflowConcurrency > 0 {
+		return fmt.Sprintf("to %s, overflowing above %d", f.Pool, f.OverflowConcurrency)
+	}
+	return fmt.Sprintf("to %s", f.Pool)
+}
+
+// ServeHTTP handles its part of the request
+func (f *Failover) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(f.pm.Servers()) == 0 {
+		if f.failover(w, r, "no members") {
+			f.failovers.Inc(1)
+			return
+		}
+	} else if f.OverflowConcurrency > 0 {
+		if atomic.AddInt64(&f.active, 1) > f.OverflowConcurrency {
+			atomic.AddInt64(&f.active, -1)
+			if f.failover(w, r, "overflow") {
+				f.overflows.Inc(1)
+				return
+			}
+			atomic.AddInt64(&f.active, 1)
+		}
+		defer atomic.AddInt64(&f.active, -1)
+	}
+
+	f.next.ServeHTTP(w, r)
+}
+
+// failover sends the request to the failover Pool, returning false if it can't
+func (f *Failover) failover(w http.ResponseWriter, r *http.Request, reason string) bool {
+	if LoadBalancers == nil {
+		return false
+	}
+	pool, ok := LoadBalancers.Get(f.Pool)
+	if !ok {
+		ErrorOut.Print(ErrRequestError{r, fmt.Sprintf("Pool %s cannot fail over to non-existent Pool %s", f.name, f.Pool)}.String())
+		return false
+	}
+
+	visited, _ := r.Context().Value(failoverVisitedKey).([]string)
+	if slices.Contains(visited, pool.Config.Name) || pool.Config.Name == f.name {
+		// Been there, done that
+		DebugOut.Print(ErrRequestError{r, fmt.Sprintf("Pool %s not failing over to %s, as it has already failed over", f.name, f.Pool)}.String())
+		return false
+	}
+
+	h, err := pool.GetPool()
+	if err != nil {
+		ErrorOut.Print(ErrRequestError{r, fmt.Sprintf("Pool %s cannot fail over to Pool %s: %s", f.name, f.Pool, err)}.String())
+		return false
+	}
+
+	DebugOut.Print(ErrRequestError{r, fmt.Sprintf("Pool %s failing over to %s (%s)", f.name, f.Pool, reason)}.String())
+	visited = append(slices.Clone(visited), f.name)
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), failoverVisitedKey, visited)))
+	return true
+}
@@ -0,0 +1,112 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestPoolFailover(t *testing.T) {
+
+	var (
+		gate    = make(chan struct{})
+		entered = make(chan struct{}, 10)
+	)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Wait") != "" {
+			entered <- struct{}{}
+			<-gate
+		}
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback"))
+	}))
+	defer fallback.Close()
+
+	oldLB := LoadBalancers
+	defer func() { LoadBalancers = oldLB }()
+
+	var err error
+	LoadBalancers, err = NewPools(map[string]*PoolConfig{
+		"regional": {
+			Name:                "regional",
+			Members:             []string{primary.URL},
+			FailoverPool:        "shared",
+			OverflowConcurrency: 1,
+		},
+		"shared": {
+			Name:         "shared",
+			Members:      []string{fallback.URL},
+			FailoverPool: "regional",
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regional, _ := LoadBalancers.Get("regional")
+	shared, _ := LoadBalancers.Get("shared")
+
+	get := func(h http.Handler, wait bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if wait {
+			req.Header.Set("X-Wait", "yes")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	Convey("When a Pool with a FailoverPool has members, they are used", t, func() {
+		h, err := regional.GetPool()
+		So(err, ShouldBeNil)
+		So(get(h, false).Body.String(), ShouldEqual, "primary")
+
+		Convey("... and when it has none, requests go to the FailoverPool", func() {
+			So(regional.RemoveMember(primary.URL), ShouldBeNil)
+			defer regional.AddMember(primary.URL)
+
+			So(get(h, false).Body.String(), ShouldEqual, "fallback")
+			So(Metrics.Get("regional_Failovers").(metrics.Counter).Count(), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("... and when both Pools are empty, they don't fail over to each other forever", func() {
+			So(regional.RemoveMember(primary.URL), ShouldBeNil)
+			defer regional.AddMember(primary.URL)
+			_, err := shared.GetPool()
+			So(err, ShouldBeNil)
+			So(shared.RemoveMember(fallback.URL), ShouldBeNil)
+			defer shared.AddMember(fallback.URL)
+
+			So(get(h, false).Code, ShouldBeGreaterThanOrEqualTo, 500)
+		})
+
+		Convey("... and when it has more than OverflowConcurrency requests, the excess overflows", func() {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				get(h, true)
+			}()
+			<-entered
+
+			So(get(h, true).Body.String(), ShouldEqual, "fallback")
+			So(Metrics.Get("regional_Overflows").(metrics.Counter).Count(), ShouldEqual, 1)
+
+			gate <- struct{}{}
+			wg.Wait()
+			So(get(h, false).Body.String(), ShouldEqual, "primary")
+		})
+	})
+
+	Convey("When a Pool has OverflowConcurrency, but no FailoverPool, materialization fails", t, func() {
+		pool := NewPool(&PoolConfig{OverflowConcurrency: 1, Members: []string{"http://localhost/"}})
+		_, err := pool.GetPool()
+		So(err, ShouldEqual, ErrPoolConfigOverflowWithoutFailover)
+	})
+}
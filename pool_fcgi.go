@@ -0,0 +1,525 @@
+package jar
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ErrPoolConfigFCGINoScript is returned when a FastCGI Pool has no way to map requests to scripts
+	ErrPoolConfigFCGINoScript = Error("a FastCGI Pool must have FCGIDocumentRoot or FCGIScriptFilename set")
+
+	// ErrPoolConfigFCGISplitPath is returned when FCGISplitPath isn't a regular expression with two groups
+	ErrPoolConfigFCGISplitPath = Error("FCGISplitPath must be a regular expression with two groups: the script name, and the path info")
+
+	// ErrFCGIMalformedResponse is returned when a FastCGI member sends something that isn't FastCGI, or CGI
+	ErrFCGIMalformedResponse = Error("the FastCGI response was malformed")
+
+	// ErrFCGIRequestRejected is returned when a FastCGI member ends a request without running it
+	ErrFCGIRequestRejected = Error("the FastCGI request was rejected")
+)
+
+const (
+	// fcgiDefaultPort is the port fcgi members without one are dialed at, as PHP-FPM listens there by default
+	fcgiDefaultPort = "9000"
+	// fcgiDefaultSplitPath separates the script name from the path info, e.g. /index.php/some/thing
+	fcgiDefaultSplitPath = `^(.+?\.php)(/.*)?$`
+	// fcgiDefaultIndex is the script requests for directories are sent to
+	fcgiDefaultIndex = "index.php"
+
+	fcgiVersion         = 1
+	fcgiBeginRequest    = 1
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiStderr          = 7
+	fcgiResponder       = 1
+	fcgiRequestID       = 1
+	fcgiMaxContent      = 65535
+	fcgiHeaderLength    = 8
+	fcgiRequestComplete = 0
+)
+
+func init() {
+	// Members that speak FastCGI, e.g. PHP-FPM at fcgi://10.0.0.1:9000 or fcgi+unix:///run/php-fpm.sock
+	Materializers["fcgi"] = materializeHTTP
+	Materializers["fcgi+unix"] = materializeHTTP
+	MemberBuilders["fcgi+unix"] = append(MemberBuilders["fcgi+unix"], unixMember)
+}
+
+// isFCGIScheme returns true if the scheme is one of the FastCGI schemes
+func isFCGIScheme(scheme string) bool {
+	return scheme == "fcgi" || scheme == "fcgi+unix"
+}
+
+// isFCGI returns true if the Pool's members are spoken to with FastCGI
+func (p *Pool) isFCGI() bool {
+	if len(p.Config.Members) < 1 {
+		return false
+	}
+	u, err := url.Parse(p.Config.Members[0])
+	if err != nil {
+		return false
+	}
+	if isDiscoveryURL(u) {
+		return isFCGIScheme(discoveredScheme(u))
+	}
+	return isFCGIScheme(u.Scheme)
+}
+
+// FCGITransport is an http.RoundTripper that makes requests of FastCGI responders, such as PHP-FPM. Each request
+// gets its own connection, which is closed when the response Body is.
+type FCGITransport struct {
+	// DocumentRoot is the root of the scripts on the members, and is prefixed to the script name to make SCRIPT_FILENAME
+	DocumentRoot string
+	// ScriptFilename, if set, is the SCRIPT_FILENAME of every request, e.g. a front controller
+	ScriptFilename string
+	// Index is the script requests for directories are sent to
+	Index string
+	// SplitPath separates the request path into the script name, and the path info
+	SplitPath *regexp.Regexp
+	// Params are added to, and override, the params of every request
+	Params map[string]string
+	// ResponseHeaderTimeout is how long a member may take to send response headers. Zero disables.
+	ResponseHeaderTimeout time.Duration
+	// Name is used to identify the Pool in logs
+	Name string
+
+	dial func(context.Context, string, string) (net.Conn, error)
+}
+
+// NewFCGITransport returns an FCGITransport configured from the PoolConfig, which dials members with dial
+func NewFCGITransport(conf *PoolConfig, dial func(context.Context, string, string) (net.Conn, error)) (*FCGITransport, error) {
+	if conf.FCGIDocumentRoot == "" && conf.FCGIScriptFilename == "" {
+		return nil, ErrPoolConfigFCGINoScript
+	}
+
+	split := conf.FCGISplitPath
+	if split == "" {
+		split = fcgiDefaultSplitPath
+	}
+	re, err := regexp.Compile(split)
+	if err != nil || re.NumSubexp() != 2 {
+		return nil, ErrPoolConfigFCGISplitPath
+	}
+
+	index := conf.FCGIIndex
+	if index == "" {
+		index = fcgiDefaultIndex
+	}
+
+	return &FCGITransport{
+		DocumentRoot:          strings.TrimSuffix(conf.FCGIDocumentRoot, "/"),
+		ScriptFilename:        conf.FCGIScriptFilename,
+		Index:                 index,
+		SplitPath:             re,
+		Params:                conf.FCGIParams,
+		ResponseHeaderTimeout: conf.TransportResponseHeaderTimeout,
+		Name:                  conf.Name,
+		dial:                  dial,
+	}, nil
+}
+
+// CloseIdleConnections is a noop, as FCGITransport doesn't keep connections
+func (t *FCGITransport) CloseIdleConnections() {}
+
+// RoundTrip sends the request to the member at req.URL.Host as FastCGI, and returns the CGI response as HTTP
+func (t *FCGITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), fcgiDefaultPort)
+	}
+	conn, err := t.dial(req.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the request goes away, so does the connection, wherever we are
+	stop := context.AfterFunc(req.Context(), func() { conn.Close() })
+	done := func() {
+		stop()
+		conn.Close()
+	}
+
+	if err = t.writeRequest(conn, req); err != nil {
+		done()
+		return nil, t.ctxErr(req, err)
+	}
+
+	if t.ResponseHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.ResponseHeaderTimeout))
+	}
+	body := &fcgiReader{r: bufio.NewReader(conn), name: t.Name, done: done}
+	resp, err := readCGIResponse(req, body)
+	if err != nil {
+		body.Close()
+		if _, ok := err.(net.Error); !ok {
+			// A bad member, like any other
+			err = &net.OpError{Op: "read", Net: "fcgi", Addr: conn.RemoteAddr(), Err: err}
+		}
+		return nil, t.ctxErr(req, err)
+	}
+	if t.ResponseHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	return resp, nil
+}
+
+// ctxErr returns the request context error if there is one, as that is why err happened, otherwise err
+func (t *FCGITransport) ctxErr(req *http.Request, err error) error {
+	if cerr := req.Context().Err(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// writeRequest writes the begin request, params, and stdin records for the request
+func (t *FCGITransport) writeRequest(conn net.Conn, req *http.Request) error {
+	w := bufio.NewWriterSize(conn, fcgiMaxContent+fcgiHeaderLength)
+
+	// Role, flags (not keeping the connection), and reserved
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeFCGIRecord(w, fcgiBeginRequest, begin); err != nil {
+		return err
+	}
+
+	if err := writeFCGIStream(w, fcgiParams, encodeFCGIParams(t.params(req))); err != nil {
+		return err
+	}
+
+	if req.Body != nil {
+		buf := make([]byte, fcgiMaxContent)
+		for {
+			n, rerr := req.Body.Read(buf)
+			if n > 0 {
+				if err := writeFCGIRecord(w, fcgiStdin, buf[:n]); err != nil {
+					return err
+				}
+			}
+			if rerr == io.EOF {
+				break
+			} else if rerr != nil {
+				return rerr
+			}
+		}
+	}
+	if err := writeFCGIRecord(w, fcgiStdin, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// scriptPath returns the script name and the path info of the request path
+func (t *FCGITransport) scriptPath(reqPath string) (string, string) {
+	if strings.HasSuffix(reqPath, "/") {
+		reqPath += t.Index
+	}
+	if m := t.SplitPath.FindStringSubmatch(reqPath); m != nil {
+		return m[1], m[2]
+	}
+	return reqPath, ""
+}
+
+// params returns the CGI params for the request
+func (t *FCGITransport) params(req *http.Request) map[string]string {
+	reqPath := req.URL.Path
+	if reqPath == "" {
+		reqPath = "/"
+	}
+
+	p := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "JAR",
+		"SERVER_PROTOCOL":   req.Proto,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     t.DocumentRoot,
+		"DOCUMENT_URI":      reqPath,
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+	}
+
+	if t.ScriptFilename != "" {
+		// A front controller gets everything as its path info
+		p["SCRIPT_FILENAME"] = t.ScriptFilename
+		p["SCRIPT_NAME"] = "/" + path.Base(t.ScriptFilename)
+		if root := t.DocumentRoot; root != "" && strings.HasPrefix(t.ScriptFilename, root+"/") {
+			p["SCRIPT_NAME"] = strings.TrimPrefix(t.ScriptFilename, root)
+		}
+		p["PATH_INFO"] = reqPath
+	} else {
+		name, info := t.scriptPath(reqPath)
+		p["SCRIPT_NAME"] = name
+		p["SCRIPT_FILENAME"] = t.DocumentRoot + name
+		p["PATH_INFO"] = info
+	}
+	if p["PATH_INFO"] != "" && t.DocumentRoot != "" {
+		p["PATH_TRANSLATED"] = t.DocumentRoot + p["PATH_INFO"]
+	}
+
+	if req.ContentLength > 0 {
+		p["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		p["REMOTE_ADDR"] = host
+		p["REMOTE_PORT"] = port
+	} else {
+		p["REMOTE_ADDR"] = ipOnly(req.RemoteAddr)
+	}
+
+	// The Host the client asked for, not the member
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		p["SERVER_NAME"] = h
+		p["SERVER_PORT"] = port
+	} else {
+		p["SERVER_NAME"] = host
+	}
+	proto := req.Header.Get("X-Forwarded-Proto")
+	if req.TLS != nil || proto == "https" {
+		p["HTTPS"] = "on"
+		if p["SERVER_PORT"] == "" {
+			p["SERVER_PORT"] = "443"
+		}
+	} else if p["SERVER_PORT"] == "" {
+		p["SERVER_PORT"] = "80"
+	}
+
+	for k, v := range req.Header {
+		k = strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		switch k {
+		case "CONTENT_TYPE", "CONTENT_LENGTH", "PROXY":
+			// Already params, or httpoxy
+			continue
+		}
+		p["HTTP_"+k] = strings.Join(v, ", ")
+	}
+	p["HTTP_HOST"] = host
+
+	for k, v := range t.Params {
+		p[k] = v
+	}
+	return p
+}
+
+// readCGIResponse reads the CGI headers from the body, returning an http.Response that reads the rest of it
+func readCGIResponse(req *http.Request, body *fcgiReader) (*http.Response, error) {
+	tp := textproto.NewReader(bufio.NewReader(body))
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if body.err != nil && body.err != io.EOF {
+				return nil, body.err
+			}
+			return nil, ErrFCGIMalformedResponse
+		}
+		return nil, err
+	}
+
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header(mh),
+		Request:    req,
+		// The rest of what was buffered, then the rest of the records
+		Body:          &fcgiBody{Reader: tp.R, closer: body},
+		ContentLength: -1,
+	}
+
+	if status := resp.Header.Get("Status"); status != "" {
+		code, _, _ := strings.Cut(status, " ")
+		resp.StatusCode, err = strconv.Atoi(code)
+		if err != nil || resp.StatusCode < 100 || resp.StatusCode > 999 {
+			resp.Body.Close()
+			return nil, ErrFCGIMalformedResponse
+		}
+		resp.Status = status
+		resp.Header.Del("Status")
+	} else if resp.Header.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+		resp.Status = "302 Found"
+	}
+
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			resp.ContentLength = n
+		}
+	}
+	return resp, nil
+}
+
+// fcgiBody is the http.Response Body of a FastCGI response
+type fcgiBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+// Close closes the underlying fcgiReader
+func (b *fcgiBody) Close() error {
+	return b.closer.Close()
+}
+
+// fcgiReader reads the stdout stream of a FastCGI response from its records, logging stderr as it goes, until the
+// request ends
+type fcgiReader struct {
+	r    *bufio.Reader
+	name string
+	done func()
+	// left is how much of the current stdout record has yet to be read, and pad its padding
+	left int
+	pad  int
+	err  error
+	once sync.Once
+}
+
+// Read reads stdout
+func (f *fcgiReader) Read(p []byte) (int, error) {
+	for f.left == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		f.err = f.next()
+	}
+
+	if len(p) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= n
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+	if f.left == 0 && f.pad > 0 {
+		if _, err = f.r.Discard(f.pad); err != nil {
+			f.err = err
+		}
+	}
+	return n, nil
+}
+
+// next reads records until there is stdout to read, returning io.EOF when the request has ended
+func (f *fcgiReader) next() error {
+	var h [fcgiHeaderLength]byte
+	if _, err := io.ReadFull(f.r, h[:]); err != nil {
+		if err == io.EOF {
+			// Ended without an end request
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if h[0] != fcgiVersion {
+		return ErrFCGIMalformedResponse
+	}
+	length := int(binary.BigEndian.Uint16(h[4:6]))
+	pad := int(h[6])
+
+	switch h[1] {
+	case fcgiStdout:
+		f.left, f.pad = length, pad
+		if length == 0 && pad > 0 {
+			_, err := f.r.Discard(pad)
+			return err
+		}
+		return nil
+	case fcgiStderr:
+		msg := make([]byte, length+pad)
+		if _, err := io.ReadFull(f.r, msg); err != nil {
+			return err
+		}
+		if length > 0 {
+			ErrorOut.Printf("FastCGI Pool %s: %s\n", f.name, strings.TrimSpace(string(msg[:length])))
+		}
+		return nil
+	case fcgiEndRequest:
+		body := make([]byte, length+pad)
+		if _, err := io.ReadFull(f.r, body); err != nil {
+			return err
+		}
+		if length >= 5 && body[4] != fcgiRequestComplete {
+			// Overloaded, or otherwise unwilling
+			return fmt.Errorf("%w: protocol status %d", ErrFCGIRequestRejected, body[4])
+		}
+		return io.EOF
+	default:
+		if _, err := f.r.Discard(length + pad); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// Close closes the connection, once
+func (f *fcgiReader) Close() error {
+	f.once.Do(f.done)
+	return nil
+}
+
+// writeFCGIRecord writes a record of the type with the content, which must be at most fcgiMaxContent long
+func writeFCGIRecord(w io.Writer, recType byte, content []byte) error {
+	h := [fcgiHeaderLength]byte{fcgiVersion, recType}
+	binary.BigEndian.PutUint16(h[2:4], fcgiRequestID)
+	binary.BigEndian.PutUint16(h[4:6], uint16(len(content)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// writeFCGIStream writes the content as records of the type, and then the empty record that ends the stream
+func writeFCGIStream(w io.Writer, recType byte, content []byte) error {
+	for len(content) > 0 {
+		n := min(len(content), fcgiMaxContent)
+		if err := writeFCGIRecord(w, recType, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return writeFCGIRecord(w, recType, nil)
+}
+
+// encodeFCGIParams returns the name-value pair encoding of the params
+func encodeFCGIParams(params map[string]string) []byte {
+	var b []byte
+	length := func(n int) {
+		if n < 128 {
+			b = append(b, byte(n))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+		}
+	}
+	for k, v := range params {
+		length(len(k))
+		length(len(v))
+		b = append(b, k...)
+		b = append(b, v...)
+	}
+	return b
+}
@@ -0,0 +1,219 @@
+package jar
+
+import (
+	"github.com/cognusion/go-jar/workers"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPoolFCGI(t *testing.T) {
+
+	// Socket paths must be short, so not t.TempDir
+	dir, err := os.MkdirTemp("", "jarfcgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/missing.php":
+				http.NotFound(w, r)
+				return
+			case "/moved.php":
+				w.Header().Set("Location", "/elsewhere")
+				w.WriteHeader(http.StatusFound)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Member", name)
+			w.Write([]byte(name + " " + r.Method + " " + r.Host + " " + r.URL.RequestURI() + " " +
+				fcgi.ProcessEnv(r)["SCRIPT_FILENAME"] + " " + string(b)))
+		})
+	}
+	serve := func(network, addr, name string) net.Listener {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go fcgi.Serve(l, handler(name))
+		return l
+	}
+
+	one := serve("tcp", "127.0.0.1:0", "one")
+	defer one.Close()
+	two := serve("tcp", "127.0.0.1:0", "two")
+	defer two.Close()
+	sock := serve("unix", filepath.Join(dir, "fpm.sock"), "sock")
+	defer sock.Close()
+
+	Convey("When a Pool has fcgi members, requests are made over FastCGI, round-robin", t, func() {
+		pool := NewPool(&PoolConfig{Name: "fcgitest", Members: []string{"fcgi://" + one.Addr().String(), "fcgi://" + two.Addr().String()},
+			FCGIDocumentRoot: "/var/www/html/", HealthCheckURI: "/ping.php", HealthCheckShotgun: true})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		seen := make(map[string]bool)
+		for range 4 {
+			req := httptest.NewRequest("GET", "http://app.example.com/index.php/things?id=1", nil)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(rr.Header().Get("X-Member"), ShouldNotBeEmpty)
+			seen[rr.Body.String()] = true
+		}
+		So(seen, ShouldContainKey, "one GET app.example.com /index.php/things?id=1 /var/www/html/index.php ")
+		So(seen, ShouldContainKey, "two GET app.example.com /index.php/things?id=1 /var/www/html/index.php ")
+
+		Convey("... request bodies are sent", func() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("POST", "http://app.example.com/form.php", strings.NewReader("a=b")))
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(rr.Body.String(), ShouldEndWith, "POST app.example.com /form.php /var/www/html/form.php a=b")
+		})
+
+		Convey("... and statuses and headers are returned", func() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "http://app.example.com/missing.php", nil))
+			So(rr.Code, ShouldEqual, http.StatusNotFound)
+
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "http://app.example.com/moved.php", nil))
+			So(rr.Code, ShouldEqual, http.StatusFound)
+			So(rr.Header().Get("Location"), ShouldEqual, "/elsewhere")
+		})
+
+		Convey("... and health checked over FastCGI too", func() {
+			oldAW := AddWork
+			defer func() { AddWork = oldAW }()
+			var work []workers.Work
+			AddWork = func(w workers.Work) {
+				work = append(work, w)
+			}
+
+			pools := &Pools{pools: map[string]*Pool{"fcgitest": pool}}
+			pools.tickFunc(nil)
+			So(work, ShouldHaveLength, 2)
+			for _, w := range work {
+				res, ok := w.Work().(HealthCheckResult)
+				So(ok, ShouldBeTrue)
+				So(res.StatusCode, ShouldEqual, http.StatusOK)
+			}
+		})
+	})
+
+	Convey("When a Pool has fcgi+unix members, requests are made over their sockets", t, func() {
+		pool := NewPool(&PoolConfig{Name: "fcgiunixtest", Members: []string{"fcgi+unix://" + sock.Addr().String()},
+			FCGIScriptFilename: "/srv/app/public/index.php",
+			ConsistentHashing:  true, ConsistentHashSources: []string{"header"}, ConsistentHashNames: []string{"X-User"}})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(pool.GetMember(pool.ListMembers()[0]).Address, ShouldStartWith, dir)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "http://app.example.com/users/1", nil))
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "sock GET app.example.com /users/1 /srv/app/public/index.php ")
+	})
+
+	Convey("When a FastCGI member is gone, or isn't speaking FastCGI, the request fails like any other bad member", t, func() {
+		junk, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer junk.Close()
+		go func() {
+			for {
+				c, err := junk.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+				c.Close()
+			}
+		}()
+
+		for _, member := range []string{"fcgi+unix://" + filepath.Join(dir, "gone.sock"), "fcgi://" + junk.Addr().String()} {
+			pool := NewPool(&PoolConfig{Name: "fcgibadtest", Members: []string{member}, FCGIDocumentRoot: "/var/www"})
+			h, err := pool.GetPool()
+			So(err, ShouldBeNil)
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/index.php", nil))
+			So(rr.Code, ShouldEqual, http.StatusBadGateway)
+		}
+	})
+
+	Convey("When a FastCGI Pool is misconfigured, it won't materialize", t, func() {
+		_, err := NewPool(&PoolConfig{Name: "fcgiconftest", Members: []string{"fcgi://127.0.0.1:9000"}}).GetPool()
+		So(err, ShouldEqual, ErrPoolConfigFCGINoScript)
+
+		_, err = NewPool(&PoolConfig{Name: "fcgiconftest", Members: []string{"fcgi://127.0.0.1:9000"},
+			FCGIDocumentRoot: "/var/www", FCGISplitPath: `^(.+\.php)`}).GetPool()
+		So(err, ShouldEqual, ErrPoolConfigFCGISplitPath)
+	})
+}
+
+func TestFCGIParams(t *testing.T) {
+	ft := &FCGITransport{DocumentRoot: "/var/www", Index: "index.php", SplitPath: regexp.MustCompile(fcgiDefaultSplitPath),
+		Params: map[string]string{"APP_ENV": "test"}}
+
+	params := func(target string) map[string]string {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Proxy", "http://evil")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		return ft.params(req)
+	}
+
+	Convey("When a request path has path info, it is split from the script name", t, func() {
+		p := params("http://app.example.com/blog/post.php/2024/hello?x=y")
+		So(p["SCRIPT_NAME"], ShouldEqual, "/blog/post.php")
+		So(p["SCRIPT_FILENAME"], ShouldEqual, "/var/www/blog/post.php")
+		So(p["PATH_INFO"], ShouldEqual, "/2024/hello")
+		So(p["PATH_TRANSLATED"], ShouldEqual, "/var/www/2024/hello")
+		So(p["QUERY_STRING"], ShouldEqual, "x=y")
+		So(p["REQUEST_URI"], ShouldEqual, "/blog/post.php/2024/hello?x=y")
+		So(p["DOCUMENT_ROOT"], ShouldEqual, "/var/www")
+		So(p["SERVER_NAME"], ShouldEqual, "app.example.com")
+		So(p["SERVER_PORT"], ShouldEqual, "443")
+		So(p["HTTPS"], ShouldEqual, "on")
+		So(p["REMOTE_ADDR"], ShouldEqual, "192.0.2.1")
+		So(p["APP_ENV"], ShouldEqual, "test")
+		So(p, ShouldNotContainKey, "HTTP_PROXY")
+	})
+
+	Convey("When a request is for a directory, the index script is used", t, func() {
+		p := params("http://app.example.com/admin/")
+		So(p["SCRIPT_NAME"], ShouldEqual, "/admin/index.php")
+		So(p["PATH_INFO"], ShouldBeEmpty)
+		So(p, ShouldNotContainKey, "PATH_TRANSLATED")
+	})
+
+	Convey("When there is a ScriptFilename, every request is sent to it, with its path as path info", t, func() {
+		ft.ScriptFilename = "/var/www/public/index.php"
+		defer func() { ft.ScriptFilename = "" }()
+
+		p := params("http://app.example.com/users/1")
+		So(p["SCRIPT_FILENAME"], ShouldEqual, "/var/www/public/index.php")
+		So(p["SCRIPT_NAME"], ShouldEqual, "/public/index.php")
+		So(p["PATH_INFO"], ShouldEqual, "/users/1")
+	})
+
+	Convey("When params are encoded, long names and values get four-byte lengths", t, func() {
+		long := strings.Repeat("v", 200)
+		b := encodeFCGIParams(map[string]string{"K": long})
+		So(b[0], ShouldEqual, 1)
+		So(b[1:5], ShouldResemble, []byte{0x80, 0, 0, 200})
+		So(string(b[5:6]), ShouldEqual, "K")
+		So(string(b[6:]), ShouldEqual, long)
+	})
+}
@@ -0,0 +1,100 @@
+package jar
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+
+	"fmt"
+	"net/url"
+	"time"
+)
+
+func init() {
+	MemberDiscoverers["file"] = discoverFile
+}
+
+// fileMember is a member entry in a members file
+type fileMember struct {
+	URL    string
+	Weight int
+	Zone   string
+}
+
+// fileDiscovery keeps a Pool's members in sync with a JSON or YAML file, which is reread when it is written to.
+// The format is determined by the file extension, and the members are listed under "members", each with a "url",
+// and an optional "weight" and "zone":
+//
+//	members:
+//	  - url: http://10.0.0.1:8080
+//	    weight: 5
+//	    zone: us-east-1a
+//
+// As the members are full URLs, the "scheme" query parameter only matters if the file is the first member of the
+// Pool, where it chooses the type of Pool (default "http"). If the "interval" query parameter is set,
+// the file is also reread that often, which is useful if it is replaced instead of written to.
+type fileDiscovery struct {
+	pool *Pool
+	name string
+	path string
+}
+
+// discoverFile is a MemberDiscoverer for file:// members
+func discoverFile(p *Pool, source *url.URL) error {
+	d := fileDiscovery{
+		pool: p,
+		name: source.Scheme + "://" + source.Host + source.Path,
+		path: source.Host + source.Path,
+	}
+
+	if err := d.sync(); err != nil {
+		// The file should be usable when we start
+		return err
+	}
+
+	if err := FileWatcher.Add(d.path, func(e fsnotify.Event) { d.sync() }); err != nil {
+		return fmt.Errorf("error watching %s: %w", d.name, err)
+	}
+
+	if i := source.Query().Get("interval"); i != "" {
+		interval, err := time.ParseDuration(i)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid interval for %s: %s", d.name, i)
+		}
+		TaskRegistry.AddEvery(fmt.Sprintf("Pool %s discovery %s", p.Config.Name, d.name), d.sync, interval)
+	}
+
+	DebugOut.Printf("\t\tFile discovery of %s\n", d.name)
+	return nil
+}
+
+// sync reads the members, and applies them to the Pool
+func (d *fileDiscovery) sync() error {
+	members, err := d.read()
+	if err == nil {
+		err = d.pool.SyncMembers(d.name, members)
+	}
+	return d.pool.discoveryStatus(d.name, err)
+}
+
+// read returns the members currently in the file
+func (d *fileDiscovery) read() ([]DiscoveredMember, error) {
+	v := viper.New()
+	v.SetConfigFile(d.path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var fms []fileMember
+	if err := v.UnmarshalKey("members", &fms); err != nil {
+		return nil, err
+	}
+
+	members := make([]DiscoveredMember, 0, len(fms))
+	for _, fm := range fms {
+		if fm.URL == "" {
+			continue
+		}
+		members = append(members, DiscoveredMember{URL: fm.URL, Weight: fm.Weight, AZ: fm.Zone})
+	}
+	return members, nil
+}
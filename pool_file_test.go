@@ -0,0 +1,86 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolFileDiscovery(t *testing.T) {
+
+	members := func(p *Pool) string {
+		var ms []string
+		for _, u := range p.ListMembers() {
+			ms = append(ms, u.String())
+		}
+		sort.Strings(ms)
+		return strings.Join(ms, ",")
+	}
+
+	Convey("When a Pool has a file:// member with YAML, the listed members are added, and follow the file", t, func() {
+		file := filepath.Join(t.TempDir(), "members.yaml")
+		So(os.WriteFile(file, []byte(`members:
+  - url: http://one:8080
+    weight: 5
+    zone: us-east-1a
+  - url: http://two:8080
+`), 0600), ShouldBeNil)
+
+		pool := NewPool(&PoolConfig{
+			Name:    "filetest",
+			Members: []string{"file://" + file},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(members(pool), ShouldEqual, "http://one:8080,http://two:8080")
+
+		one, _ := url.Parse("http://one:8080")
+		So(serverOptionsToWeight(pool.GetMember(one).Weight), ShouldEqual, 5)
+		So(pool.GetMember(one).AZ, ShouldEqual, "us-east-1a")
+
+		So(os.WriteFile(file, []byte(`members:
+  - url: http://two:8080
+  - url: http://three:8080
+`), 0600), ShouldBeNil)
+		So(waitFor(2*time.Second, func() bool {
+			return members(pool) == "http://three:8080,http://two:8080"
+		}), ShouldBeTrue)
+
+		Convey("... and if the file is emptied or broken, the existing members are kept", func() {
+			So(os.WriteFile(file, []byte(`members: [`), 0600), ShouldBeNil)
+			So(waitFor(2*time.Second, func() bool {
+				_, serr := Status.Get("filetest_file://" + file + "_Discovery")
+				return serr == nil
+			}), ShouldBeTrue)
+			So(members(pool), ShouldEqual, "http://three:8080,http://two:8080")
+		})
+	})
+
+	Convey("When a Pool has a file:// member with JSON, alongside a static member, both are used", t, func() {
+		file := filepath.Join(t.TempDir(), "members.json")
+		So(os.WriteFile(file, []byte(`{"members": [{"url": "http://one:8080", "weight": 2}]}`), 0600), ShouldBeNil)
+
+		pool := NewPool(&PoolConfig{
+			Name:    "filejsontest",
+			Members: []string{"http://static:80", "file://" + file},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(members(pool), ShouldEqual, "http://one:8080,http://static:80")
+	})
+
+	Convey("When a Pool has a file:// member that doesn't exist, materialization fails", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:    "filemissingtest",
+			Members: []string{"file:///no/such/members.yaml"},
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldNotBeNil)
+	})
+}
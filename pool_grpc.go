@@ -0,0 +1,192 @@
+package jar
+
+import (
+	"github.com/cognusion/go-prw"
+	"github.com/vulcand/oxy/v2/utils"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes that JAR may generate itself
+const (
+	grpcStatusCancelled        = 1
+	grpcStatusDeadlineExceeded = 4
+	grpcStatusUnavailable      = 14
+)
+
+func init() {
+	// Members that speak HTTP/2 without TLS
+	Materializers["h2c"] = materializeHTTP
+	Materializers["grpc"] = materializeHTTP
+}
+
+// isH2CScheme returns true if members with the scheme are proxied over cleartext HTTP/2
+func isH2CScheme(scheme string) bool {
+	return scheme == "h2c" || scheme == "grpc"
+}
+
+// transportScheme returns the scheme that members with the scheme are actually requested with
+func transportScheme(scheme string) string {
+	switch scheme {
+	case "h2c", "grpc", "ws", "fcgi":
+		return "http"
+	case "wss":
+		return "https"
+	}
+	return scheme
+}
+
+// isH2C returns true if the Pool's members are proxied over cleartext HTTP/2
+func (p *Pool) isH2C() bool {
+	if len(p.Config.Members) < 1 {
+		return false
+	}
+	u, err := url.Parse(p.Config.Members[0])
+	if err != nil {
+		return false
+	}
+	if isDiscoveryURL(u) {
+		return isH2CScheme(discoveredScheme(u))
+	}
+	return isH2CScheme(u.Scheme)
+}
+
+// isGRPCRequest returns true if the request is a gRPC call
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcTimeout parses a grpc-timeout header value (e.g. "100m" or "5S"), returning the duration and true,
+// or false if it is missing or malformed
+func grpcTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		// The spec allows at most 8 digits
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// grpcStatus returns the gRPC status from the response headers or trailers, or an empty string
+func grpcStatus(h http.Header) string {
+	if s := h.Get("Grpc-Status"); s != "" {
+		return s
+	}
+	return h.Get(http.TrailerPrefix + "Grpc-Status")
+}
+
+// grpcErrorHandler is a proxy ErrorHandler that answers gRPC calls with a trailers-only gRPC error, so
+// clients see a gRPC status instead of a protocol error, and hands everything else off to the default ErrorHandler
+func grpcErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if !isGRPCRequest(r) {
+		utils.DefaultHandler.ServeHTTP(w, r, err)
+		return
+	}
+
+	code, msg := grpcStatusUnavailable, "upstream unavailable"
+	if errors.Is(err, context.DeadlineExceeded) {
+		code, msg = grpcStatusDeadlineExceeded, "deadline exceeded"
+	} else if errors.Is(err, context.Canceled) {
+		code, msg = grpcStatusCancelled, "cancelled"
+	}
+	DebugOut.Print(ErrRequestError{r, "gRPC upstream error: " + err.Error()}.String())
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// h2cHandler is an unchainable handler that must be placed directly in front of the proxy, after the PoolManager has
+// chosen a member, requesting the member over cleartext HTTP/2. gRPC deadlines are applied to the upstream request,
+// and response trailers are passed through any PluggableResponseWriter that has already been flushed.
+func h2cHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if d, ok := grpcTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+
+		// WithContext makes a shallow copy, so the member URL is untouched for everyone else
+		newReq := r.WithContext(ctx)
+		newReq.URL = CopyURL(r.URL)
+		newReq.URL.Scheme = transportScheme(r.URL.Scheme)
+
+		rw, ok := w.(*prw.PluggableResponseWriter)
+		if !ok {
+			next.ServeHTTP(w, newReq)
+			return
+		}
+
+		tw := &trailerWriter{PluggableResponseWriter: rw}
+		next.ServeHTTP(tw, newReq)
+		if tw.flushed {
+			// The headers are long gone, so the trailers need to be sent on their own
+			rw.AddFlushFunc(flushTrailers)
+		}
+	})
+}
+
+// trailerWriter is a PluggableResponseWriter that notes whether it has been flushed
+type trailerWriter struct {
+	*prw.PluggableResponseWriter
+	flushed bool
+}
+
+// Flush notes the flush, and flushes
+func (t *trailerWriter) Flush() {
+	t.flushed = true
+	t.PluggableResponseWriter.Flush()
+}
+
+// flushTrailers is a PluggableResponseWriter flush func that copies the trailers to the original ResponseWriter,
+// and flushes it. It must only be used after the PluggableResponseWriter has been flushed normally.
+func flushTrailers(to http.ResponseWriter, from *prw.PluggableResponseWriter) {
+	h := from.Header()
+	for _, declared := range h.Values("Trailer") {
+		for _, k := range strings.Split(declared, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if v, ok := h[k]; ok {
+				to.Header()[k] = v
+			}
+		}
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			to.Header()[k] = v
+		}
+	}
+
+	if f, ok := to.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,185 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a goro-safe bytes.Buffer
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestGRPCTimeout(t *testing.T) {
+
+	Convey("When grpc-timeout values are parsed, they are understood, or refused", t, func() {
+		for v, d := range map[string]time.Duration{
+			"1H":        time.Hour,
+			"2M":        2 * time.Minute,
+			"3S":        3 * time.Second,
+			"100m":      100 * time.Millisecond,
+			"5u":        5 * time.Microsecond,
+			"99999999n": 99999999 * time.Nanosecond,
+		} {
+			got, ok := grpcTimeout(v)
+			So(ok, ShouldBeTrue)
+			So(got, ShouldEqual, d)
+		}
+
+		for _, v := range []string{"", "S", "10", "10x", "-1S", "123456789S"} {
+			_, ok := grpcTimeout(v)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestPoolH2C(t *testing.T) {
+
+	release := make(chan struct{})
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		case "/stream":
+			w.Write([]byte("one\n"))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte("two\n"))
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "not found")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	oa := AccessOut
+	defer func() { AccessOut = oa }()
+	var logs lockedBuffer
+	AccessOut = log.New(&logs, "", 0)
+
+	pool := NewPool(&PoolConfig{
+		Name:    "h2ctest",
+		Members: []string{strings.Replace(backend.URL, "http://", "grpc://", 1)},
+	})
+	h, err := pool.GetPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The front end accepts cleartext HTTP/2 like the listener does with h2c set
+	front := httptest.NewUnstartedServer(AccessLogHandler(h))
+	front.Config.Protocols = new(http.Protocols)
+	front.Config.Protocols.SetHTTP1(true)
+	front.Config.Protocols.SetUnencryptedHTTP2(true)
+	front.Start()
+	defer front.Close()
+
+	ct := &http.Transport{Protocols: new(http.Protocols)}
+	ct.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: ct}
+	defer ct.CloseIdleConnections()
+
+	call := func(path string, timeout string) *http.Response {
+		req, _ := http.NewRequest("POST", front.URL+path, strings.NewReader("hello"))
+		req.Header.Set("Content-Type", "application/grpc")
+		if timeout != "" {
+			req.Header.Set("Grpc-Timeout", timeout)
+		}
+		resp, err := client.Do(req)
+		So(err, ShouldBeNil)
+		return resp
+	}
+
+	Convey("When a Pool has grpc:// members, calls are proxied over HTTP/2, with their trailers, and the status is logged", t, func() {
+		resp := call("/", "")
+		defer resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.ProtoMajor, ShouldEqual, 2)
+		io.ReadAll(resp.Body)
+		So(resp.Trailer.Get("Grpc-Status"), ShouldEqual, "5")
+		So(resp.Trailer.Get("Grpc-Message"), ShouldEqual, "not found")
+
+		So(waitFor(time.Second, func() bool {
+			return strings.Contains(logs.String(), `"grpcstatus":"5"`)
+		}), ShouldBeTrue)
+	})
+
+	Convey("When a gRPC member streams its response, it is flushed to the client as it comes", t, func() {
+		resp := call("/stream", "")
+		defer resp.Body.Close()
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(resp.Body, buf)
+		So(err, ShouldBeNil)
+		So(string(buf), ShouldEqual, "one\n")
+
+		close(release)
+		rest, _ := io.ReadAll(resp.Body)
+		So(string(rest), ShouldEqual, "two\n")
+		So(resp.Trailer.Get("Grpc-Status"), ShouldEqual, "5")
+	})
+
+	Convey("When a gRPC call has a deadline, it is applied to the member, and exceeding it is a gRPC error", t, func() {
+		start := time.Now()
+		resp := call("/slow", "50m")
+		defer resp.Body.Close()
+		io.ReadAll(resp.Body)
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Grpc-Status"), ShouldEqual, "4")
+	})
+
+	Convey("When a gRPC member is unavailable, the call gets a gRPC error", t, func() {
+		dead := NewPool(&PoolConfig{
+			Name:    "h2cdeadtest",
+			Members: []string{"h2c://127.0.0.1:1"},
+		})
+		dh, err := dead.GetPool()
+		So(err, ShouldBeNil)
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+		req.Header.Set("Content-Type", "application/grpc")
+		dh.ServeHTTP(rr, req)
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Header().Get("Grpc-Status"), ShouldEqual, "14")
+
+		Convey("... but a plain request gets a plain error", func() {
+			rr := httptest.NewRecorder()
+			dh.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			So(rr.Code, ShouldEqual, http.StatusBadGateway)
+		})
+	})
+}
@@ -0,0 +1,291 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// hedgeMinSamples is the number of latencies that must be observed before the p95 is trusted
+	hedgeMinSamples = 20
+)
+
+// hedge race entrants
+const (
+	hedgePrimary int32 = iota + 1
+	hedgeSecondary
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultHedgeDelay] = 100 * time.Millisecond
+}
+
+// Hedger is an http.Handler that wraps a PoolManager, and if a GET or HEAD request is taking too long,
+// sends the same request to a different member. Whichever responds first is returned, and the other is cancelled.
+// If the PoolManager is a MemberServer, e.g. a LeastRequestsPool, the hedge is accounted for like any other request.
+type Hedger struct {
+	// Delay is how long a request may take before it is hedged. If zero, the observed p95 latency is used.
+	Delay time.Duration
+	// DefaultDelay is used instead of the p95 latency until enough latencies have been observed
+	DefaultDelay time.Duration
+
+	pm      PoolManager
+	latency metrics.Timer
+	fired   metrics.Counter
+	won     metrics.Counter
+}
+
+// NewHedger returns a Hedger wrapping the PoolManager. Its latency and counters are registered with Metrics.
+func NewHedger(pool *Pool, pm PoolManager) *Hedger {
+	return &Hedger{
+		Delay:        pool.Config.HedgeDelay,
+		DefaultDelay: Conf.GetDuration(ConfigPoolsDefaultHedgeDelay),
+		pm:           pm,
+		latency:      metrics.GetOrRegisterTimer(fmt.Sprintf("%s_HedgeLatency", pool.Config.Name), Metrics),
+		fired:        metrics.GetOrRegisterCounter(fmt.Sprintf("%s_HedgesFired", pool.Config.Name), Metrics),
+		won:          metrics.GetOrRegisterCounter(fmt.Sprintf("%s_HedgesWon", pool.Config.Name), Metrics),
+	}
+}
+
+// String returns a summary of the Hedger
+func (h *Hedger) String() string {
+	if h.Delay > 0 {
+		return fmt.Sprintf("after %s", h.Delay)
+	}
+	return fmt.Sprintf("after p95 (default %s)", h.DefaultDelay)
+}
+
+// ServeHTTP handles its part of the request
+func (h *Hedger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Upgrade") != "" {
+		// Not hedgeable
+		h.pm.ServeHTTP(w, r)
+		return
+	}
+
+	var (
+		race    = hedgeRace{cancels: make(map[int32]context.CancelFunc)}
+		done    = make(chan *hedgeWriter, 2)
+		start   = time.Now()
+		timer   = time.NewTimer(h.delay())
+		running = 1
+	)
+	defer timer.Stop()
+
+	primary := race.run(w, r, hedgePrimary, done, h.pm.ServeHTTP)
+
+	select {
+	case hw := <-done:
+		// Done before we needed to hedge
+		h.finish(r, hw, start)
+		return
+	case <-timer.C:
+	}
+
+	if race.decided() {
+		// Primary is already responding, so we wait for it
+		h.finish(r, <-done, start)
+		return
+	}
+
+	member := h.alternate(primary.Member())
+	if member == nil {
+		// Nowhere else to go
+		h.finish(r, <-done, start)
+		return
+	}
+
+	h.fired.Inc(1)
+	DebugOut.Print(ErrRequestError{r, fmt.Sprintf("Hedging to %s after %s", member.String(), time.Since(start))}.String())
+	race.run(w, r, hedgeSecondary, done, func(hw http.ResponseWriter, hr *http.Request) {
+		// Counted against the member, if the PoolManager counts
+		serveMember(h.pm, hw, hr, member)
+	})
+	running++
+
+	var winner *hedgeWriter
+	for ; running > 0; running-- {
+		// The loser is cancelled when the winner claims the response, but we let everyone finish before we return
+		if hw := <-done; hw.won {
+			winner = hw
+		}
+	}
+	h.finish(r, winner, start)
+}
+
+// hedgeRace is the state of a hedged request, shared by the entrants
+type hedgeRace struct {
+	lock    sync.Mutex
+	winner  int32
+	cancels map[int32]context.CancelFunc
+}
+
+// run starts an entrant in the race, returning its poolAttempt, and sending its hedgeWriter to done when it is complete
+func (race *hedgeRace) run(w http.ResponseWriter, r *http.Request, id int32, done chan<- *hedgeWriter, serve http.HandlerFunc) *poolAttempt {
+	ctx, cancel := context.WithCancel(r.Context())
+	race.lock.Lock()
+	race.cancels[id] = cancel
+	race.lock.Unlock()
+
+	hw := &hedgeWriter{
+		w:       w,
+		header:  make(http.Header),
+		race:    race,
+		id:      id,
+		attempt: &poolAttempt{},
+	}
+
+	rr := r.WithContext(context.WithValue(ctx, poolAttemptKey, hw.attempt))
+	rr.Header = r.Header.Clone() // downstream handlers may mutate them
+
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil && rec != http.ErrAbortHandler {
+				ErrorOut.Print(ErrRequestError{r, fmt.Sprintf("Hedged request panicked: %v", rec)}.String())
+			}
+			// Nothing written at all is an empty 200, if nobody else has claimed the response
+			hw.claim(http.StatusOK)
+			cancel()
+			done <- hw
+		}()
+		serve(hw, rr)
+	}()
+	return hw.attempt
+}
+
+// claim returns true if the id wins the race, cancelling the other entrants
+func (race *hedgeRace) claim(id int32) bool {
+	race.lock.Lock()
+	defer race.lock.Unlock()
+
+	if race.winner != 0 {
+		return race.winner == id
+	}
+	race.winner = id
+	for i, cancel := range race.cancels {
+		if i != id {
+			cancel()
+		}
+	}
+	return true
+}
+
+// decided returns true if the race has been won
+func (race *hedgeRace) decided() bool {
+	race.lock.Lock()
+	defer race.lock.Unlock()
+	return race.winner != 0
+}
+
+// finish records the outcome of the race
+func (h *Hedger) finish(r *http.Request, hw *hedgeWriter, start time.Time) {
+	h.latency.UpdateSince(start)
+	if hw.id == hedgeSecondary {
+		h.won.Inc(1)
+	}
+	if a, ok := r.Context().Value(poolAttemptKey).(*poolAttempt); ok {
+		// Pass the winner on up
+		a.SetMember(hw.attempt.Member())
+	}
+}
+
+// delay returns how long to wait before hedging
+func (h *Hedger) delay() time.Duration {
+	if h.Delay > 0 {
+		return h.Delay
+	}
+	if h.latency.Count() < hedgeMinSamples {
+		return h.DefaultDelay
+	}
+	return time.Duration(h.latency.Percentile(0.95))
+}
+
+// alternate returns a member that isn't the primary, or nil if there isn't one
+func (h *Hedger) alternate(primary string) *url.URL {
+	servers := h.pm.Servers()
+	if len(servers) < 2 {
+		return nil
+	}
+
+	// We don't ask NextServer, as some PoolManagers advance their state when asked
+	offset := rand.IntN(len(servers))
+	for i := range servers {
+		if u := servers[(offset+i)%len(servers)]; u.String() != primary {
+			return CopyURL(u)
+		}
+	}
+	return nil
+}
+
+// hedgeWriter is an http.ResponseWriter for an entrant in a hedge race. The first to write its headers wins,
+// and the rest are discarded.
+type hedgeWriter struct {
+	w       http.ResponseWriter
+	header  http.Header
+	race    *hedgeRace
+	id      int32
+	attempt *poolAttempt
+	won     bool
+	lost    bool
+}
+
+// Header returns the header map
+func (hw *hedgeWriter) Header() http.Header {
+	if hw.won {
+		return hw.w.Header()
+	}
+	return hw.header
+}
+
+// WriteHeader claims the response, if it is still available
+func (hw *hedgeWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		// Informational responses aren't worth racing over
+		return
+	}
+	hw.claim(code)
+}
+
+// claim tries to win the race, writing the headers if successful
+func (hw *hedgeWriter) claim(code int) {
+	if hw.won || hw.lost {
+		return
+	}
+	if !hw.race.claim(hw.id) {
+		hw.lost = true
+		return
+	}
+
+	hw.won = true
+	h := hw.w.Header()
+	for k, v := range hw.header {
+		h[k] = v
+	}
+	hw.w.WriteHeader(code)
+}
+
+// Write writes the body, if we won
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	hw.claim(http.StatusOK)
+	if hw.lost {
+		return len(b), nil
+	}
+	return hw.w.Write(b)
+}
+
+// Flush flushes the response, if we won
+func (hw *hedgeWriter) Flush() {
+	if !hw.won {
+		return
+	}
+	if f, ok := hw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,149 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolHedging(t *testing.T) {
+
+	var cancelled int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			atomic.AddInt64(&cancelled, 1)
+			return
+		case <-time.After(300 * time.Millisecond):
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	Convey("When a Hedge Pool has a slow member, GET requests are hedged to the other member, and the slow one is cancelled", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:       "hedgetest",
+			Members:    []string{slow.URL, fast.URL},
+			Hedge:      true,
+			HedgeDelay: 20 * time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 10; i++ {
+			start := time.Now()
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(rr.Body.String(), ShouldEqual, "fast")
+			So(time.Since(start), ShouldBeLessThan, 250*time.Millisecond)
+		}
+
+		So(Metrics.Get("hedgetest_HedgesFired").(metrics.Counter).Count(), ShouldEqual, 5)
+		So(Metrics.Get("hedgetest_HedgesWon").(metrics.Counter).Count(), ShouldEqual, 5)
+		So(Metrics.Get("hedgetest_HedgeLatency").(metrics.Timer).Count(), ShouldEqual, 10)
+		So(waitFor(time.Second, func() bool { return atomic.LoadInt64(&cancelled) == 5 }), ShouldBeTrue)
+	})
+
+	Convey("When a Hedge Pool has a slow member, POST requests are not hedged", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:       "hedgeposttest",
+			Members:    []string{slow.URL, fast.URL},
+			Hedge:      true,
+			HedgeDelay: 20 * time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		var slows int
+		for i := 0; i < 4; i++ {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			if rr.Body.String() == "slow" {
+				slows++
+			}
+		}
+		So(slows, ShouldEqual, 2)
+		So(Metrics.Get("hedgeposttest_HedgesFired").(metrics.Counter).Count(), ShouldEqual, 0)
+	})
+}
+
+func TestPoolHedgerChoices(t *testing.T) {
+
+	Convey("When a Hedger has no fixed delay, it uses the default until it has enough samples, and then the p95", t, func() {
+		h := Hedger{DefaultDelay: time.Second, latency: metrics.NewTimer()}
+		So(h.delay(), ShouldEqual, time.Second)
+
+		for i := 0; i < hedgeMinSamples; i++ {
+			h.latency.Update(10 * time.Millisecond)
+		}
+		So(h.delay(), ShouldEqual, 10*time.Millisecond)
+
+		h.Delay = time.Minute
+		So(h.delay(), ShouldEqual, time.Minute)
+	})
+
+	Convey("When a Hedger wraps a LeastRequestsPool, hedges are counted as outstanding requests to their member", t, func() {
+		one, _ := url.Parse("http://one:8080/")
+		two, _ := url.Parse("http://two:8080/")
+
+		var (
+			lr          *LeastRequestsPool
+			outstanding = make(chan int64, 10)
+		)
+		lr = NewLeastRequestsPool(nil, attemptHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Host == one.Host {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				return
+			}
+			n, _ := lr.Outstanding(two)
+			outstanding <- n
+			w.Write([]byte("two"))
+		})))
+		So(lr.UpsertServer(one), ShouldBeNil)
+		So(lr.UpsertServer(two), ShouldBeNil)
+
+		h := Hedger{Delay: 10 * time.Millisecond, pm: lr, latency: metrics.NewTimer(), fired: metrics.NewCounter(), won: metrics.NewCounter()}
+		for i := 0; i < 4; i++ {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			So(rr.Body.String(), ShouldEqual, "two")
+			So(<-outstanding, ShouldEqual, 1)
+		}
+		So(h.fired.Count(), ShouldBeGreaterThan, 0)
+
+		n, _ := lr.Outstanding(two)
+		So(n, ShouldEqual, 0)
+	})
+
+	Convey("When a Hedger needs an alternate member, it never chooses the primary", t, func() {
+		ch, err := NewConsistentHashPool("request", "remoteaddr", nil, http.NotFoundHandler())
+		So(err, ShouldBeNil)
+		h := Hedger{pm: ch}
+
+		one, _ := url.Parse("http://one:8080/")
+		two, _ := url.Parse("http://two:8080/")
+		So(ch.UpsertServer(one), ShouldBeNil)
+		So(h.alternate(one.String()), ShouldBeNil)
+
+		So(ch.UpsertServer(two), ShouldBeNil)
+		for i := 0; i < 10; i++ {
+			So(h.alternate(one.String()).String(), ShouldEqual, two.String())
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package jar
+
+import (
+	"github.com/vulcand/oxy/v2/roundrobin"
+
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// materializeLeastRequests extends Pool to be able to create LeastRequestsPools
+func (p *Pool) materializeLeastRequests(next http.Handler) (PoolManager, error) {
+	DebugOut.Printf("\t\tLeastRequests\n")
+	return NewLeastRequestsPool(p, next), nil
+}
+
+// lrMember is a LeastRequestsPool member, and its outstanding request count
+type lrMember struct {
+	url      *url.URL
+	weight   int
+	inflight int64
+}
+
+// load returns the number of outstanding requests
+func (m *lrMember) load() int64 {
+	return atomic.LoadInt64(&m.inflight)
+}
+
+// LeastRequestsPool is a PoolManager that sends each request to the member with the fewest
+// outstanding requests, relative to its weight
+type LeastRequestsPool struct {
+	lock    sync.Mutex
+	members []*lrMember
+	index   int
+	pool    *Pool
+	next    http.Handler
+}
+
+// NewLeastRequestsPool returns a primed LeastRequestsPool
+func NewLeastRequestsPool(pool *Pool, next http.Handler) *LeastRequestsPool {
+	return &LeastRequestsPool{
+		pool: pool,
+		next: next,
+	}
+}
+
+// Servers returns a list of member URLs
+func (lr *LeastRequestsPool) Servers() []*url.URL {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	sl := make([]*url.URL, len(lr.members))
+	for i, m := range lr.members {
+		sl[i] = m.url
+	}
+	return sl
+}
+
+// ServeHTTP handles its part of the request
+func (lr *LeastRequestsPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := lr.acquire()
+	if m == nil {
+		// frick, pool is probably empty
+		RequestErrorResponse(r, w, "Pool faulted, and likely is empty", http.StatusServiceUnavailable)
+		return
+	}
+	lr.serve(w, r, m)
+}
+
+// ServeMember sends the request to the specified member, counting it as outstanding like any other.
+// If the URL is not a member, the request is sent to it uncounted.
+func (lr *LeastRequestsPool) ServeMember(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	lr.lock.Lock()
+	m, _ := lr.find(u)
+	if m != nil {
+		atomic.AddInt64(&m.inflight, 1)
+	}
+	lr.lock.Unlock()
+
+	if m == nil {
+		// make shallow copy of request
+		newReq := *r
+		newReq.URL = CopyURL(u)
+		lr.next.ServeHTTP(w, &newReq)
+		return
+	}
+	lr.serve(w, r, m)
+}
+
+// serve sends the request to the acquired member, decrementing its outstanding count when the request is complete
+func (lr *LeastRequestsPool) serve(w http.ResponseWriter, r *http.Request, m *lrMember) {
+	var once sync.Once
+	release := func() {
+		once.Do(func() { atomic.AddInt64(&m.inflight, -1) })
+	}
+	defer release()
+
+	// make shallow copy of request
+	newReq := *r
+	newReq.URL = CopyURL(m.url)
+	if isWebSocketRequest(r) {
+		// Once upgraded, the WebSocketTracker counts it for as long as it is open, even if the member is re-added
+		newReq = *newReq.WithContext(context.WithValue(r.Context(), wsUpgradedKey, release))
+	}
+
+	lr.next.ServeHTTP(w, &newReq)
+}
+
+// ServerWeight returns the weight of the specified member, and true, or -1 and false if it is not a member
+func (lr *LeastRequestsPool) ServerWeight(u *url.URL) (int, bool) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	if m, _ := lr.find(u); m != nil {
+		return m.weight, true
+	}
+	return -1, false
+}
+
+// Outstanding returns the number of in-flight requests for the specified member, and true, or -1 and false if it is not a member
+func (lr *LeastRequestsPool) Outstanding(u *url.URL) (int64, bool) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	if m, _ := lr.find(u); m != nil {
+		return m.load(), true
+	}
+	return -1, false
+}
+
+// RemoveServer removes the specified member from the pool
+func (lr *LeastRequestsPool) RemoveServer(u *url.URL) error {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	m, i := lr.find(u)
+	if m == nil {
+		return ErrNoSuchMemberError
+	}
+	lr.members = append(lr.members[:i], lr.members[i+1:]...)
+	return nil
+}
+
+// UpsertServer adds or updates the member to the pool. If no options are provided, and there is a Pool
+// attached, the Member weight is used.
+func (lr *LeastRequestsPool) UpsertServer(u *url.URL, options ...roundrobin.ServerOption) error {
+	if len(options) == 0 && lr.pool != nil {
+		// We have a pool, so let it render a Member for us
+		options = append(options, lr.pool.GetMember(u).Weight)
+	}
+	weight := serverOptionsToWeight(options...)
+
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	if m, _ := lr.find(u); m != nil {
+		m.weight = weight
+		return nil
+	}
+	lr.members = append(lr.members, &lrMember{url: CopyURL(u), weight: weight})
+	return nil
+}
+
+// NextServer returns the URL of the member that would currently be chosen, without accounting for a request to it
+func (lr *LeastRequestsPool) NextServer() (*url.URL, error) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	m := lr.least()
+	if m == nil {
+		return nil, roundrobin.ErrNoServers
+	}
+	return CopyURL(m.url), nil
+}
+
+// Next returns the specified next Handler
+func (lr *LeastRequestsPool) Next() http.Handler {
+	return lr.next
+}
+
+// acquire chooses the least-loaded member, and increments its outstanding count before returning it.
+// The caller must decrement the count when the request is complete.
+func (lr *LeastRequestsPool) acquire() *lrMember {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	m := lr.least()
+	if m != nil {
+		atomic.AddInt64(&m.inflight, 1)
+	}
+	return m
+}
+
+// least returns the member with the lowest outstanding-to-weight ratio, or nil if there are no members.
+// Ties are broken by rotating the starting point. The caller must hold the lock.
+func (lr *LeastRequestsPool) least() *lrMember {
+	if len(lr.members) == 0 {
+		return nil
+	}
+
+	lr.index = (lr.index + 1) % len(lr.members)
+
+	var best *lrMember
+	for i := 0; i < len(lr.members); i++ {
+		m := lr.members[(lr.index+i)%len(lr.members)]
+		// m.load/m.weight < best.load/best.weight, sans division
+		if best == nil || lr.load(m)*int64(best.weight) < lr.load(best)*int64(m.weight) {
+			best = m
+		}
+	}
+	return best
+}
+
+// load returns the number of outstanding requests to the member, plus its open WebSockets
+func (lr *LeastRequestsPool) load(m *lrMember) int64 {
+	l := m.load()
+	if lr.pool != nil {
+		l += int64(lr.pool.websockets.Count(m.url))
+	}
+	return l
+}
+
+// find returns the member and its index, or nil and -1 if the URL is not a member. The caller must hold the lock.
+func (lr *LeastRequestsPool) find(u *url.URL) (*lrMember, int) {
+	for i, m := range lr.members {
+		if sameURL(u, m.url) {
+			return m, i
+		}
+	}
+	return nil, -1
+}
+
+// sameURL returns true if the two URLs refer to the same member
+func sameURL(a, b *url.URL) bool {
+	return a.Path == b.Path && a.Host == b.Host && a.Scheme == b.Scheme
+}
+
+// serverOptionsToWeight applies the provided roundrobin.ServerOptions to a scratch server,
+// and returns the resulting weight, as oxy doesn't otherwise expose it.
+func serverOptionsToWeight(options ...roundrobin.ServerOption) int {
+	var (
+		scratch, _ = roundrobin.New(nil)
+		u          = &url.URL{Scheme: "http", Host: "weight"}
+	)
+
+	if err := scratch.UpsertServer(u, options...); err != nil {
+		return 1
+	}
+	if w, ok := scratch.ServerWeight(u); ok && w > 0 {
+		return w
+	}
+	return 1
+}
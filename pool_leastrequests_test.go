@@ -0,0 +1,156 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vulcand/oxy/v2/roundrobin"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestPoolLeastRequestsBusyMember(t *testing.T) {
+
+	oneURL, _ := url.Parse("http://one:8080/")
+	twoURL, _ := url.Parse("http://two:8080/")
+
+	Convey("When a two-member LeastRequestsPool has a member with a stalled request, new requests go to the other member", t, func() {
+		var (
+			counts  = make(map[string]int)
+			clock   sync.Mutex
+			stall   = make(chan struct{})
+			stalled = make(chan struct{})
+		)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clock.Lock()
+			counts[r.URL.Host]++
+			clock.Unlock()
+			if r.RequestURI == "/stall" {
+				close(stalled)
+				<-stall
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		lb := NewLeastRequestsPool(nil, next)
+		So(lb.UpsertServer(oneURL), ShouldBeNil)
+		So(lb.UpsertServer(twoURL), ShouldBeNil)
+		So(len(lb.Servers()), ShouldEqual, 2)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stall", nil))
+		}()
+		<-stalled
+
+		var stalledHost string
+		clock.Lock()
+		for k := range counts {
+			stalledHost = k
+		}
+		clock.Unlock()
+
+		n, ok := lb.Outstanding(&url.URL{Scheme: "http", Host: stalledHost, Path: "/"})
+		So(ok, ShouldBeTrue)
+		So(n, ShouldEqual, 1)
+
+		for i := 0; i < 10; i++ {
+			rr := httptest.NewRecorder()
+			lb.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			So(rr.Code, ShouldEqual, http.StatusOK)
+		}
+
+		clock.Lock()
+		So(counts[stalledHost], ShouldEqual, 1)
+		So(counts["one:8080"]+counts["two:8080"], ShouldEqual, 11)
+		clock.Unlock()
+
+		close(stall)
+		<-done
+
+		n, _ = lb.Outstanding(oneURL)
+		So(n, ShouldEqual, 0)
+		n, _ = lb.Outstanding(twoURL)
+		So(n, ShouldEqual, 0)
+	})
+}
+
+func TestPoolLeastRequestsWeights(t *testing.T) {
+
+	oneURL, _ := url.Parse("http://one:8080/")
+	twoURL, _ := url.Parse("http://two:8080/")
+
+	Convey("When a two-member LeastRequestsPool has weighted members, weights are honored and updatable", t, func() {
+		lb := NewLeastRequestsPool(nil, http.NotFoundHandler())
+		So(lb.UpsertServer(oneURL, roundrobin.Weight(3)), ShouldBeNil)
+		So(lb.UpsertServer(twoURL), ShouldBeNil)
+
+		w, ok := lb.ServerWeight(oneURL)
+		So(ok, ShouldBeTrue)
+		So(w, ShouldEqual, 3)
+
+		w, ok = lb.ServerWeight(twoURL)
+		So(ok, ShouldBeTrue)
+		So(w, ShouldEqual, 1)
+
+		// Hold requests open, so we can see where they land
+		var held []*lrMember
+		for i := 0; i < 8; i++ {
+			held = append(held, lb.acquire())
+		}
+		n, _ := lb.Outstanding(oneURL)
+		So(n, ShouldEqual, 6)
+		n, _ = lb.Outstanding(twoURL)
+		So(n, ShouldEqual, 2)
+		So(len(held), ShouldEqual, 8)
+
+		So(lb.UpsertServer(oneURL, roundrobin.Weight(5)), ShouldBeNil)
+		w, _ = lb.ServerWeight(oneURL)
+		So(w, ShouldEqual, 5)
+		So(len(lb.Servers()), ShouldEqual, 2)
+	})
+
+	Convey("When a LeastRequestsPool has its members removed, requests fail appropriately", t, func() {
+		lb := NewLeastRequestsPool(nil, http.NotFoundHandler())
+		So(lb.UpsertServer(oneURL), ShouldBeNil)
+		So(lb.RemoveServer(oneURL), ShouldBeNil)
+		So(lb.RemoveServer(oneURL), ShouldEqual, ErrNoSuchMemberError)
+
+		_, err := lb.NextServer()
+		So(err, ShouldNotBeNil)
+
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusServiceUnavailable)
+	})
+}
+
+func TestPoolLeastRequestsMaterialize(t *testing.T) {
+
+	Convey("When a LeastRequests Pool is materialized, and a request is made, it is served", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer server.Close()
+
+		pool := NewPool(&PoolConfig{LeastRequests: true, Members: []string{server.URL}})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "OK")
+		So(len(pool.ListMembers()), ShouldEqual, 1)
+	})
+
+	Convey("When a LeastRequests Pool is also Sticky, materialization fails", t, func() {
+		pool := NewPool(&PoolConfig{LeastRequests: true, Sticky: true, Members: []string{"http://localhost/"}})
+		_, err := pool.GetPool()
+		So(err, ShouldEqual, ErrPoolConfigBalancersExclusive)
+	})
+}
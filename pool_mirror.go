@@ -0,0 +1,339 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ErrPoolConfigMirrorSelf is returned when a Pool has itself as its MirrorPool
+	ErrPoolConfigMirrorSelf = Error("a Pool cannot be its own MirrorPool")
+)
+
+// mirrorKey is a type for Mirror context keys
+type mirrorKey int
+
+const (
+	// mirrorShadowKey is the context key set on shadow requests, so they aren't mirrored again
+	mirrorShadowKey mirrorKey = iota
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsMirrorMaxBodySize] = 1024 * 1024
+	ConfigAdditions[ConfigPoolsMirrorTimeout] = 10 * time.Second
+}
+
+// Mirror is an http.Handler that wraps a materialized Pool, and after each sampled request has been served, sends a
+// copy of it to a shadow Pool via the Workers. Shadow responses are discarded, and only compared with the real ones:
+// the results are kept in metrics, and differences are logged to MirrorOut.
+type Mirror struct {
+	// Pool is the name of the shadow Pool, from LoadBalancers
+	Pool string
+	// Percent is the percentage of requests that are mirrored
+	Percent float64
+	// MaxBodySize is the largest request body that will be held so the request can be mirrored
+	MaxBodySize int64
+	// Timeout is how long each shadow request may take
+	Timeout time.Duration
+	// Methods are the request methods that are mirrored
+	Methods []string
+
+	name       string
+	next       http.Handler
+	mirrored   metrics.Counter
+	skipped    metrics.Counter
+	mismatches metrics.Counter
+	errors     metrics.Counter
+}
+
+// NewMirror returns a Mirror for the Pool, which is served by next. Its counters are registered with Metrics.
+func NewMirror(pool *Pool, next http.Handler) *Mirror {
+	m := Mirror{
+		Pool:        pool.Config.MirrorPool,
+		Percent:     pool.Config.MirrorPercent,
+		MaxBodySize: Conf.GetInt64(ConfigPoolsMirrorMaxBodySize),
+		Timeout:     Conf.GetDuration(ConfigPoolsMirrorTimeout),
+		Methods:     []string{http.MethodGet, http.MethodHead},
+		name:        pool.Config.Name,
+		next:        next,
+		mirrored:    metrics.GetOrRegisterCounter(fmt.Sprintf("%s_Mirrored", pool.Config.Name), Metrics),
+		skipped:     metrics.GetOrRegisterCounter(fmt.Sprintf("%s_MirrorSkipped", pool.Config.Name), Metrics),
+		mismatches:  metrics.GetOrRegisterCounter(fmt.Sprintf("%s_MirrorMismatches", pool.Config.Name), Metrics),
+		errors:      metrics.GetOrRegisterCounter(fmt.Sprintf("%s_MirrorErrors", pool.Config.Name), Metrics),
+	}
+
+	if m.Percent <= 0 {
+		m.Percent = 100
+	}
+	if pool.Config.MirrorMaxBodySize > 0 {
+		m.MaxBodySize = pool.Config.MirrorMaxBodySize
+	}
+	if len(pool.Config.MirrorMethods) > 0 {
+		m.Methods = pool.Config.MirrorMethods
+	}
+	return &m
+}
+
+// String returns a summary of the Mirror
+func (m *Mirror) String() string {
+	return fmt.Sprintf("%.1f%% of %s to %s, bodies up to %d bytes, timeout %s", m.Percent, strings.Join(m.Methods, ","), m.Pool, m.MaxBodySize, m.Timeout)
+}
+
+// ServeHTTP handles its part of the request
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Value(mirrorShadowKey) != nil || r.Header.Get("Upgrade") != "" || isGRPCRequest(r) || !m.mirrors(r.Method) ||
+		(m.Percent < 100 && rand.Float64()*100 >= m.Percent) {
+		// Not for us
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.MaxBodySize+1))
+		if err != nil {
+			RequestErrorResponse(r, w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > m.MaxBodySize {
+			// Too big to hold onto, so stitch it back together and don't mirror it
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			m.skipped.Inc(1)
+			m.next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// Copy the request before anything downstream has a chance to change it
+	shadow := r.Clone(context.WithValue(context.Background(), mirrorShadowKey, true))
+	shadow.Body = http.NoBody
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	var requestID string
+	if rid, ok := r.Context().Value(requestIDKey).(string); ok {
+		requestID = rid
+	}
+
+	mw := &mirrorWriter{ResponseWriter: w, tally: newMirrorTally()}
+	start := time.Now()
+	m.next.ServeHTTP(mw, r)
+
+	if AddWork == nil {
+		return
+	}
+	m.mirrored.Inc(1)
+	AddWork(&MirrorWork{
+		Mirror:    m,
+		Request:   shadow,
+		RequestID: requestID,
+		code:      mw.tally.Code(),
+		length:    mw.tally.length,
+		sum:       mw.tally.hash.Sum64(),
+		duration:  time.Since(start),
+	})
+}
+
+// mirrors returns true if requests with the method are mirrored
+func (m *Mirror) mirrors(method string) bool {
+	for _, mm := range m.Methods {
+		if strings.EqualFold(mm, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorWork is Work to send a shadow request to a Mirror's Pool, and compare its response with the real one
+type MirrorWork struct {
+	Mirror    *Mirror
+	Request   *http.Request
+	RequestID string
+
+	// The real response
+	code     int
+	length   int64
+	sum      uint64
+	duration time.Duration
+}
+
+// MirrorDiff is logged to MirrorOut when a shadow response differs from the real one
+type MirrorDiff struct {
+	Pool           string `json:"pool"`
+	MirrorPool     string `json:"mirrorpool"`
+	Method         string `json:"method"`
+	Request        string `json:"request"`
+	RequestID      string `json:"requestid"`
+	Status         int    `json:"status"`
+	MirrorStatus   int    `json:"mirrorstatus"`
+	Bytes          int64  `json:"bytes"`
+	MirrorBytes    int64  `json:"mirrorbytes"`
+	BodyMatch      bool   `json:"bodymatch"`
+	Duration       string `json:"duration"`
+	MirrorDuration string `json:"mirrorduration"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Work sends the shadow request, returning a *MirrorDiff if the response differs, or nil
+func (mw *MirrorWork) Work() interface{} {
+	m := mw.Mirror
+	diff := MirrorDiff{
+		Pool:       m.name,
+		MirrorPool: m.Pool,
+		Method:     mw.Request.Method,
+		Request:    mw.Request.URL.RequestURI(),
+		RequestID:  mw.RequestID,
+		Status:     mw.code,
+		Bytes:      mw.length,
+		Duration:   mw.duration.String(),
+	}
+
+	var pool *Pool
+	if LoadBalancers != nil {
+		pool, _ = LoadBalancers.Get(m.Pool)
+	}
+	if pool == nil {
+		diff.Error = "no such Pool"
+		return &diff
+	}
+	h, err := pool.GetPool()
+	if err != nil {
+		diff.Error = err.Error()
+		return &diff
+	}
+
+	ctx, cancel := context.WithTimeout(mw.Request.Context(), m.Timeout)
+	defer cancel()
+
+	rec := &mirrorRecorder{header: make(http.Header), tally: newMirrorTally()}
+	start := time.Now()
+	h.ServeHTTP(rec, mw.Request.WithContext(ctx))
+	diff.MirrorDuration = time.Since(start).String()
+	diff.MirrorStatus = rec.tally.Code()
+	diff.MirrorBytes = rec.tally.length
+	diff.BodyMatch = rec.tally.length == mw.length && rec.tally.hash.Sum64() == mw.sum
+
+	if diff.MirrorStatus == diff.Status && diff.BodyMatch {
+		return nil
+	}
+	return &diff
+}
+
+// Return counts and logs differences
+func (mw *MirrorWork) Return(rthing interface{}) {
+	switch d := rthing.(type) {
+	case *MirrorDiff:
+		if d.Error != "" {
+			mw.Mirror.errors.Inc(1)
+		} else {
+			mw.Mirror.mismatches.Inc(1)
+		}
+		if b, err := json.Marshal(d); err == nil {
+			MirrorOut.Println(string(b))
+		}
+	case nil:
+	default:
+		// WorkError, et al
+		mw.Mirror.errors.Inc(1)
+		ErrorOut.Printf("Mirror %s to %s failed: %v\n", mw.Mirror.name, mw.Mirror.Pool, d)
+	}
+}
+
+// mirrorTally keeps the status, length, and a hash of a response
+type mirrorTally struct {
+	code   int
+	length int64
+	hash   hash.Hash64
+}
+
+// newMirrorTally returns an initialized mirrorTally
+func newMirrorTally() *mirrorTally {
+	return &mirrorTally{hash: fnv.New64a()}
+}
+
+// Code returns the response code, which is 200 if nothing was said
+func (t *mirrorTally) Code() int {
+	if t.code == 0 {
+		return http.StatusOK
+	}
+	return t.code
+}
+
+// WriteHeader notes the first final response code
+func (t *mirrorTally) WriteHeader(code int) {
+	if t.code == 0 && code >= http.StatusOK {
+		t.code = code
+	}
+}
+
+// Write counts and hashes the body
+func (t *mirrorTally) Write(b []byte) {
+	t.length += int64(len(b))
+	t.hash.Write(b)
+}
+
+// mirrorWriter is an http.ResponseWriter that tallies the real response as it is written
+type mirrorWriter struct {
+	http.ResponseWriter
+	tally *mirrorTally
+}
+
+// WriteHeader notes the code, and writes it
+func (w *mirrorWriter) WriteHeader(code int) {
+	w.tally.WriteHeader(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write tallies the body, and writes it
+func (w *mirrorWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.tally.Write(b[:n])
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter, if it can
+func (w *mirrorWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (w *mirrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// mirrorRecorder is an http.ResponseWriter that tallies the shadow response, and discards it
+type mirrorRecorder struct {
+	header http.Header
+	tally  *mirrorTally
+}
+
+// Header returns the header map
+func (w *mirrorRecorder) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader notes the code
+func (w *mirrorRecorder) WriteHeader(code int) {
+	w.tally.WriteHeader(code)
+}
+
+// Write tallies the body
+func (w *mirrorRecorder) Write(b []byte) (int, error) {
+	w.tally.Write(b)
+	return len(b), nil
+}
@@ -0,0 +1,175 @@
+package jar
+
+import (
+	"github.com/cognusion/go-jar/workers"
+	"github.com/rcrowley/go-metrics"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolMirror(t *testing.T) {
+
+	var (
+		lock    sync.Mutex
+		shadows []string
+	)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("hello " + string(body)))
+	}))
+	defer primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		shadows = append(shadows, r.Method+" "+r.URL.RequestURI()+" "+string(body)+" "+r.Header.Get("X-Test"))
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(300 * time.Millisecond)
+		case "/differ":
+			w.WriteHeader(http.StatusTeapot)
+		}
+		w.Write([]byte("hello " + string(body)))
+	}))
+	defer shadow.Close()
+
+	seen := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), shadows...)
+	}
+
+	var work sync.WaitGroup
+	oldLB, oldAW, oldMO := LoadBalancers, AddWork, MirrorOut
+	defer func() {
+		work.Wait()
+		LoadBalancers, AddWork, MirrorOut = oldLB, oldAW, oldMO
+	}()
+	AddWork = func(w workers.Work) {
+		work.Add(1)
+		go func() {
+			defer work.Done()
+			w.Return(w.Work())
+		}()
+	}
+	var diffs *lockedBuffer
+
+	var err error
+	LoadBalancers, err = NewPools(map[string]*PoolConfig{
+		"mirrortest":        {Name: "mirrortest", Members: []string{primary.URL}, MirrorPool: "mirrorshadow", MirrorMaxBodySize: 16, MirrorMethods: []string{"GET", "post"}},
+		"mirrormethodtest":  {Name: "mirrormethodtest", Members: []string{primary.URL}, MirrorPool: "mirrorshadow"},
+		"mirrorsampletest":  {Name: "mirrorsampletest", Members: []string{primary.URL}, MirrorPool: "mirrorshadow", MirrorPercent: 50},
+		"mirrormissingtest": {Name: "mirrormissingtest", Members: []string{primary.URL}, MirrorPool: "nosuchpool"},
+		"mirrorselftest":    {Name: "mirrorselftest", Members: []string{primary.URL}, MirrorPool: "mirrorselftest"},
+		"mirrorshadow":      {Name: "mirrorshadow", Members: []string{shadow.URL}},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(name, method, target, body string) *httptest.ResponseRecorder {
+		pool, _ := LoadBalancers.Get(name)
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Test", "yes")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	counter := func(name string) int64 {
+		return metrics.GetOrRegisterCounter(name, Metrics).Count()
+	}
+
+	Convey("When a Pool has a MirrorPool, requests are copied to it, and the shadow responses are discarded", t, func() {
+		lock.Lock()
+		shadows = nil
+		lock.Unlock()
+		diffs = &lockedBuffer{}
+		MirrorOut = log.New(diffs, "", 0)
+		mirrored, mismatches, skipped := counter("mirrortest_Mirrored"), counter("mirrortest_MirrorMismatches"), counter("mirrortest_MirrorSkipped")
+
+		rr := serve("mirrortest", "POST", "/same?q=1", "world")
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "hello world")
+		So(waitFor(time.Second, func() bool { return len(seen()) == 1 }), ShouldBeTrue)
+		So(seen()[0], ShouldEqual, "POST /same?q=1 world yes")
+		So(counter("mirrortest_Mirrored"), ShouldEqual, mirrored+1)
+		time.Sleep(20 * time.Millisecond)
+		So(diffs.String(), ShouldBeEmpty)
+
+		Convey("... and when they differ, the difference is counted and logged", func() {
+			rr := serve("mirrortest", "GET", "/differ", "")
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(waitFor(time.Second, func() bool { return diffs.String() != "" }), ShouldBeTrue)
+			So(counter("mirrortest_MirrorMismatches"), ShouldEqual, mismatches+1)
+
+			var d MirrorDiff
+			So(json.Unmarshal([]byte(diffs.String()), &d), ShouldBeNil)
+			So(d.Pool, ShouldEqual, "mirrortest")
+			So(d.MirrorPool, ShouldEqual, "mirrorshadow")
+			So(d.Request, ShouldEqual, "/differ")
+			So(d.Status, ShouldEqual, http.StatusOK)
+			So(d.MirrorStatus, ShouldEqual, http.StatusTeapot)
+			So(d.BodyMatch, ShouldBeTrue)
+		})
+
+		Convey("... and slow shadows don't slow the client down", func() {
+			start := time.Now()
+			So(serve("mirrortest", "GET", "/slow", "").Code, ShouldEqual, http.StatusOK)
+			So(time.Since(start), ShouldBeLessThan, 200*time.Millisecond)
+			So(waitFor(time.Second, func() bool { return len(seen()) == 2 }), ShouldBeTrue)
+		})
+
+		Convey("... but requests with large bodies are not copied", func() {
+			rr := serve("mirrortest", "POST", "/big", strings.Repeat("x", 17))
+			So(rr.Body.String(), ShouldEqual, "hello "+strings.Repeat("x", 17))
+			So(counter("mirrortest_MirrorSkipped"), ShouldEqual, skipped+1)
+			time.Sleep(50 * time.Millisecond)
+			So(seen(), ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("When a Pool has a MirrorPool, but no MirrorMethods, only GET and HEAD requests are copied", t, func() {
+		lock.Lock()
+		shadows = nil
+		lock.Unlock()
+
+		So(serve("mirrormethodtest", "POST", "/order", "one").Body.String(), ShouldEqual, "hello one")
+		So(serve("mirrormethodtest", "DELETE", "/order", "").Code, ShouldEqual, http.StatusOK)
+		So(serve("mirrormethodtest", "GET", "/order", "").Code, ShouldEqual, http.StatusOK)
+		So(waitFor(time.Second, func() bool { return len(seen()) == 1 }), ShouldBeTrue)
+		time.Sleep(50 * time.Millisecond)
+		So(seen(), ShouldResemble, []string{"GET /order  yes"})
+		So(counter("mirrormethodtest_Mirrored"), ShouldEqual, 1)
+	})
+
+	Convey("When a Pool has a MirrorPercent, only that many requests are copied", t, func() {
+		for range 200 {
+			serve("mirrorsampletest", "GET", "/", "")
+		}
+		So(counter("mirrorsampletest_Mirrored"), ShouldBeBetween, 50, 150)
+	})
+
+	Convey("When a Pool's MirrorPool doesn't exist, the errors are counted, and the client doesn't notice", t, func() {
+		So(serve("mirrormissingtest", "GET", "/", "").Body.String(), ShouldEqual, "hello ")
+		So(waitFor(time.Second, func() bool { return counter("mirrormissingtest_MirrorErrors") == 1 }), ShouldBeTrue)
+	})
+
+	Convey("When a Pool is its own MirrorPool, it doesn't materialize", t, func() {
+		pool, _ := LoadBalancers.Get("mirrorselftest")
+		_, err := pool.GetPool()
+		So(err, ShouldEqual, ErrPoolConfigMirrorSelf)
+	})
+}
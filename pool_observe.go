@@ -0,0 +1,127 @@
+package jar
+
+import (
+	"github.com/vulcand/oxy/v2/utils"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	memberObservationKey poolObserveKey = iota
+	poolAttemptKey
+)
+
+type poolObserveKey int
+
+// MemberObserver is a function that is told the outcome of every proxied request to a Pool member:
+// the member, the response code (0 if there was no response), how long the member took to respond, and
+// the error (if any) encountered while proxying
+type MemberObserver func(member *url.URL, code int, latency time.Duration, err error)
+
+// memberObservation is stashed in the request context so the outcome can be attributed to the member
+type memberObservation struct {
+	member   *url.URL
+	start    time.Time
+	observed bool
+}
+
+// poolAttempt is stashed in the request context by things that wrap a PoolManager (e.g. RetryPolicy), so
+// that attemptHandler can tell them which member was chosen
+type poolAttempt struct {
+	lock   sync.Mutex
+	member string
+}
+
+// SetMember notes the chosen member
+func (a *poolAttempt) SetMember(member string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.member = member
+}
+
+// Member returns the chosen member, or an empty string if none has been chosen yet
+func (a *poolAttempt) Member() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.member
+}
+
+// AddObserver adds a MemberObserver to the Pool. Observers must be added before the Pool is materialized.
+func (p *Pool) AddObserver(o MemberObserver) {
+	p.observers = append(p.observers, o)
+}
+
+// observeHandler is an unchainable handler that must be placed after the PoolManager has chosen a member,
+// so that the outcome of the request may be attributed to the chosen member. If the Pool has no observers,
+// next is returned as-is.
+func (p *Pool) observeHandler(next http.Handler) http.Handler {
+	if len(p.observers) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mo := memberObservation{
+			member: CopyURL(r.URL),
+			start:  time.Now(),
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), memberObservationKey, &mo)))
+	})
+}
+
+// observeResponse is a ProxyResponseModifier that tells the observers about a response
+func (p *Pool) observeResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	if mo, ok := resp.Request.Context().Value(memberObservationKey).(*memberObservation); ok {
+		p.observe(mo, resp.StatusCode, nil)
+	}
+	return nil
+}
+
+// observeError returns a proxy ErrorHandler that tells the observers about an error, unless the request was
+// cancelled, and then hands off to next, or the default ErrorHandler if next is nil
+func (p *Pool) observeError(next func(http.ResponseWriter, *http.Request, error)) func(http.ResponseWriter, *http.Request, error) {
+	if next == nil {
+		next = utils.DefaultHandler.ServeHTTP
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, context.Canceled) {
+			// Not the member's fault (e.g. the client left, or a hedge won)
+		} else if mo, ok := r.Context().Value(memberObservationKey).(*memberObservation); ok {
+			p.observe(mo, 0, err)
+		}
+		next(w, r, err)
+	}
+}
+
+// observe calls each observer, once per request
+func (p *Pool) observe(mo *memberObservation, code int, err error) {
+	if mo.observed {
+		// e.g. a ResponseModifier errored after the response was observed
+		return
+	}
+	mo.observed = true
+
+	latency := time.Since(mo.start)
+	for _, o := range p.observers {
+		o(mo.member, code, latency, err)
+	}
+}
+
+// attemptHandler is an unchainable handler that must be placed after the PoolManager has chosen a member,
+// noting the chosen member in the poolAttempt, if there is one
+func attemptHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a, ok := r.Context().Value(poolAttemptKey).(*poolAttempt); ok {
+			a.SetMember(r.URL.String())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,224 @@
+package jar
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultOutlierConsecutiveFailures] = 5
+	ConfigAdditions[ConfigPoolsDefaultOutlierEjectionTime] = 30 * time.Second
+	ConfigAdditions[ConfigPoolsDefaultOutlierMaxEjectionPercent] = 50
+	ConfigAdditions[ConfigPoolsOutlierMaxEjectionTime] = 5 * time.Minute
+	ConfigAdditions[ConfigPoolsOutlierWindow] = 10 * time.Second
+	ConfigAdditions[ConfigPoolsOutlierMinRequests] = 10
+}
+
+// outlierMember is the failure accounting for a single Pool member
+type outlierMember struct {
+	lock        sync.Mutex
+	member      *url.URL
+	consecutive int
+	windowStart time.Time
+	total       int
+	failures    int
+	ejected     bool
+	ejections   int
+	returned    time.Time
+}
+
+// reset zeroes the failure counts. The caller must hold the lock.
+func (m *outlierMember) reset() {
+	m.consecutive = 0
+	m.total = 0
+	m.failures = 0
+	m.windowStart = time.Now()
+}
+
+// OutlierDetector is a MemberObserver factory that passively healthchecks the members of a Pool using live
+// traffic, ejecting members that fail too often, and returning them after a period that backs off
+// exponentially with each subsequent ejection
+type OutlierDetector struct {
+	// ConsecutiveFailures is the number of consecutive failures that will eject a member. Zero disables.
+	ConsecutiveFailures int
+	// FailureRate is the ratio (0.0-1.0) of failed requests within a Window that will eject a member. Zero disables.
+	FailureRate float64
+	// EjectionTime is how long a member is ejected the first time
+	EjectionTime time.Duration
+	// MaxEjectionTime caps the backoff. A member that stays in the Pool this long has its backoff reset.
+	MaxEjectionTime time.Duration
+	// MaxEjectionPercent is the maximum percentage of members that may be ejected at the same time
+	MaxEjectionPercent int
+	// Window is how long requests are counted for FailureRate before the counts are reset
+	Window time.Duration
+	// MinRequests is the number of requests that must be counted in a Window before FailureRate is considered
+	MinRequests int
+
+	pool    *Pool
+	members sync.Map // string -> *outlierMember
+	lock    sync.Mutex
+	ejected int
+}
+
+// NewOutlierDetector returns an OutlierDetector for the specified Pool, configured from the PoolConfig
+// and global defaults
+func NewOutlierDetector(pool *Pool) *OutlierDetector {
+	od := OutlierDetector{
+		ConsecutiveFailures: Conf.GetInt(ConfigPoolsDefaultOutlierConsecutiveFailures),
+		EjectionTime:        Conf.GetDuration(ConfigPoolsDefaultOutlierEjectionTime),
+		MaxEjectionTime:     Conf.GetDuration(ConfigPoolsOutlierMaxEjectionTime),
+		MaxEjectionPercent:  Conf.GetInt(ConfigPoolsDefaultOutlierMaxEjectionPercent),
+		Window:              Conf.GetDuration(ConfigPoolsOutlierWindow),
+		MinRequests:         Conf.GetInt(ConfigPoolsOutlierMinRequests),
+		pool:                pool,
+	}
+
+	if pool.Config.OutlierConsecutiveFailures > 0 {
+		od.ConsecutiveFailures = pool.Config.OutlierConsecutiveFailures
+	}
+	if pool.Config.OutlierEjectionTime > 0 {
+		od.EjectionTime = pool.Config.OutlierEjectionTime
+	}
+	if pool.Config.OutlierMaxEjectionPercent > 0 {
+		od.MaxEjectionPercent = pool.Config.OutlierMaxEjectionPercent
+	}
+	od.FailureRate = pool.Config.OutlierFailureRate
+
+	return &od
+}
+
+// Observe is a MemberObserver that counts the outcome against the member, ejecting it if warranted.
+// Connection errors, timeouts, and 502, 503, and 504 responses are failures.
+func (od *OutlierDetector) Observe(member *url.URL, code int, latency time.Duration, err error) {
+	failed := err != nil || code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+
+	v, _ := od.members.LoadOrStore(member.String(), &outlierMember{member: CopyURL(member), windowStart: time.Now()})
+	m := v.(*outlierMember)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.ejected {
+		// Stragglers that were in-flight when the member was ejected
+		return
+	}
+
+	if time.Since(m.windowStart) > od.Window {
+		m.total = 0
+		m.failures = 0
+		m.windowStart = time.Now()
+	}
+	m.total++
+	if !failed {
+		m.consecutive = 0
+		return
+	}
+	m.failures++
+	m.consecutive++
+
+	var reason string
+	if od.ConsecutiveFailures > 0 && m.consecutive >= od.ConsecutiveFailures {
+		reason = fmt.Sprintf("%d consecutive failures", m.consecutive)
+	} else if od.FailureRate > 0 && m.total >= od.MinRequests && float64(m.failures)/float64(m.total) >= od.FailureRate {
+		reason = fmt.Sprintf("%d of %d requests failed", m.failures, m.total)
+	} else {
+		return
+	}
+
+	od.eject(m, reason)
+}
+
+// Ejected returns true if the member is currently ejected
+func (od *OutlierDetector) Ejected(member *url.URL) bool {
+	v, ok := od.members.Load(member.String())
+	if !ok {
+		return false
+	}
+	m := v.(*outlierMember)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.ejected
+}
+
+// eject removes the member from the Pool, unless doing so would exceed MaxEjectionPercent or empty the Pool.
+// The caller must hold the member's lock.
+func (od *OutlierDetector) eject(m *outlierMember, reason string) {
+	od.lock.Lock()
+	ejected := od.ejected
+	total := len(od.pool.ListMembers()) + ejected
+	if ejected+1 >= total || float64(ejected+1)*100/float64(total) > float64(od.MaxEjectionPercent) {
+		od.lock.Unlock()
+		// Start over, so we don't re-evaluate on every subsequent request
+		m.reset()
+		DebugOut.Printf("Outlier %s: not ejecting %s (%s), as %d of %d members are already ejected\n", od.pool.Config.Name, m.member.String(), reason, ejected, total)
+		return
+	}
+	od.ejected++
+	od.lock.Unlock()
+
+	if !m.returned.IsZero() && time.Since(m.returned) > od.MaxEjectionTime {
+		// Been good for long enough, forgive past sins
+		m.ejections = 0
+	}
+	m.ejections++
+	m.ejected = true
+
+	d := od.EjectionTime
+	for i := 1; i < m.ejections && d < od.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > od.MaxEjectionTime {
+		d = od.MaxEjectionTime
+	}
+
+	msg := fmt.Sprintf("Ejected for %s: %s", d.String(), reason)
+	ErrorOut.Printf("Outlier %s: %s %s\n", od.pool.Config.Name, m.member.String(), msg)
+	Status.Add(od.statusName(m.member), "WARNING", msg, nil)
+
+	if rerr := od.pool.ejectMember(m.member.String(), ejectorOutlier); rerr != nil {
+		ErrorOut.Printf("Outlier %s: error removing %s: %s\n", od.pool.Config.Name, m.member.String(), rerr)
+	}
+	time.AfterFunc(d, func() { od.restore(m) })
+}
+
+// restore returns the member to the Pool, unless the member has since been deleted from the Pool, or is still
+// ejected by the healthchecks or CircuitBreakers, which will return it instead
+func (od *OutlierDetector) restore(m *outlierMember) {
+	od.lock.Lock()
+	od.ejected--
+	od.lock.Unlock()
+
+	if _, ok := od.pool.members.Load(*m.member); !ok {
+		// Deleted while we were ejected, so we forget about it
+		od.members.Delete(m.member.String())
+		Status.Remove(od.statusName(m.member))
+		DebugOut.Printf("Outlier %s: %s was deleted while ejected, forgetting it\n", od.pool.Config.Name, m.member.String())
+		return
+	}
+
+	m.lock.Lock()
+	m.ejected = false
+	m.returned = time.Now()
+	m.reset()
+	m.lock.Unlock()
+
+	Status.Add(od.statusName(m.member), "OK", nil, nil)
+
+	others := od.pool.ejectors(m.member.String(), ejectorOutlier)
+	if returned, aerr := od.pool.returnMember(m.member.String(), ejectorOutlier); aerr != nil {
+		ErrorOut.Printf("Outlier %s: error re-adding %s: %s\n", od.pool.Config.Name, m.member.String(), aerr)
+	} else if returned {
+		ErrorOut.Printf("Outlier %s: %s returned\n", od.pool.Config.Name, m.member.String())
+	} else {
+		ErrorOut.Printf("Outlier %s: %s ejection elapsed, but it is still ejected by %s\n", od.pool.Config.Name, m.member.String(), strings.Join(others, ", "))
+	}
+}
+
+// statusName returns the Status name for the member's ejection state
+func (od *OutlierDetector) statusName(u *url.URL) string {
+	return fmt.Sprintf("%s_%s_Outlier", od.pool.Config.Name, u.String())
+}
@@ -0,0 +1,180 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPoolOutlierDetection(t *testing.T) {
+
+	Convey("When an OutlierDetection Pool has a member that fails, it is ejected and returned", t, func() {
+		good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer good.Close()
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer bad.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:                       "outliertest",
+			Members:                    []string{good.URL, bad.URL},
+			OutlierDetection:           true,
+			OutlierConsecutiveFailures: 3,
+			OutlierEjectionTime:        100 * time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		var fails int
+		for i := 0; i < 20; i++ {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			if rr.Code != http.StatusOK {
+				fails++
+			}
+		}
+		So(fails, ShouldEqual, 3)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+
+		s, err := Status.Get("outliertest_" + bad.URL + "_Outlier")
+		So(err, ShouldBeNil)
+		So(s.Status, ShouldEqual, "WARNING")
+
+		So(waitFor(time.Second, func() bool { return len(pool.ListMembers()) == 2 }), ShouldBeTrue)
+		s, _ = Status.Get("outliertest_" + bad.URL + "_Outlier")
+		So(s.Status, ShouldEqual, "OK")
+	})
+
+	Convey("When an OutlierDetection Pool has all of its members failing, it is never emptied", t, func() {
+		bad := func() *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			}))
+		}
+		one, two := bad(), bad()
+		defer one.Close()
+		defer two.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:                       "outlieremptytest",
+			Members:                    []string{one.URL, two.URL},
+			OutlierDetection:           true,
+			OutlierConsecutiveFailures: 2,
+			OutlierEjectionTime:        time.Minute,
+			OutlierMaxEjectionPercent:  100,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 20; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+	})
+
+	Convey("When an ejected member is pruned by the healthchecks, it isn't returned until they return it", t, func() {
+		good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer good.Close()
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer bad.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:                       "outlierhealthtest",
+			Members:                    []string{good.URL, bad.URL},
+			OutlierDetection:           true,
+			OutlierConsecutiveFailures: 3,
+			OutlierEjectionTime:        50 * time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 20; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+		So(pool.healthCheckRemove(bad.URL), ShouldEqual, ErrNoSuchMemberError)
+
+		time.Sleep(150 * time.Millisecond)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+
+		So(pool.healthCheckAdd(bad.URL), ShouldBeNil)
+		So(pool.ListMembers(), ShouldHaveLength, 2)
+	})
+}
+
+func TestPoolOutlierBackoff(t *testing.T) {
+
+	Convey("When a member is repeatedly ejected, its ejection time backs off exponentially, and respects MaxEjectionPercent", t, func() {
+		var (
+			removed = make(chan string, 10)
+			added   = make(chan string, 10)
+			members []*url.URL
+		)
+
+		pool := &Pool{Config: &PoolConfig{Name: "outlierbackofftest"}}
+		pool.ListMembers = func() []*url.URL { return members }
+		pool.RemoveMember = func(m string) error {
+			removed <- m
+			return nil
+		}
+		pool.AddMember = func(m string) error {
+			added <- m
+			return nil
+		}
+		for _, m := range []string{"http://one/", "http://two/", "http://three/", "http://four/"} {
+			u, _ := url.Parse(m)
+			members = append(members, pool.GetMember(u).URL)
+		}
+
+		od := OutlierDetector{
+			ConsecutiveFailures: 1,
+			EjectionTime:        20 * time.Millisecond,
+			MaxEjectionTime:     time.Minute,
+			MaxEjectionPercent:  25,
+			Window:              time.Minute,
+			pool:                pool,
+		}
+
+		oops := errors.New("connection refused")
+
+		// First ejection
+		start := time.Now()
+		od.Observe(members[0], 0, 0, oops)
+		So(<-removed, ShouldEqual, "http://one/")
+		So(od.Ejected(members[0]), ShouldBeTrue)
+
+		// Another member is not ejected, as 25% are already out
+		od.Observe(members[1], 0, 0, oops)
+		So(od.Ejected(members[1]), ShouldBeFalse)
+		So(removed, ShouldHaveLength, 0)
+
+		So(<-added, ShouldEqual, "http://one/")
+		first := time.Since(start)
+		So(od.Ejected(members[0]), ShouldBeFalse)
+
+		// Second ejection is twice as long
+		start = time.Now()
+		od.Observe(members[0], http.StatusGatewayTimeout, 0, nil)
+		So(<-removed, ShouldEqual, "http://one/")
+		So(<-added, ShouldEqual, "http://one/")
+		second := time.Since(start)
+		So(second, ShouldBeGreaterThanOrEqualTo, 40*time.Millisecond)
+		So(second, ShouldBeGreaterThan, first)
+
+		// 500s are not outliers
+		od.Observe(members[0], http.StatusInternalServerError, 0, nil)
+		So(od.Ejected(members[0]), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,313 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"github.com/vulcand/oxy/v2/roundrobin"
+
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Constants for configuration key strings
+const (
+	ConfigPeakEWMADecay = ConfigKey("peakewma.decay")
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultPeakEWMADecay] = 10 * time.Second
+}
+
+// materializePeakEWMA extends Pool to be able to create PeakEWMAPools
+func (p *Pool) materializePeakEWMA(next http.Handler) (PoolManager, error) {
+	decay := Conf.GetDuration(ConfigPoolsDefaultPeakEWMADecay)
+
+	// Allow overrides via PoolOptions :(
+	if v, err := p.Config.Options.GetDuration(ConfigPeakEWMADecay); err != nil {
+		return nil, err
+	} else if v > 0 {
+		decay = v
+	}
+
+	DebugOut.Printf("\t\tPeakEWMA with decay of %s\n", decay.String())
+	return NewPeakEWMAPool(decay, p, next), nil
+}
+
+// ewmaMember is a PeakEWMAPool member, its outstanding request count, and its latency average
+type ewmaMember struct {
+	lrMember
+
+	lock  sync.Mutex
+	ewma  float64 // nanoseconds
+	stamp time.Time
+	gauge metrics.GaugeFloat64
+}
+
+// observe folds the provided latency into the average. Latencies above the average replace
+// it outright (the "peak"), while lower ones decay it towards them over time.
+func (m *ewmaMember) observe(rtt time.Duration, decay time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var (
+		now  = time.Now()
+		nrtt = float64(rtt)
+	)
+
+	if nrtt > m.ewma || m.stamp.IsZero() {
+		m.ewma = nrtt
+	} else {
+		w := math.Exp(-float64(now.Sub(m.stamp)) / float64(decay))
+		m.ewma = m.ewma*w + nrtt*(1-w)
+	}
+	m.stamp = now
+
+	if m.gauge != nil {
+		// milliseconds are easier on the eyes
+		m.gauge.Update(m.ewma / float64(time.Millisecond))
+	}
+}
+
+// average returns the current latency average
+func (m *ewmaMember) average() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return time.Duration(m.ewma)
+}
+
+// cost returns the latency average, scaled by the outstanding requests and weight. A member without an average
+// yet, e.g. a new or re-added one, is charged the penalty instead once it has outstanding requests, so it isn't
+// free to choose until its first response comes back.
+func (m *ewmaMember) cost(penalty float64) float64 {
+	m.lock.Lock()
+	ewma := m.ewma
+	m.lock.Unlock()
+
+	load := m.load()
+	if ewma == 0 && load > 0 {
+		ewma = penalty
+	}
+	return ewma * float64(load+1) / float64(m.weight)
+}
+
+// PeakEWMAPool is a PoolManager that keeps a peak-sensitive exponentially-weighted moving average
+// of each member's latency, and sends each request to the better of two randomly-chosen members
+type PeakEWMAPool struct {
+	lock    sync.RWMutex
+	members []*ewmaMember
+	decay   time.Duration
+	pool    *Pool
+	next    http.Handler
+}
+
+// NewPeakEWMAPool returns a primed PeakEWMAPool. The decay is how long it takes a latency
+// spike to mostly wash out of the average
+func NewPeakEWMAPool(decay time.Duration, pool *Pool, next http.Handler) *PeakEWMAPool {
+	if decay <= 0 {
+		decay = 10 * time.Second
+	}
+	return &PeakEWMAPool{
+		decay: decay,
+		pool:  pool,
+		next:  next,
+	}
+}
+
+// Servers returns a list of member URLs
+func (pe *PeakEWMAPool) Servers() []*url.URL {
+	pe.lock.RLock()
+	defer pe.lock.RUnlock()
+
+	sl := make([]*url.URL, len(pe.members))
+	for i, m := range pe.members {
+		sl[i] = m.url
+	}
+	return sl
+}
+
+// ServeHTTP handles its part of the request
+func (pe *PeakEWMAPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := pe.choose()
+	if m == nil {
+		// frick, pool is probably empty
+		RequestErrorResponse(r, w, "Pool faulted, and likely is empty", http.StatusServiceUnavailable)
+		return
+	}
+	pe.serve(w, r, m)
+}
+
+// ServeMember sends the request to the specified member, counting it as outstanding and observing its latency
+// like any other. If the URL is not a member, the request is sent to it unobserved.
+func (pe *PeakEWMAPool) ServeMember(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	pe.lock.RLock()
+	m, _ := pe.find(u)
+	pe.lock.RUnlock()
+
+	if m == nil {
+		// make shallow copy of request
+		newReq := *r
+		newReq.URL = CopyURL(u)
+		pe.next.ServeHTTP(w, &newReq)
+		return
+	}
+	pe.serve(w, r, m)
+}
+
+// serve sends the request to the member, accounting for it while it is outstanding, and observing its latency
+func (pe *PeakEWMAPool) serve(w http.ResponseWriter, r *http.Request, m *ewmaMember) {
+	atomic.AddInt64(&m.inflight, 1)
+	start := time.Now()
+	defer func() {
+		if rtt := time.Since(start); r.Context().Err() == nil || rtt > m.average() {
+			// A cancelled request, e.g. the loser of a hedge, only tells us the member is at least that slow
+			m.observe(rtt, pe.decay)
+		}
+		atomic.AddInt64(&m.inflight, -1)
+	}()
+
+	// make shallow copy of request
+	newReq := *r
+	newReq.URL = CopyURL(m.url)
+
+	pe.next.ServeHTTP(w, &newReq)
+}
+
+// ServerWeight returns the weight of the specified member, and true, or -1 and false if it is not a member
+func (pe *PeakEWMAPool) ServerWeight(u *url.URL) (int, bool) {
+	pe.lock.RLock()
+	defer pe.lock.RUnlock()
+
+	if m, _ := pe.find(u); m != nil {
+		return m.weight, true
+	}
+	return -1, false
+}
+
+// Average returns the latency average for the specified member, and true, or 0 and false if it is not a member
+func (pe *PeakEWMAPool) Average(u *url.URL) (time.Duration, bool) {
+	pe.lock.RLock()
+	defer pe.lock.RUnlock()
+
+	if m, _ := pe.find(u); m != nil {
+		return m.average(), true
+	}
+	return 0, false
+}
+
+// RemoveServer removes the specified member from the pool
+func (pe *PeakEWMAPool) RemoveServer(u *url.URL) error {
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+
+	m, i := pe.find(u)
+	if m == nil {
+		return ErrNoSuchMemberError
+	}
+	pe.members = append(pe.members[:i], pe.members[i+1:]...)
+	if m.gauge != nil {
+		Metrics.Unregister(pe.gaugeName(m.url))
+	}
+	return nil
+}
+
+// UpsertServer adds or updates the member to the pool. If no options are provided, and there is a Pool
+// attached, the Member weight is used.
+func (pe *PeakEWMAPool) UpsertServer(u *url.URL, options ...roundrobin.ServerOption) error {
+	if len(options) == 0 && pe.pool != nil {
+		// We have a pool, so let it render a Member for us
+		options = append(options, pe.pool.GetMember(u).Weight)
+	}
+	weight := serverOptionsToWeight(options...)
+
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+
+	if m, _ := pe.find(u); m != nil {
+		m.weight = weight
+		return nil
+	}
+
+	m := &ewmaMember{lrMember: lrMember{url: CopyURL(u), weight: weight}}
+	if pe.pool != nil && pe.pool.Config != nil {
+		// Only Pools get their averages reported in the healthcheck
+		m.gauge = metrics.GetOrRegisterGaugeFloat64(pe.gaugeName(u), Metrics)
+	}
+	pe.members = append(pe.members, m)
+	return nil
+}
+
+// NextServer returns the URL of the member that would currently be chosen, without accounting for a request to it
+func (pe *PeakEWMAPool) NextServer() (*url.URL, error) {
+	m := pe.choose()
+	if m == nil {
+		return nil, roundrobin.ErrNoServers
+	}
+	return CopyURL(m.url), nil
+}
+
+// Next returns the specified next Handler
+func (pe *PeakEWMAPool) Next() http.Handler {
+	return pe.next
+}
+
+// choose picks two distinct members at random, and returns the one with the lower cost,
+// or nil if there are no members
+func (pe *PeakEWMAPool) choose() *ewmaMember {
+	pe.lock.RLock()
+	defer pe.lock.RUnlock()
+
+	switch n := len(pe.members); n {
+	case 0:
+		return nil
+	case 1:
+		return pe.members[0]
+	default:
+		i := rand.IntN(n)
+		j := rand.IntN(n - 1)
+		if j >= i {
+			j++
+		}
+		a, b := pe.members[i], pe.members[j]
+		var penalty float64
+		if a.average() == 0 || b.average() == 0 {
+			penalty = pe.penalty()
+		}
+		if b.cost(penalty) < a.cost(penalty) {
+			return b
+		}
+		return a
+	}
+}
+
+// penalty returns the highest latency average of the members, in nanoseconds, or 1 if none of them have one yet.
+// The caller must hold the lock.
+func (pe *PeakEWMAPool) penalty() float64 {
+	penalty := 1.0
+	for _, m := range pe.members {
+		m.lock.Lock()
+		penalty = max(penalty, m.ewma)
+		m.lock.Unlock()
+	}
+	return penalty
+}
+
+// find returns the member and its index, or nil and -1 if the URL is not a member. The caller must hold the lock.
+func (pe *PeakEWMAPool) find(u *url.URL) (*ewmaMember, int) {
+	for i, m := range pe.members {
+		if sameURL(u, m.url) {
+			return m, i
+		}
+	}
+	return nil, -1
+}
+
+// gaugeName returns the Metrics name for the member's latency average
+func (pe *PeakEWMAPool) gaugeName(u *url.URL) string {
+	return fmt.Sprintf("%s_%s_PeakEWMA", pe.pool.Config.Name, u.String())
+}
@@ -0,0 +1,184 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolPeakEWMAObserve(t *testing.T) {
+
+	Convey("When latencies are observed, the average honors peaks and decays towards lower values", t, func() {
+		m := ewmaMember{lrMember: lrMember{weight: 1}}
+
+		m.observe(10*time.Millisecond, time.Second)
+		So(m.average(), ShouldEqual, 10*time.Millisecond)
+
+		// Peak replaces
+		m.observe(50*time.Millisecond, time.Second)
+		So(m.average(), ShouldEqual, 50*time.Millisecond)
+
+		// Lower decays, but not all the way
+		m.observe(time.Millisecond, time.Second)
+		So(m.average(), ShouldBeLessThanOrEqualTo, 50*time.Millisecond)
+		So(m.average(), ShouldBeGreaterThan, time.Millisecond)
+
+		// Cost scales with outstanding requests, and inversely with weight
+		c := m.cost(0)
+		m.inflight = 1
+		So(m.cost(0), ShouldAlmostEqual, c*2)
+		m.weight = 2
+		So(m.cost(0), ShouldAlmostEqual, c)
+	})
+
+	Convey("When a member has no average yet, it is free until it has outstanding requests, then it is charged the penalty", t, func() {
+		m := ewmaMember{lrMember: lrMember{weight: 1}}
+		So(m.cost(float64(time.Second)), ShouldEqual, 0)
+
+		m.inflight = 3
+		So(m.cost(float64(time.Second)), ShouldAlmostEqual, float64(4*time.Second))
+	})
+}
+
+func TestPoolPeakEWMASlowMember(t *testing.T) {
+
+	oneURL, _ := url.Parse("http://one:8080/")
+	twoURL, _ := url.Parse("http://two:8080/")
+
+	Convey("When a two-member PeakEWMAPool has a slow member, requests go to the faster member", t, func() {
+		var (
+			counts = make(map[string]int)
+			clock  sync.Mutex
+		)
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clock.Lock()
+			counts[r.URL.Host]++
+			clock.Unlock()
+			if r.URL.Host == "one:8080" {
+				time.Sleep(20 * time.Millisecond)
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		lb := NewPeakEWMAPool(time.Minute, nil, next)
+		So(lb.UpsertServer(oneURL), ShouldBeNil)
+		So(lb.UpsertServer(twoURL), ShouldBeNil)
+		So(len(lb.Servers()), ShouldEqual, 2)
+
+		// Until both have been observed, the unobserved one is preferred
+		for i := 0; i < 2; i++ {
+			rr := httptest.NewRecorder()
+			lb.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			So(rr.Code, ShouldEqual, http.StatusOK)
+		}
+		So(counts["one:8080"], ShouldEqual, 1)
+		So(counts["two:8080"], ShouldEqual, 1)
+
+		for i := 0; i < 20; i++ {
+			rr := httptest.NewRecorder()
+			lb.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			So(rr.Code, ShouldEqual, http.StatusOK)
+		}
+		So(counts["one:8080"], ShouldEqual, 1)
+		So(counts["two:8080"], ShouldEqual, 21)
+
+		slow, ok := lb.Average(oneURL)
+		So(ok, ShouldBeTrue)
+		fast, ok := lb.Average(twoURL)
+		So(ok, ShouldBeTrue)
+		So(slow, ShouldBeGreaterThan, fast)
+	})
+
+	Convey("When a member is added to a PeakEWMAPool, it isn't always chosen while its first requests are outstanding", t, func() {
+		threeURL, _ := url.Parse("http://three:8080/")
+
+		lb := NewPeakEWMAPool(time.Minute, nil, http.NotFoundHandler())
+		So(lb.UpsertServer(oneURL), ShouldBeNil)
+		So(lb.UpsertServer(twoURL), ShouldBeNil)
+		lb.members[0].observe(10*time.Millisecond, time.Minute)
+		lb.members[1].observe(20*time.Millisecond, time.Minute)
+
+		So(lb.UpsertServer(threeURL), ShouldBeNil)
+		lb.members[2].inflight = 50
+
+		var chosen int
+		for i := 0; i < 100; i++ {
+			if u, _ := lb.NextServer(); u.String() == threeURL.String() {
+				chosen++
+			}
+		}
+		So(chosen, ShouldEqual, 0)
+	})
+
+	Convey("When a request is sent to a specific PeakEWMAPool member, its latency is observed, unless it was cancelled early", t, func() {
+		lb := NewPeakEWMAPool(time.Minute, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+		}))
+		So(lb.UpsertServer(oneURL), ShouldBeNil)
+		lb.members[0].observe(time.Second, time.Minute)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		lb.ServeMember(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx), oneURL)
+		avg, _ := lb.Average(oneURL)
+		So(avg, ShouldEqual, time.Second)
+
+		lb.ServeMember(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), oneURL)
+		avg, _ = lb.Average(oneURL)
+		So(avg, ShouldBeLessThan, time.Second)
+	})
+
+	Convey("When a PeakEWMAPool has its members removed, requests fail appropriately", t, func() {
+		lb := NewPeakEWMAPool(0, nil, http.NotFoundHandler())
+		So(lb.UpsertServer(oneURL), ShouldBeNil)
+		So(lb.RemoveServer(oneURL), ShouldBeNil)
+		So(lb.RemoveServer(oneURL), ShouldEqual, ErrNoSuchMemberError)
+
+		_, err := lb.NextServer()
+		So(err, ShouldNotBeNil)
+
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusServiceUnavailable)
+	})
+}
+
+func TestPoolPeakEWMAMaterialize(t *testing.T) {
+
+	Convey("When a PeakEWMA Pool is materialized, and a request is made, it is served and its average is reported", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		defer server.Close()
+
+		pool := NewPool(&PoolConfig{Name: "ewmatest", PeakEWMA: true, Members: []string{server.URL}, Options: PoolOptions{"PeakEWMA.Decay": "5s"}})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "OK")
+
+		g := Metrics.Get("ewmatest_" + server.URL + "_PeakEWMA")
+		So(g, ShouldNotBeNil)
+		So(g.(metrics.GaugeFloat64).Value(), ShouldBeGreaterThan, 0)
+
+		So(pool.DeleteMember(server.URL), ShouldBeNil)
+		So(Metrics.Get("ewmatest_"+server.URL+"_PeakEWMA"), ShouldBeNil)
+	})
+
+	Convey("When a PeakEWMA Pool is also LeastRequests, materialization fails", t, func() {
+		pool := NewPool(&PoolConfig{PeakEWMA: true, LeastRequests: true, Members: []string{"http://localhost/"}})
+		_, err := pool.GetPool()
+		So(err, ShouldEqual, ErrPoolConfigBalancersExclusive)
+	})
+}
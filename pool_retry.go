@@ -0,0 +1,289 @@
+package jar
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// retryBudgetMinimum is the number of concurrent retries always allowed, regardless of the budget,
+	// so that low-traffic pools may still retry
+	retryBudgetMinimum = 3
+)
+
+var (
+	// defaultRetryMethods are the idempotent request methods
+	defaultRetryMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace}
+	// defaultRetryStatuses are the response codes that are retried by default
+	defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultRetryBackoff] = 25 * time.Millisecond
+	ConfigAdditions[ConfigPoolsDefaultRetryBudget] = 20.0
+	ConfigAdditions[ConfigPoolsRetryMaxBodySize] = 1024 * 1024
+}
+
+// RetryPolicy is an http.Handler that wraps a PoolManager, retrying requests that fail in configurable ways
+type RetryPolicy struct {
+	// Retries is the number of times a request may be retried
+	Retries int
+	// Methods are the request methods that may be retried
+	Methods map[string]bool
+	// Statuses are the response codes that will be retried
+	Statuses map[int]bool
+	// PerTryTimeout is how long each attempt may take. Zero disables.
+	PerTryTimeout time.Duration
+	// Backoff is the base wait between attempts
+	Backoff time.Duration
+	// Budget is the percentage of in-flight requests that may be retries
+	Budget float64
+	// MaxBodySize is the largest request body that will be held so the request can be retried
+	MaxBodySize int64
+
+	next     http.Handler
+	active   int64
+	retrying int64
+}
+
+// NewRetryPolicy returns a RetryPolicy wrapping next, configured from the PoolConfig and global defaults
+func NewRetryPolicy(conf *PoolConfig, next http.Handler) *RetryPolicy {
+	rp := RetryPolicy{
+		Retries:       conf.Retries,
+		Methods:       make(map[string]bool),
+		Statuses:      make(map[int]bool),
+		PerTryTimeout: conf.RetryPerTryTimeout,
+		Backoff:       Conf.GetDuration(ConfigPoolsDefaultRetryBackoff),
+		Budget:        Conf.GetFloat64(ConfigPoolsDefaultRetryBudget),
+		MaxBodySize:   Conf.GetInt64(ConfigPoolsRetryMaxBodySize),
+		next:          next,
+	}
+
+	methods := conf.RetryMethods
+	if len(methods) == 0 {
+		methods = defaultRetryMethods
+	}
+	for _, m := range methods {
+		rp.Methods[strings.ToUpper(m)] = true
+	}
+
+	statuses := conf.RetryStatuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	for _, s := range statuses {
+		rp.Statuses[s] = true
+	}
+
+	if conf.RetryBackoff > 0 {
+		rp.Backoff = conf.RetryBackoff
+	}
+	if conf.RetryBudget > 0 {
+		rp.Budget = conf.RetryBudget
+	}
+
+	return &rp
+}
+
+// String returns a summary of the policy
+func (rp *RetryPolicy) String() string {
+	return fmt.Sprintf("retries %d pertry %s backoff %s budget %.1f%%", rp.Retries, rp.PerTryTimeout, rp.Backoff, rp.Budget)
+}
+
+// ServeHTTP handles its part of the request
+func (rp *RetryPolicy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&rp.active, 1)
+	defer atomic.AddInt64(&rp.active, -1)
+
+	if !rp.Methods[r.Method] || r.Header.Get("Upgrade") != "" {
+		// Not retryable, so don't bother
+		rp.next.ServeHTTP(w, r)
+		return
+	}
+
+	var (
+		body    []byte
+		retries = rp.Retries
+	)
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, rp.MaxBodySize+1))
+		if err != nil {
+			RequestErrorResponse(r, w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > rp.MaxBodySize {
+			// Too big to hold onto, so stitch it back together and only try once
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			body = nil
+			retries = 0
+		}
+	}
+
+	var (
+		ua, _ = r.Context().Value(upstreamAttemptsKey).(*UpstreamAttempts)
+		held  int64
+	)
+	defer func() {
+		atomic.AddInt64(&rp.retrying, -held)
+	}()
+
+	for attempt := 0; ; attempt++ {
+		var (
+			ctx    = r.Context()
+			cancel = func() {}
+			ra     = poolAttempt{}
+		)
+		if rp.PerTryTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, rp.PerTryTimeout)
+		}
+		ar := r.WithContext(context.WithValue(ctx, poolAttemptKey, &ra))
+		ar.Header = r.Header.Clone() // downstream handlers may mutate them
+		if body != nil {
+			ar.Body = io.NopCloser(bytes.NewReader(body))
+			ar.ContentLength = int64(len(body))
+		}
+
+		if attempt >= retries {
+			// Last chance
+			rp.next.ServeHTTP(w, ar)
+			cancel()
+			if m := ra.Member(); ua != nil && m != "" {
+				ua.Add(m)
+			}
+			return
+		}
+
+		rw := &retryWriter{
+			w:      w,
+			header: make(http.Header),
+			retry: func(code int) bool {
+				if !rp.Statuses[code] || !rp.acquire() {
+					return false
+				}
+				held++
+				return true
+			},
+		}
+		rp.next.ServeHTTP(rw, ar)
+		cancel()
+		if m := ra.Member(); ua != nil && m != "" {
+			ua.Add(m)
+		}
+
+		if !rw.discarded {
+			return
+		}
+		DebugOut.Print(ErrRequestError{r, fmt.Sprintf("RetryPolicy retrying after %d from %s (attempt %d)", rw.code, ra.Member(), attempt+1)}.String())
+
+		// Backoff, with jitter
+		select {
+		case <-r.Context().Done():
+			// Client gave up
+			return
+		case <-time.After(rp.backoff(attempt)):
+		}
+	}
+}
+
+// acquire returns true if the budget allows another concurrent retry, and accounts for it.
+// The caller must decrement rp.retrying when the request is complete.
+func (rp *RetryPolicy) acquire() bool {
+	allowed := int64(float64(atomic.LoadInt64(&rp.active)) * rp.Budget / 100)
+	if allowed < retryBudgetMinimum {
+		allowed = retryBudgetMinimum
+	}
+	if atomic.AddInt64(&rp.retrying, 1) > allowed {
+		atomic.AddInt64(&rp.retrying, -1)
+		return false
+	}
+	return true
+}
+
+// backoff returns how long to wait before the next attempt, which doubles each attempt,
+// and is jittered between half and all of that
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	if rp.Backoff <= 0 {
+		return 0
+	}
+	d := rp.Backoff << min(attempt, 10)
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryWriter is an http.ResponseWriter that holds the headers until the response code is known, and
+// then either passes the response through, or discards it so the request may be retried
+type retryWriter struct {
+	w         http.ResponseWriter
+	header    http.Header
+	retry     func(code int) bool
+	code      int
+	discarded bool
+	committed bool
+}
+
+// Header returns the header map
+func (rw *retryWriter) Header() http.Header {
+	if rw.committed {
+		return rw.w.Header()
+	}
+	return rw.header
+}
+
+// WriteHeader decides whether the response is passed through, or discarded
+func (rw *retryWriter) WriteHeader(code int) {
+	if rw.committed || rw.discarded {
+		return
+	}
+	if code < http.StatusOK {
+		// Informational, pass it on
+		rw.copyHeader()
+		rw.w.WriteHeader(code)
+		return
+	}
+
+	rw.code = code
+	if rw.retry(code) {
+		rw.discarded = true
+		return
+	}
+
+	rw.copyHeader()
+	rw.committed = true
+	rw.w.WriteHeader(code)
+}
+
+// copyHeader copies the held headers to the underlying ResponseWriter
+func (rw *retryWriter) copyHeader() {
+	h := rw.w.Header()
+	for k, v := range rw.header {
+		h[k] = v
+	}
+}
+
+// Write writes the body, unless the response is being discarded
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	if !rw.committed && !rw.discarded {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.discarded {
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+// Flush flushes the response, if it is being passed through
+func (rw *retryWriter) Flush() {
+	if !rw.committed {
+		return
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,145 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolRetryPolicy(t *testing.T) {
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Member", "good")
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Member", "bad")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	Convey("When a Pool has Retries set, and a member fails, idempotent requests are retried and the attempts noted", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:    "retrytest",
+			Members: []string{bad.URL, good.URL},
+			Retries: 2,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		var retried int
+		for i := 0; i < 10; i++ {
+			ua := &UpstreamAttempts{}
+			req := httptest.NewRequest("PUT", "/", strings.NewReader("hello"))
+			req = req.WithContext(context.WithValue(req.Context(), upstreamAttemptsKey, ua))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(rr.Body.String(), ShouldEqual, "hello")
+			So(rr.Header().Values("X-Member"), ShouldResemble, []string{"good"})
+
+			if ua.Attempts() > 1 {
+				retried++
+				So(ua.Members()[0], ShouldStartWith, bad.URL)
+				So(ua.Members()[1], ShouldStartWith, good.URL)
+
+				// and the access log picks it up
+				var a JSONAccessLog
+				a.RequestFiller(req)
+				So(a.Attempts, ShouldEqual, "2")
+				So(a.Upstreams, ShouldContainSubstring, bad.URL)
+			}
+		}
+		So(retried, ShouldBeGreaterThan, 0)
+	})
+
+	Convey("When a Pool has Retries set, non-idempotent requests are not retried", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:    "retrypostttest",
+			Members: []string{bad.URL, good.URL},
+			Retries: 2,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		var fails int
+		for i := 0; i < 10; i++ {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+			if rr.Code == http.StatusServiceUnavailable {
+				fails++
+			}
+		}
+		So(fails, ShouldEqual, 5)
+	})
+
+	Convey("When a Pool has a RetryPerTryTimeout set, slow attempts are retried", t, func() {
+		var calls int64
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&calls, 1) == 1 {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				return
+			}
+			w.Write([]byte("OK"))
+		}))
+		defer slow.Close()
+
+		pool := NewPool(&PoolConfig{
+			Name:               "retrytimeouttest",
+			Members:            []string{slow.URL},
+			Retries:            1,
+			RetryPerTryTimeout: 50 * time.Millisecond,
+			RetryBackoff:       time.Millisecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "OK")
+		So(atomic.LoadInt64(&calls), ShouldEqual, 2)
+	})
+
+	Convey("When a Pool has Buffered and Retries set, materialization fails", t, func() {
+		pool := NewPool(&PoolConfig{Buffered: true, Retries: 1, Members: []string{"http://localhost/"}})
+		_, err := pool.GetPool()
+		So(err, ShouldEqual, ErrPoolConfigBufferedAndRetries)
+	})
+}
+
+func TestPoolRetryPolicyBudget(t *testing.T) {
+
+	Convey("When a RetryPolicy is busy retrying, the budget limits concurrent retries", t, func() {
+		rp := NewRetryPolicy(&PoolConfig{Retries: 1, RetryBudget: 10}, http.NotFoundHandler())
+
+		// The minimum is always allowed
+		for i := 0; i < retryBudgetMinimum; i++ {
+			So(rp.acquire(), ShouldBeTrue)
+		}
+		So(rp.acquire(), ShouldBeFalse)
+
+		// More traffic, more budget
+		rp.active = 40
+		So(rp.acquire(), ShouldBeTrue)
+		So(rp.acquire(), ShouldBeFalse)
+	})
+
+	Convey("When a RetryPolicy backs off, it doubles and jitters", t, func() {
+		rp := NewRetryPolicy(&PoolConfig{Retries: 1, RetryBackoff: 100 * time.Millisecond}, http.NotFoundHandler())
+		So(rp.backoff(0), ShouldBeBetweenOrEqual, 50*time.Millisecond, 100*time.Millisecond)
+		So(rp.backoff(2), ShouldBeBetweenOrEqual, 200*time.Millisecond, 400*time.Millisecond)
+	})
+}
@@ -0,0 +1,135 @@
+package jar
+
+import (
+	"github.com/vulcand/oxy/v2/roundrobin"
+
+	"math"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// slowStartScale is multiplied into every member weight of a SlowStart Pool, so that
+	// ramping members have room to be lighter than a weight of 1
+	slowStartScale = 100
+	// slowStartMinFraction is the fraction of its weight a ramping member starts with
+	slowStartMinFraction = 0.1
+	// slowStartSteps is the number of weight changes during a ramp
+	slowStartSteps = 20
+	// slowStartMinInterval is the shortest time between weight changes, so tiny SlowStarts still tick
+	slowStartMinInterval = time.Millisecond
+)
+
+// slowRamp is the state of a single member's ramp
+type slowRamp struct {
+	lock      sync.Mutex
+	full      int
+	cancelled bool
+}
+
+// slowStarter ramps the weights of members added to a PoolManager after materialization, from a fraction
+// of their weight up to their full weight, over a duration
+type slowStarter struct {
+	pm         PoolManager
+	name       string
+	duration   time.Duration
+	aggression float64
+	ramps      sync.Map // string -> *slowRamp
+}
+
+// newSlowStarter returns a slowStarter for the PoolManager. An aggression of 1.0 is a linear ramp, larger
+// values ramp up more quickly at first, smaller values more slowly.
+func newSlowStarter(name string, pm PoolManager, duration time.Duration, aggression float64) *slowStarter {
+	if aggression <= 0 {
+		aggression = 1.0
+	}
+	return &slowStarter{
+		pm:         pm,
+		name:       name,
+		duration:   duration,
+		aggression: aggression,
+	}
+}
+
+// fraction returns the fraction of its full weight a member should have, elapsed into its ramp
+func (ss *slowStarter) fraction(elapsed time.Duration) float64 {
+	if elapsed >= ss.duration {
+		return 1.0
+	}
+	f := math.Pow(float64(elapsed)/float64(ss.duration), 1/ss.aggression)
+	return math.Max(f, slowStartMinFraction)
+}
+
+// Upsert adds the member to the PoolManager with its full weight (which must already be scaled), ramping up to
+// it if the member is new. Members that are already ramping have their target updated.
+func (ss *slowStarter) Upsert(u *url.URL, full int) error {
+	if v, ok := ss.ramps.Load(u.String()); ok {
+		r := v.(*slowRamp)
+		r.lock.Lock()
+		r.full = full
+		r.lock.Unlock()
+		return nil
+	}
+
+	if _, ok := ss.pm.ServerWeight(u); ok {
+		// Already here, not ramping
+		return ss.pm.UpsertServer(u, roundrobin.Weight(full))
+	}
+
+	r := &slowRamp{full: full}
+	ss.ramps.Store(u.String(), r)
+	if err := ss.pm.UpsertServer(u, roundrobin.Weight(ss.weight(full, 0))); err != nil {
+		ss.ramps.Delete(u.String())
+		return err
+	}
+	DebugOut.Printf("SlowStart %s: ramping %s to %d over %s\n", ss.name, u.String(), full, ss.duration.String())
+
+	go ss.ramp(CopyURL(u), r)
+	return nil
+}
+
+// Cancel stops the member's ramp, if any. It must be called before the member is removed from the PoolManager,
+// otherwise the ramp may re-add it.
+func (ss *slowStarter) Cancel(u *url.URL) {
+	if v, ok := ss.ramps.LoadAndDelete(u.String()); ok {
+		r := v.(*slowRamp)
+		r.lock.Lock()
+		r.cancelled = true
+		r.lock.Unlock()
+	}
+}
+
+// ramp steps the member's weight up until it is full, or the ramp is cancelled
+func (ss *slowStarter) ramp(u *url.URL, r *slowRamp) {
+	var (
+		start  = time.Now()
+		ticker = time.NewTicker(max(ss.duration/slowStartSteps, slowStartMinInterval))
+	)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		elapsed := time.Since(start)
+
+		r.lock.Lock()
+		if r.cancelled {
+			r.lock.Unlock()
+			return
+		}
+		if err := ss.pm.UpsertServer(u, roundrobin.Weight(ss.weight(r.full, elapsed))); err != nil {
+			ErrorOut.Printf("SlowStart %s: error ramping %s: %s\n", ss.name, u.String(), err)
+		}
+		r.lock.Unlock()
+
+		if elapsed >= ss.duration {
+			ss.ramps.Delete(u.String())
+			DebugOut.Printf("SlowStart %s: %s is at full weight\n", ss.name, u.String())
+			return
+		}
+	}
+}
+
+// weight returns the weight a member should have, elapsed into its ramp
+func (ss *slowStarter) weight(full int, elapsed time.Duration) int {
+	return max(int(math.Ceil(float64(full)*ss.fraction(elapsed))), 1)
+}
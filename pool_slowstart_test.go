@@ -0,0 +1,102 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPoolSlowStartFraction(t *testing.T) {
+
+	Convey("When a slowStarter computes ramp fractions, they follow the curve and respect the floor", t, func() {
+		ss := newSlowStarter("test", nil, 100*time.Second, 0)
+		So(ss.fraction(0), ShouldEqual, slowStartMinFraction)
+		So(ss.fraction(50*time.Second), ShouldAlmostEqual, 0.5)
+		So(ss.fraction(100*time.Second), ShouldEqual, 1.0)
+		So(ss.fraction(time.Hour), ShouldEqual, 1.0)
+		So(ss.weight(100, 50*time.Second), ShouldEqual, 50)
+
+		aggressive := newSlowStarter("test", nil, 100*time.Second, 2.0)
+		So(aggressive.fraction(25*time.Second), ShouldAlmostEqual, 0.5)
+	})
+}
+
+func TestPoolSlowStart(t *testing.T) {
+
+	for _, balancer := range []string{"roundrobin", "consistent", "sticky"} {
+		Convey("When a SlowStart Pool has a member added, it ramps up to its full weight, balancing by "+balancer, t, func() {
+			pool := NewPool(&PoolConfig{
+				Name:                  "slowstarttest",
+				Members:               []string{"http://one:8080/", "http://two:8080/"},
+				SlowStart:             200 * time.Millisecond,
+				ConsistentHashing:     balancer == "consistent",
+				Sticky:                balancer == "sticky",
+				ConsistentHashSources: []string{"request"},
+				ConsistentHashNames:   []string{"remoteaddr"},
+			})
+			_, err := pool.GetPool()
+			So(err, ShouldBeNil)
+			// Sticky Pools are wrapped for draining, so go to the source
+			pm := pool.drainer.pm
+
+			one, _ := url.Parse("http://one:8080/")
+			three, _ := url.Parse("http://three:8080/")
+
+			// Configured members do not ramp
+			w, ok := pm.ServerWeight(one)
+			So(ok, ShouldBeTrue)
+			So(w, ShouldEqual, DefaultMemberWeight*slowStartScale)
+
+			So(pool.AddMember(three.String()), ShouldBeNil)
+			w, ok = pm.ServerWeight(three)
+			So(ok, ShouldBeTrue)
+			So(w, ShouldBeLessThan, DefaultMemberWeight*slowStartScale)
+
+			So(waitFor(time.Second, func() bool {
+				w, _ := pm.ServerWeight(three)
+				return w == DefaultMemberWeight*slowStartScale
+			}), ShouldBeTrue)
+
+			// Re-adding an existing member doesn't ramp it again
+			So(pool.AddMember(three.String()), ShouldBeNil)
+			w, _ = pm.ServerWeight(three)
+			So(w, ShouldEqual, DefaultMemberWeight*slowStartScale)
+		})
+	}
+
+	Convey("When a SlowStart Pool has a ramping member removed, the ramp does not put it back", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:      "slowstartremovetest",
+			Members:   []string{"http://one:8080/"},
+			SlowStart: 100 * time.Millisecond,
+		})
+		_, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		So(pool.AddMember("http://two:8080/"), ShouldBeNil)
+		So(pool.ListMembers(), ShouldHaveLength, 2)
+		So(pool.RemoveMember("http://two:8080/"), ShouldBeNil)
+
+		time.Sleep(150 * time.Millisecond)
+		So(pool.ListMembers(), ShouldHaveLength, 1)
+	})
+	Convey("When a SlowStart Pool has a tiny SlowStart, added members still ramp to their full weight", t, func() {
+		pool := NewPool(&PoolConfig{
+			Name:      "slowstarttinytest",
+			Members:   []string{"http://one:8080/"},
+			SlowStart: 10 * time.Nanosecond,
+		})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		pm := h.(PoolManager)
+
+		two, _ := url.Parse("http://two:8080/")
+		So(pool.AddMember(two.String()), ShouldBeNil)
+		So(waitFor(time.Second, func() bool {
+			w, _ := pm.ServerWeight(two)
+			return w == DefaultMemberWeight*slowStartScale
+		}), ShouldBeTrue)
+	})
+}
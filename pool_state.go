@@ -0,0 +1,233 @@
+package jar
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	// ErrPoolsStatePolicyInvalid is returned when pools.statepolicy is set to something other than "config" or "state"
+	ErrPoolsStatePolicyInvalid = Error("pools.statepolicy must be 'config' or 'state'")
+)
+
+// Policies for when the configured members of a Pool have changed since its runtime changes were persisted
+const (
+	// PoolStatePolicyConfig discards the runtime changes of Pools whose configured members have changed
+	PoolStatePolicyConfig = "config"
+	// PoolStatePolicyState replays the runtime changes anyway
+	PoolStatePolicyState = "state"
+)
+
+var (
+	// PoolState persists runtime membership changes made to LoadBalancers, if pools.statefile is set
+	PoolState *PoolMembershipState
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsStatePolicy] = PoolStatePolicyConfig
+
+	ConfigValidations[ConfigPoolsStatePolicy] = func() error {
+		switch Conf.GetString(ConfigPoolsStatePolicy) {
+		case PoolStatePolicyConfig, PoolStatePolicyState:
+			return nil
+		}
+		return ErrPoolsStatePolicyInvalid
+	}
+}
+
+// PoolStateEntry is the runtime membership changes made to a Pool, relative to its configured members
+type PoolStateEntry struct {
+	// Configured is the members the Pool was configured with when the changes were made
+	Configured []string `json:"configured"`
+	// Added is members added that weren't configured
+	Added []string `json:"added,omitempty"`
+	// Removed is configured members that were removed, deleted, or drained
+	Removed []string `json:"removed,omitempty"`
+}
+
+// PoolMembershipState is the runtime membership changes made to Pools, written atomically to a file on every
+// change, so they can be replayed after a restart. All methods are safe to call on a nil PoolMembershipState.
+type PoolMembershipState struct {
+	path   string
+	policy string
+	lock   sync.Mutex
+	pools  map[string]*PoolStateEntry
+}
+
+// NewPoolMembershipState returns a PoolMembershipState persisted to the path, reading any existing state from it.
+// The policy decides what happens to Pools whose configured members have changed since their state was written.
+func NewPoolMembershipState(path, policy string) (*PoolMembershipState, error) {
+	s := PoolMembershipState{
+		path:   path,
+		policy: policy,
+		pools:  make(map[string]*PoolStateEntry),
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing has changed yet
+		return &s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &s.pools); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Replay applies the persisted changes to the Pools, according to the policy, and rewrites the state file to match
+func (s *PoolMembershipState) Replay(pools *Pools) error {
+	if s == nil || pools == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	replayed := make(map[string]*PoolStateEntry)
+	for _, name := range pools.List() {
+		pool, _ := pools.Get(name)
+		configured := sortedMembers(pool.Config.Members)
+
+		e := &PoolStateEntry{Configured: configured}
+		if old, ok := s.pools[name]; ok {
+			if !slices.Equal(old.Configured, configured) && s.policy != PoolStatePolicyState {
+				ErrorOut.Printf("Pool %s members have changed in the config, discarding its runtime changes (added %v, removed %v)\n", name, old.Added, old.Removed)
+			} else {
+				// Rebase the changes on what is configured now
+				for _, m := range old.Added {
+					if !slices.Contains(configured, m) {
+						e.Added = append(e.Added, m)
+					}
+				}
+				for _, m := range old.Removed {
+					if slices.Contains(configured, m) {
+						e.Removed = append(e.Removed, m)
+					}
+				}
+				replayPoolState(pool, e)
+			}
+		}
+		replayed[name] = e
+	}
+	s.pools = replayed
+
+	return s.save()
+}
+
+// Added records that the member was added to the named Pool
+func (s *PoolMembershipState) Added(poolName, member string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.pools[poolName]
+	if !ok {
+		return nil
+	}
+	e.Removed = slices.DeleteFunc(e.Removed, func(m string) bool { return m == member })
+	if !slices.Contains(e.Configured, member) && !slices.Contains(e.Added, member) {
+		e.Added = append(e.Added, member)
+	}
+	return s.save()
+}
+
+// Removed records that the member was removed, deleted, or drained from the named Pool
+func (s *PoolMembershipState) Removed(poolName, member string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.pools[poolName]
+	if !ok {
+		return nil
+	}
+	e.Added = slices.DeleteFunc(e.Added, func(m string) bool { return m == member })
+	if slices.Contains(e.Configured, member) && !slices.Contains(e.Removed, member) {
+		e.Removed = append(e.Removed, member)
+	}
+	return s.save()
+}
+
+// save atomically writes the state file. The lock must be held.
+func (s *PoolMembershipState) save() error {
+	b, err := json.MarshalIndent(s.pools, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write a temp file next to the real one, and move it into place, so readers never see half of it
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// replayPoolState applies the changes to the Pool, via its member funcs if it is materialized, or to its config if not
+func replayPoolState(pool *Pool, e *PoolStateEntry) {
+	members := slices.DeleteFunc(slices.Clone(pool.Config.Members), func(m string) bool { return slices.Contains(e.Removed, m) })
+	if !pool.IsMaterialized() && len(members)+len(e.Added) == 0 {
+		// An unmaterialized Pool can't be configured empty, but a materialized one can be emptied
+		if _, err := pool.GetPool(); err != nil {
+			ErrorOut.Printf("Pool %s error materializing to replay its changes: %s\n", pool.Config.Name, err)
+			return
+		}
+	}
+
+	if pool.IsMaterialized() {
+		if pool.AddMember == nil || pool.DeleteMember == nil {
+			ErrorOut.Printf("Pool %s does not support dynamic members, not replaying its changes\n", pool.Config.Name)
+			return
+		}
+		for _, m := range e.Removed {
+			if err := pool.DeleteMember(m); err != nil && err != ErrNoSuchMemberError {
+				ErrorOut.Printf("Pool %s error replaying removal of %s: %s\n", pool.Config.Name, m, err)
+			}
+		}
+		for _, m := range e.Added {
+			if err := pool.AddMember(m); err != nil {
+				ErrorOut.Printf("Pool %s error replaying addition of %s: %s\n", pool.Config.Name, m, err)
+			}
+		}
+		return
+	}
+
+	pool.Config.Members = append(members, e.Added...)
+}
+
+// sortedMembers returns a sorted copy of the members
+func sortedMembers(members []string) []string {
+	s := slices.Clone(members)
+	slices.Sort(s)
+	if s == nil {
+		s = []string{}
+	}
+	return s
+}
@@ -0,0 +1,180 @@
+package jar
+
+import (
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPoolMembershipState(t *testing.T) {
+
+	const (
+		one   = "http://one:8080"
+		two   = "http://two:8080"
+		three = "http://three:8080"
+	)
+
+	build := func(members ...string) *Pools {
+		pools, err := NewPools(map[string]*PoolConfig{
+			"statetest": {Name: "statetest", Members: members},
+		}, 0)
+		So(err, ShouldBeNil)
+		return pools
+	}
+
+	read := func(path string) map[string]*PoolStateEntry {
+		b, err := os.ReadFile(path)
+		So(err, ShouldBeNil)
+		var state map[string]*PoolStateEntry
+		So(json.Unmarshal(b, &state), ShouldBeNil)
+		return state
+	}
+
+	Convey("When a state file is used, runtime membership changes are written to it, and replayed", t, func() {
+		path := filepath.Join(t.TempDir(), "pools.json")
+		state, err := NewPoolMembershipState(path, PoolStatePolicyConfig)
+		So(err, ShouldBeNil)
+		So(state.Replay(build(one, two)), ShouldBeNil)
+		So(read(path)["statetest"].Configured, ShouldResemble, []string{one, two})
+
+		So(state.Added("statetest", three), ShouldBeNil)
+		So(state.Removed("statetest", one), ShouldBeNil)
+		So(state.Added("statetest", two), ShouldBeNil) // already configured
+		So(state.Added("nosuchpool", three), ShouldBeNil)
+		saved := read(path)
+		So(saved["statetest"].Added, ShouldResemble, []string{three})
+		So(saved["statetest"].Removed, ShouldResemble, []string{one})
+		So(saved, ShouldNotContainKey, "nosuchpool")
+
+		entries, _ := os.ReadDir(filepath.Dir(path))
+		So(entries, ShouldHaveLength, 1) // no temp files left behind
+
+		Convey("... to unmaterialized Pools", func() {
+			state, err := NewPoolMembershipState(path, PoolStatePolicyConfig)
+			So(err, ShouldBeNil)
+			pools := build(one, two)
+			So(state.Replay(pools), ShouldBeNil)
+			pool, _ := pools.Get("statetest")
+			So(pool.Config.Members, ShouldResemble, []string{two, three})
+		})
+
+		Convey("... to materialized Pools", func() {
+			state, err := NewPoolMembershipState(path, PoolStatePolicyConfig)
+			So(err, ShouldBeNil)
+			pools := build(one, two)
+			pool, _ := pools.Get("statetest")
+			_, err = pool.GetPool()
+			So(err, ShouldBeNil)
+			So(state.Replay(pools), ShouldBeNil)
+
+			var members []string
+			for _, u := range pool.ListMembers() {
+				members = append(members, u.String())
+			}
+			So(members, ShouldResemble, []string{two, three})
+		})
+
+		Convey("... and when every configured member was removed, the Pool is empty, not broken", func() {
+			So(state.Removed("statetest", two), ShouldBeNil)
+			So(state.Removed("statetest", three), ShouldBeNil)
+
+			state, err := NewPoolMembershipState(path, PoolStatePolicyConfig)
+			So(err, ShouldBeNil)
+			pools := build(one, two)
+			So(state.Replay(pools), ShouldBeNil)
+			pool, _ := pools.Get("statetest")
+			So(pool.IsMaterialized(), ShouldBeTrue)
+			So(pool.ListMembers(), ShouldBeEmpty)
+		})
+
+		Convey("... but if the configured members have changed, the config wins", func() {
+			state, err := NewPoolMembershipState(path, PoolStatePolicyConfig)
+			So(err, ShouldBeNil)
+			pools := build(one, two, "http://four:8080")
+			So(state.Replay(pools), ShouldBeNil)
+			pool, _ := pools.Get("statetest")
+			So(pool.Config.Members, ShouldResemble, []string{one, two, "http://four:8080"})
+			So(read(path)["statetest"].Added, ShouldBeEmpty)
+			So(read(path)["statetest"].Removed, ShouldBeEmpty)
+		})
+
+		Convey("... unless the policy says the state wins, and the changes are rebased on the new config", func() {
+			state, err := NewPoolMembershipState(path, PoolStatePolicyState)
+			So(err, ShouldBeNil)
+			pools := build(two, three)
+			So(state.Replay(pools), ShouldBeNil)
+			pool, _ := pools.Get("statetest")
+			So(pool.Config.Members, ShouldResemble, []string{two, three})
+			saved := read(path)
+			So(saved["statetest"].Configured, ShouldResemble, []string{three, two})
+			So(saved["statetest"].Added, ShouldBeEmpty)
+			So(saved["statetest"].Removed, ShouldBeEmpty)
+		})
+	})
+
+	Convey("When a state file is unreadable, an error is returned", t, func() {
+		path := filepath.Join(t.TempDir(), "pools.json")
+		So(os.WriteFile(path, []byte("{nope"), 0600), ShouldBeNil)
+		_, err := NewPoolMembershipState(path, PoolStatePolicyConfig)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When there is no state file, changes aren't recorded, and nothing breaks", t, func() {
+		var state *PoolMembershipState
+		So(state.Replay(build(one)), ShouldBeNil)
+		So(state.Added("statetest", two), ShouldBeNil)
+		So(state.Removed("statetest", one), ShouldBeNil)
+	})
+}
+
+func TestPoolMemberFinishersState(t *testing.T) {
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	Convey("When the PoolMember finishers change a Pool, the changes are persisted", t, func() {
+		oldLB, oldState := LoadBalancers, PoolState
+		defer func() { LoadBalancers, PoolState = oldLB, oldState }()
+
+		var err error
+		LoadBalancers, err = NewPools(map[string]*PoolConfig{
+			"statefinishertest": {Name: "statefinishertest", Members: []string{backend.URL}},
+		}, 0)
+		So(err, ShouldBeNil)
+
+		path := filepath.Join(t.TempDir(), "pools.json")
+		PoolState, err = NewPoolMembershipState(path, PoolStatePolicyConfig)
+		So(err, ShouldBeNil)
+		So(PoolState.Replay(LoadBalancers), ShouldBeNil)
+
+		finish := func(f http.HandlerFunc, member string) {
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{
+				"poolname":     "statefinishertest",
+				"b64memberurl": base64.StdEncoding.EncodeToString([]byte(member)),
+			})
+			rr := httptest.NewRecorder()
+			f(rr, req)
+			So(rr.Code, ShouldEqual, http.StatusOK)
+		}
+
+		finish(PoolMemberAdder, "http://127.0.0.1:1")
+		finish(PoolMemberLoser, backend.URL)
+
+		state, err := NewPoolMembershipState(path, PoolStatePolicyConfig)
+		So(err, ShouldBeNil)
+		pools, err := NewPools(map[string]*PoolConfig{
+			"statefinishertest": {Name: "statefinishertest", Members: []string{backend.URL}},
+		}, 0)
+		So(err, ShouldBeNil)
+		So(state.Replay(pools), ShouldBeNil)
+		pool, _ := pools.Get("statefinishertest")
+		So(pool.Config.Members, ShouldResemble, []string{"http://127.0.0.1:1"})
+	})
+}
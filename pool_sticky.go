@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
-	"time"
 )
 
 // materializeSticky extents Pool to create cookie-based session-pinned Pools
@@ -18,11 +17,32 @@ func (p *Pool) materializeSticky(next http.Handler, opts ...roundrobin.LBOption)
 
 // NewStickyPool returns a primed RoundRobin that honors pinning based on a cookie value
 func NewStickyPool(poolName, cookieName, cookieType string, next http.Handler, opts ...roundrobin.LBOption) (*roundrobin.RoundRobin, error) {
+	ss, err := newStickySession(poolName, cookieName, cookieType)
+	if err != nil {
+		return nil, err
+	}
+	sticky := roundrobin.EnableStickySession(ss)
+
+	var lb *roundrobin.RoundRobin
+	if len(opts) > 0 {
+		newopts := []roundrobin.LBOption{sticky}
+		newopts = append(newopts, opts...)
+		lb, err = roundrobin.New(next, newopts...)
+	} else {
+		lb, err = roundrobin.New(next, sticky)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lb, nil
+}
+
+// newStickySession returns a StickySession for the cookie name and type
+func newStickySession(poolName, cookieName, cookieType string) (*roundrobin.StickySession, error) {
 	var (
 		cookie         = fmt.Sprintf("%s%s", "jar", poolName)
-		sticky         roundrobin.LBOption
-		err            error
-		lb             *roundrobin.RoundRobin
 		cookieHTTPOnly = Conf.GetBool(ConfigStickyCookieHTTPOnly)
 		cookieSecure   = Conf.GetBool(ConfigStickyCookieSecure)
 	)
@@ -36,61 +56,39 @@ func NewStickyPool(poolName, cookieName, cookieType string, next http.Handler, o
 		cookieType = "plain"
 	}
 
+	ss := roundrobin.NewStickySessionWithOptions(cookie, roundrobin.CookieOptions{HTTPOnly: cookieHTTPOnly, Secure: cookieSecure})
 	switch sct := strings.ToLower(cookieType); sct {
 	case "aes":
 		// AES-encrypted values
 		DebugOut.Printf("\t\tSticky with AES-encryption!\n")
-		if sskey := Conf.GetString(ConfigKeysStickyCookie); sskey != "" {
-			var (
-				ao       stickycookie.CookieValue
-				clearKey []byte
-			)
-
-			clearKey, err = base64.StdEncoding.DecodeString(sskey)
-			if err != nil {
-				return nil, err
-			}
-
-			if cookielife := Conf.GetDuration(ConfigStickyCookieAESTTL); cookielife > 0 {
-				DebugOut.Printf("\t\t... with expiration of %s\n", cookielife.String())
-				ao, err = stickycookie.NewAESValue(clearKey, cookielife)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				ao, err = stickycookie.NewAESValue(clearKey, time.Duration(0))
-				if err != nil {
-					return nil, err
-				}
-			}
-			sticky = roundrobin.EnableStickySession(roundrobin.NewStickySessionWithOptions(cookie, roundrobin.CookieOptions{HTTPOnly: cookieHTTPOnly, Secure: cookieSecure}).SetCookieValue(ao))
-
-		} else {
+		sskey := Conf.GetString(ConfigKeysStickyCookie)
+		if sskey == "" {
 			// No key set!
 			return nil, ErrPoolStickyAESNoKey
 		}
+
+		clearKey, err := base64.StdEncoding.DecodeString(sskey)
+		if err != nil {
+			return nil, err
+		}
+
+		cookielife := Conf.GetDuration(ConfigStickyCookieAESTTL)
+		if cookielife > 0 {
+			DebugOut.Printf("\t\t... with expiration of %s\n", cookielife.String())
+		}
+		ao, err := stickycookie.NewAESValue(clearKey, cookielife)
+		if err != nil {
+			return nil, err
+		}
+		return ss.SetCookieValue(ao), nil
 	case "hash":
 		// Hashed values
 		DebugOut.Printf("\t\tSticky with hashed values!\n")
-		sticky = roundrobin.EnableStickySession(roundrobin.NewStickySessionWithOptions(cookie, roundrobin.CookieOptions{HTTPOnly: cookieHTTPOnly, Secure: cookieSecure}).SetCookieValue(&stickycookie.HashValue{Salt: Conf.GetString(ConfigKeysStickyCookie)}))
+		return ss.SetCookieValue(&stickycookie.HashValue{Salt: Conf.GetString(ConfigKeysStickyCookie)}), nil
 	case "plain":
 		DebugOut.Printf("\t\tSticky with plaintext values!\n")
-		sticky = roundrobin.EnableStickySession(roundrobin.NewStickySessionWithOptions(cookie, roundrobin.CookieOptions{HTTPOnly: cookieHTTPOnly, Secure: cookieSecure}))
+		return ss, nil
 	default:
 		return nil, fmt.Errorf("invalid Pool.StickyCookieType '%s'", sct)
 	}
-
-	if len(opts) > 0 {
-		newopts := []roundrobin.LBOption{sticky}
-		newopts = append(newopts, opts...)
-		lb, err = roundrobin.New(next, newopts...)
-	} else {
-		lb, err = roundrobin.New(next, sticky)
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	return lb, nil
 }
@@ -0,0 +1,394 @@
+package jar
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ErrPoolsSyncNoPeers is returned when pools.sync is set, but groupcache.peerlist is not
+	ErrPoolsSyncNoPeers = Error("pools.sync requires groupcache.peerlist to be set")
+
+	// ErrPoolsSyncNoKey is returned when pools.sync is set, but pools.synckey is not
+	ErrPoolsSyncNoKey = Error("pools.sync requires pools.synckey to be set")
+
+	// ErrPoolsSyncUnauthorized is returned when a request to the PoolSyncer isn't signed by a peer
+	ErrPoolsSyncUnauthorized = Error("pool sync request is not signed with pools.synckey, or is too old")
+
+	// PoolSyncPath is where peers send membership changes to each other, on the groupcache listener
+	PoolSyncPath = "/_jar/poolsync"
+
+	// PoolSyncTimeHeader is the header peers send the time a request was signed in, as Unix seconds
+	PoolSyncTimeHeader = "X-JAR-PoolSync-Time"
+
+	// PoolSyncSignatureHeader is the header peers send the hex HMAC-SHA256 of a request in, keyed with pools.synckey
+	PoolSyncSignatureHeader = "X-JAR-PoolSync-Signature"
+
+	// poolSyncMaxSkew is how far from now the signing time of a request may be
+	poolSyncMaxSkew = 5 * time.Minute
+
+	// poolSyncMaxBody is the largest request body a PoolSyncer will read
+	poolSyncMaxBody = 16 * 1024 * 1024
+)
+
+// Operations on Pool members that are synchronized between peers
+const (
+	PoolSyncAdd    = "add"
+	PoolSyncRemove = "remove"
+	PoolSyncDrain  = "drain"
+)
+
+var (
+	// PoolSync propagates runtime membership changes made to LoadBalancers to our peers, if pools.sync is set
+	PoolSync *PoolSyncer
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsSync] = false
+	ConfigAdditions[ConfigPoolsSyncInterval] = 30 * time.Second
+
+	ConfigValidations[ConfigPoolsSync] = func() error {
+		if !Conf.GetBool(ConfigPoolsSync) {
+			return nil
+		}
+		if Conf.GetString(ConfigGroupCachePeers) == "" {
+			return ErrPoolsSyncNoPeers
+		}
+		if Conf.GetString(ConfigPoolsSyncKey) == "" {
+			return ErrPoolsSyncNoKey
+		}
+		return nil
+	}
+}
+
+// PoolSyncEntry is the latest change to a member of a Pool
+type PoolSyncEntry struct {
+	Pool    string        `json:"pool"`
+	Member  string        `json:"member"`
+	Op      string        `json:"op"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Stamp orders changes to the same member: the highest wins
+	Stamp int64 `json:"stamp"`
+	// Origin is the peer that made the change, and breaks ties between equal Stamps
+	Origin string `json:"origin"`
+}
+
+// newer returns true if the entry supersedes the other
+func (e *PoolSyncEntry) newer(o *PoolSyncEntry) bool {
+	if e.Stamp != o.Stamp {
+		return e.Stamp > o.Stamp
+	}
+	return e.Origin > o.Origin
+}
+
+// key returns the map key of the entry
+func (e *PoolSyncEntry) key() string {
+	return e.Pool + " " + e.Member
+}
+
+// PoolSyncer propagates runtime membership changes between peers, so one admin call converges across the fleet.
+// Each change to a member is stamped with a hybrid logical clock (wall time, but always ahead of every stamp we
+// have seen), and the latest change to each member wins everywhere. Changes are pushed to the peers as they are
+// made, and everything we know is pushed every Interval, so peers that missed changes catch up. Every request
+// between peers is signed with a shared key, and unsigned requests are refused.
+type PoolSyncer struct {
+	// Interval is how often everything we know is pushed to the peers
+	Interval time.Duration
+
+	self    string
+	key     []byte
+	peers   []string
+	pools   *Pools
+	client  *http.Client
+	lock    sync.Mutex
+	stamp   int64
+	entries map[string]*PoolSyncEntry
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewPoolSyncer returns a PoolSyncer for the Pools, that talks to its peers (base URLs of their groupcache
+// listeners) at PoolSyncPath, signing requests with pools.synckey. self is our own base URL, and is skipped if
+// it is in peers.
+func NewPoolSyncer(self string, peers []string, pools *Pools) *PoolSyncer {
+	s := PoolSyncer{
+		Interval: Conf.GetDuration(ConfigPoolsSyncInterval),
+		self:     strings.TrimSuffix(self, "/"),
+		key:      []byte(Conf.GetString(ConfigPoolsSyncKey)),
+		pools:    pools,
+		client:   &http.Client{Timeout: 10 * time.Second, Transport: DefaultTrip},
+		entries:  make(map[string]*PoolSyncEntry),
+		stop:     make(chan struct{}),
+	}
+	for _, p := range peers {
+		if p = strings.TrimSuffix(p, "/"); p != s.self {
+			s.peers = append(s.peers, p)
+		}
+	}
+	return &s
+}
+
+// Start catches up with the peers, and then pushes everything we know to them every Interval, until Stop is called
+func (s *PoolSyncer) Start() {
+	go func() {
+		s.pull()
+
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.push(s.Entries())
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic pushes
+func (s *PoolSyncer) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+// Record stamps a change made here to a member of a Pool, and pushes it to the peers. Safe to call on a nil
+// PoolSyncer.
+func (s *PoolSyncer) Record(poolName, member, op string, timeout time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.stamp = max(s.stamp+1, time.Now().UnixNano())
+	e := &PoolSyncEntry{Pool: poolName, Member: member, Op: op, Timeout: timeout, Stamp: s.stamp, Origin: s.self}
+	s.entries[e.key()] = e
+	s.lock.Unlock()
+
+	go s.push([]*PoolSyncEntry{e})
+}
+
+// Entries returns the latest change to each member, oldest first
+func (s *PoolSyncer) Entries() []*PoolSyncEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l := make([]*PoolSyncEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		c := *e
+		l = append(l, &c)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[j].newer(l[i]) })
+	return l
+}
+
+// ServeHTTP receives changes from peers with a POST, and returns everything we know to a GET. Requests that
+// aren't signed by a peer are refused.
+func (s *PoolSyncer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, poolSyncMaxBody))
+	if err != nil {
+		http.Error(w, "Error reading changes", http.StatusBadRequest)
+		return
+	}
+	if err = s.verify(r, body); err != nil {
+		ErrorOut.Printf("PoolSync: refusing %s from %s: %s\n", r.Method, r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Entries())
+		return
+	}
+
+	var entries []*PoolSyncEntry
+	if err = json.Unmarshal(body, &entries); err != nil {
+		http.Error(w, "Error decoding changes", http.StatusBadRequest)
+		return
+	}
+	s.merge(entries)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// signature returns the HMAC of a request with the method, signing time, and body
+func (s *PoolSyncer) signature(method, stamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(method + "\n" + stamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// sign adds the signing time and signature headers to the request to a peer
+func (s *PoolSyncer) sign(req *http.Request, body []byte) {
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(PoolSyncTimeHeader, stamp)
+	req.Header.Set(PoolSyncSignatureHeader, hex.EncodeToString(s.signature(req.Method, stamp, body)))
+}
+
+// verify returns nil if the request from a peer is signed with our key, recently, otherwise ErrPoolsSyncUnauthorized
+func (s *PoolSyncer) verify(r *http.Request, body []byte) error {
+	if len(s.key) == 0 {
+		// Nobody can sign anything
+		return ErrPoolsSyncUnauthorized
+	}
+
+	stamp := r.Header.Get(PoolSyncTimeHeader)
+	signed, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return ErrPoolsSyncUnauthorized
+	}
+	if skew := time.Since(time.Unix(signed, 0)); skew > poolSyncMaxSkew || skew < -poolSyncMaxSkew {
+		return ErrPoolsSyncUnauthorized
+	}
+
+	sig, err := hex.DecodeString(r.Header.Get(PoolSyncSignatureHeader))
+	if err != nil || !hmac.Equal(sig, s.signature(r.Method, stamp, body)) {
+		return ErrPoolsSyncUnauthorized
+	}
+	return nil
+}
+
+// merge applies the entries that are newer than what we know, oldest first
+func (s *PoolSyncer) merge(entries []*PoolSyncEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[j].newer(entries[i]) })
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, e := range entries {
+		s.stamp = max(s.stamp, e.Stamp)
+		if old, ok := s.entries[e.key()]; ok && !e.newer(old) {
+			// Old news
+			continue
+		}
+		s.entries[e.key()] = e
+		s.apply(e)
+	}
+}
+
+// apply makes a change from a peer to our Pool, and persists it if we have a PoolState
+func (s *PoolSyncer) apply(e *PoolSyncEntry) {
+	pool, ok := s.pools.Get(e.Pool)
+	if !ok {
+		DebugOut.Printf("PoolSync: ignoring %s of %s to unknown Pool %s from %s\n", e.Op, e.Member, e.Pool, e.Origin)
+		return
+	}
+	if _, err := pool.GetPool(); err != nil {
+		ErrorOut.Printf("PoolSync: failed to materialize pool %s: %s\n", e.Pool, err)
+		return
+	}
+	if pool.AddMember == nil || pool.DeleteMember == nil {
+		ErrorOut.Printf("PoolSync: Pool %s does not support dynamic members, ignoring %s of %s\n", e.Pool, e.Op, e.Member)
+		return
+	}
+
+	DebugOut.Printf("PoolSync: %s of %s to Pool %s from %s\n", e.Op, e.Member, e.Pool, e.Origin)
+	var err error
+	switch e.Op {
+	case PoolSyncAdd:
+		if err = pool.AddMember(e.Member); err == nil {
+			err = PoolState.Added(e.Pool, e.Member)
+		}
+	case PoolSyncRemove:
+		if err = pool.DeleteMember(e.Member); err == nil || err == ErrNoSuchMemberError {
+			err = PoolState.Removed(e.Pool, e.Member)
+		}
+	case PoolSyncDrain:
+		if pool.DrainMember == nil {
+			err = pool.DeleteMember(e.Member)
+		} else {
+			err = pool.DrainMember(e.Member, e.Timeout)
+		}
+		if err == nil || err == ErrNoSuchMemberError {
+			err = PoolState.Removed(e.Pool, e.Member)
+		}
+	default:
+		err = Error("unknown operation")
+	}
+	if err != nil {
+		ErrorOut.Printf("PoolSync: error applying %s of %s to Pool %s from %s: %s\n", e.Op, e.Member, e.Pool, e.Origin, err)
+	}
+}
+
+// push sends the entries to each peer
+func (s *PoolSyncer) push(entries []*PoolSyncEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		ErrorOut.Printf("PoolSync: error encoding changes: %s\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, peer := range s.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			req, perr := http.NewRequest(http.MethodPost, peer+PoolSyncPath, bytes.NewReader(b))
+			if perr != nil {
+				ErrorOut.Printf("PoolSync: error building push to %s: %s\n", peer, perr)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			s.sign(req, b)
+			resp, perr := s.client.Do(req)
+			if perr != nil {
+				DebugOut.Printf("PoolSync: error pushing to %s: %s\n", peer, perr)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				DebugOut.Printf("PoolSync: push to %s returned %s\n", peer, resp.Status)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// pull asks each peer for everything it knows, and merges it
+func (s *PoolSyncer) pull() {
+	for _, peer := range s.peers {
+		req, err := http.NewRequest(http.MethodGet, peer+PoolSyncPath, nil)
+		if err != nil {
+			ErrorOut.Printf("PoolSync: error building pull from %s: %s\n", peer, err)
+			continue
+		}
+		s.sign(req, nil)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			DebugOut.Printf("PoolSync: error pulling from %s: %s\n", peer, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			DebugOut.Printf("PoolSync: pull from %s returned %s\n", peer, resp.Status)
+			continue
+		}
+
+		var entries []*PoolSyncEntry
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if err != nil {
+			DebugOut.Printf("PoolSync: error decoding changes from %s: %s\n", peer, err)
+			continue
+		}
+		s.merge(entries)
+	}
+}
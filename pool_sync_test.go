@@ -0,0 +1,209 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolSyncer(t *testing.T) {
+
+	oldKey := Conf.GetString(ConfigPoolsSyncKey)
+	Conf.Set(ConfigPoolsSyncKey, "sekrit")
+	defer Conf.Set(ConfigPoolsSyncKey, oldKey)
+
+	const (
+		one = "http://one:8080"
+		two = "http://two:8080"
+	)
+
+	// peer is a JAR instance, with its own Pools, and a listener for its PoolSyncer
+	type peer struct {
+		pool   *Pool
+		syncer *PoolSyncer
+		server *httptest.Server
+		down   atomic.Bool
+	}
+
+	newPeers := func(n int) []*peer {
+		peers := make([]*peer, n)
+		var urls []string
+		for i := range peers {
+			p := &peer{}
+			p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if p.down.Load() {
+					http.Error(w, "down", http.StatusServiceUnavailable)
+					return
+				}
+				p.syncer.ServeHTTP(w, r)
+			}))
+			urls = append(urls, p.server.URL)
+			peers[i] = p
+		}
+		for _, p := range peers {
+			pools, err := NewPools(map[string]*PoolConfig{
+				"synctest": {Name: "synctest", Members: []string{one}},
+			}, 0)
+			So(err, ShouldBeNil)
+			p.pool, _ = pools.Get("synctest")
+			_, err = p.pool.GetPool()
+			So(err, ShouldBeNil)
+			p.syncer = NewPoolSyncer(p.server.URL, urls, pools)
+		}
+		return peers
+	}
+
+	closePeers := func(peers []*peer) {
+		for _, p := range peers {
+			p.syncer.Stop()
+			p.server.Close()
+		}
+	}
+
+	hasMember := func(p *peer, member string) bool {
+		return slices.ContainsFunc(p.pool.ListMembers(), func(u *url.URL) bool { return u.String() == member })
+	}
+	converged := func(peers []*peer, member string, present bool) bool {
+		return waitFor(time.Second, func() bool {
+			for _, p := range peers {
+				if hasMember(p, member) != present {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	Convey("When a member is added or removed on one peer, every peer follows", t, func() {
+		peers := newPeers(3)
+		defer closePeers(peers)
+
+		So(peers[0].pool.AddMember(two), ShouldBeNil)
+		peers[0].syncer.Record("synctest", two, PoolSyncAdd, 0)
+		So(converged(peers, two, true), ShouldBeTrue)
+
+		So(peers[2].pool.DeleteMember(one), ShouldBeNil)
+		peers[2].syncer.Record("synctest", one, PoolSyncRemove, 0)
+		So(converged(peers, one, false), ShouldBeTrue)
+
+		Convey("... and a drain is a drain everywhere", func() {
+			So(peers[1].pool.DrainMember(two, time.Hour), ShouldBeNil)
+			peers[1].syncer.Record("synctest", two, PoolSyncDrain, time.Hour)
+			So(converged(peers, two, false), ShouldBeTrue)
+			for _, p := range peers {
+				So(p.pool.ListDrainingMembers(), ShouldHaveLength, 1)
+			}
+		})
+	})
+
+	Convey("When changes to the same member conflict, the latest one wins everywhere", t, func() {
+		peers := newPeers(2)
+		defer closePeers(peers)
+
+		newer := &PoolSyncEntry{Pool: "synctest", Member: two, Op: PoolSyncAdd, Stamp: 200, Origin: "b"}
+		older := &PoolSyncEntry{Pool: "synctest", Member: two, Op: PoolSyncRemove, Stamp: 100, Origin: "a"}
+		tied := &PoolSyncEntry{Pool: "synctest", Member: two, Op: PoolSyncRemove, Stamp: 200, Origin: "a"}
+
+		peers[0].syncer.merge([]*PoolSyncEntry{newer, older})
+		peers[1].syncer.merge([]*PoolSyncEntry{older})
+		peers[1].syncer.merge([]*PoolSyncEntry{tied})
+		peers[1].syncer.merge([]*PoolSyncEntry{newer})
+		for _, p := range peers {
+			So(hasMember(p, two), ShouldBeTrue)
+			So(p.syncer.Entries(), ShouldHaveLength, 1)
+			So(p.syncer.Entries()[0].Op, ShouldEqual, PoolSyncAdd)
+		}
+
+		Convey("... and our own changes are stamped after everything we have seen", func() {
+			future := time.Now().Add(time.Hour).UnixNano()
+			peers[0].syncer.merge([]*PoolSyncEntry{{Pool: "synctest", Member: one, Op: PoolSyncAdd, Stamp: future, Origin: "c"}})
+			peers[0].syncer.Record("synctest", one, PoolSyncRemove, 0)
+			e := peers[0].syncer.Entries()
+			So(e[len(e)-1].Op, ShouldEqual, PoolSyncRemove)
+			So(e[len(e)-1].Stamp, ShouldBeGreaterThan, future)
+		})
+	})
+
+	Convey("When a peer misses changes, it catches up", t, func() {
+		peers := newPeers(3)
+		defer closePeers(peers)
+
+		peers[2].down.Store(true)
+		So(peers[0].pool.AddMember(two), ShouldBeNil)
+		peers[0].syncer.Record("synctest", two, PoolSyncAdd, 0)
+		So(converged(peers[:2], two, true), ShouldBeTrue)
+		So(hasMember(peers[2], two), ShouldBeFalse)
+		peers[2].down.Store(false)
+
+		Convey("... by pulling when it starts", func() {
+			peers[2].syncer.Start()
+			So(converged(peers, two, true), ShouldBeTrue)
+		})
+
+		Convey("... or from the periodic pushes", func() {
+			peers[1].syncer.Interval = 20 * time.Millisecond
+			peers[1].syncer.Start()
+			So(converged(peers, two, true), ShouldBeTrue)
+		})
+	})
+
+	Convey("When a request isn't signed by a peer, it is refused, and nothing changes", t, func() {
+		peers := newPeers(1)
+		defer closePeers(peers)
+		body := `[{"pool":"synctest","member":"http://two:8080","op":"add","stamp":1,"origin":"evil"}]`
+
+		post := func(sign func(*http.Request)) int {
+			req, _ := http.NewRequest("POST", peers[0].server.URL+PoolSyncPath, strings.NewReader(body))
+			if sign != nil {
+				sign(req)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		So(post(nil), ShouldEqual, http.StatusUnauthorized)
+		So(post(func(req *http.Request) {
+			// Signed with the wrong key
+			other := &PoolSyncer{key: []byte("wrong")}
+			other.sign(req, []byte(body))
+		}), ShouldEqual, http.StatusUnauthorized)
+		So(post(func(req *http.Request) {
+			// Signed a while ago
+			stamp := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+			req.Header.Set(PoolSyncTimeHeader, stamp)
+			req.Header.Set(PoolSyncSignatureHeader, hex.EncodeToString(peers[0].syncer.signature("POST", stamp, []byte(body))))
+		}), ShouldEqual, http.StatusUnauthorized)
+		So(post(func(req *http.Request) {
+			// Signed for a different body
+			peers[0].syncer.sign(req, []byte("[]"))
+		}), ShouldEqual, http.StatusUnauthorized)
+		So(hasMember(peers[0], two), ShouldBeFalse)
+		So(peers[0].syncer.Entries(), ShouldBeEmpty)
+
+		resp, err := http.Get(peers[0].server.URL + PoolSyncPath)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+		Convey("... but a signed one is applied", func() {
+			So(post(func(req *http.Request) { peers[0].syncer.sign(req, []byte(body)) }), ShouldEqual, http.StatusNoContent)
+			So(hasMember(peers[0], two), ShouldBeTrue)
+		})
+	})
+
+	Convey("When there is no PoolSyncer, recording does nothing", t, func() {
+		var s *PoolSyncer
+		So(func() { s.Record("synctest", one, PoolSyncAdd, 0) }, ShouldNotPanic)
+	})
+}
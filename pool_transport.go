@@ -0,0 +1,123 @@
+package jar
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// ErrPoolTransportCertWithoutKey is returned when a Pool has only one of TransportCertFile and TransportKeyFile set
+	ErrPoolTransportCertWithoutKey = Error("a Pool must have both or neither of TransportCertFile and TransportKeyFile set")
+
+	// ErrPoolTransportNoCAs is returned when a Pool's TransportCAFile contains no usable certificates
+	ErrPoolTransportNoCAs = Error("no certificates found in TransportCAFile")
+)
+
+var (
+	// poolTransports are the current Pool transports, keyed by Pool name
+	poolTransports sync.Map
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsDefaultMaxIdleConns] = 100
+	ConfigAdditions[ConfigPoolsDefaultTLSHandshakeTimeout] = 10 * time.Second
+}
+
+// newTransport returns an http.Transport with the global defaults
+func newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   Conf.GetDuration(ConfigTimeout),
+			KeepAlive: Conf.GetDuration(ConfigKeepaliveTimeout),
+		}).DialContext,
+		MaxIdleConns:          Conf.GetInt(ConfigPoolsDefaultMaxIdleConns),
+		IdleConnTimeout:       3 * Conf.GetDuration(ConfigTimeout),
+		TLSHandshakeTimeout:   Conf.GetDuration(ConfigPoolsDefaultTLSHandshakeTimeout),
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewPoolTransport returns an http.Transport for the Pool, with the global defaults overridden by the PoolConfig
+func NewPoolTransport(conf *PoolConfig) (*http.Transport, error) {
+	t := newTransport()
+
+	dialTimeout := Conf.GetDuration(ConfigTimeout)
+	if conf.TransportDialTimeout > 0 {
+		dialTimeout = conf.TransportDialTimeout
+		t.DialContext = (&net.Dialer{
+			Timeout:   conf.TransportDialTimeout,
+			KeepAlive: Conf.GetDuration(ConfigKeepaliveTimeout),
+		}).DialContext
+	}
+	// unix members are dialed at their sockets
+	t.DialContext = unixDialContext(&net.Dialer{Timeout: dialTimeout}, t.DialContext)
+	if conf.TransportTLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = conf.TransportTLSHandshakeTimeout
+	}
+	if conf.TransportResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = conf.TransportResponseHeaderTimeout
+	}
+	if conf.TransportMaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = conf.TransportMaxIdleConnsPerHost
+	}
+	// Go only tries HTTP/2 on its own if there is no custom dialer or TLS config, and we always have a dialer
+	t.ForceAttemptHTTP2 = conf.TransportHTTP2
+
+	if conf.TransportCAFile == "" && conf.TransportCertFile == "" && conf.TransportKeyFile == "" &&
+		conf.TransportServerName == "" && !conf.TransportInsecureSkipVerify {
+		// No TLS customizations
+		return t, nil
+	}
+
+	//#nosec G402 -- Only skips verification if explicitly configured.
+	tc := &tls.Config{
+		ServerName:         conf.TransportServerName,
+		InsecureSkipVerify: conf.TransportInsecureSkipVerify,
+	}
+
+	if conf.TransportCAFile != "" {
+		pem, err := os.ReadFile(conf.TransportCAFile) //#nosec G304 -- Path is from configuration.
+		if err != nil {
+			return nil, fmt.Errorf("error reading TransportCAFile: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrPoolTransportNoCAs
+		}
+	}
+
+	if conf.TransportCertFile != "" || conf.TransportKeyFile != "" {
+		if conf.TransportCertFile == "" || conf.TransportKeyFile == "" {
+			return nil, ErrPoolTransportCertWithoutKey
+		}
+		cert, err := tls.LoadX509KeyPair(conf.TransportCertFile, conf.TransportKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TransportCertFile/TransportKeyFile: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	t.TLSClientConfig = tc
+	return t, nil
+}
+
+// registerPoolTransport registers the Pool's transport with StrainFuncs. If the Pool already had one,
+// e.g. before a reload, it is replaced, and its idle connections closed.
+func registerPoolTransport(name string, t *http.Transport) {
+	if old, loaded := poolTransports.Swap(name, t); loaded {
+		old.(*http.Transport).CloseIdleConnections()
+		return
+	}
+
+	StrainFuncs.Add(func() {
+		if t, ok := poolTransports.Load(name); ok {
+			t.(*http.Transport).CloseIdleConnections()
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestClientCert writes a self-signed client certificate and key to dir, returning their paths and the certificate
+func writeTestClientCert(dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jar client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	kder, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return certFile, keyFile, cert
+}
+
+func TestPoolTransport(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := writeTestClientCert(dir)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0600)
+
+	get := func(conf *PoolConfig) *httptest.ResponseRecorder {
+		h, err := NewPool(conf).GetPool()
+		So(err, ShouldBeNil)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		return rr
+	}
+
+	Convey("When a Pool has a CA bundle and client certificate, it can talk to an mTLS member", t, func() {
+		rr := get(&PoolConfig{
+			Name:              "transporttest",
+			Members:           []string{backend.URL},
+			TransportCAFile:   caFile,
+			TransportCertFile: certFile,
+			TransportKeyFile:  keyFile,
+		})
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "HTTP/1.1")
+
+		Convey("... and with HTTP/2 enabled, and the SNI overridden, it still can", func() {
+			rr := get(&PoolConfig{
+				Name:                "transporth2test",
+				Members:             []string{backend.URL},
+				TransportCAFile:     caFile,
+				TransportCertFile:   certFile,
+				TransportKeyFile:    keyFile,
+				TransportServerName: "example.com",
+				TransportHTTP2:      true,
+			})
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(rr.Body.String(), ShouldEqual, "HTTP/2.0")
+		})
+	})
+
+	Convey("When a Pool has no client certificate, or doesn't trust the member, it cannot talk to an mTLS member", t, func() {
+		So(get(&PoolConfig{
+			Name:            "transportnocerttest",
+			Members:         []string{backend.URL},
+			TransportCAFile: caFile,
+		}).Code, ShouldBeGreaterThanOrEqualTo, http.StatusInternalServerError)
+
+		So(get(&PoolConfig{
+			Name:              "transportnocatest",
+			Members:           []string{backend.URL},
+			TransportCertFile: certFile,
+			TransportKeyFile:  keyFile,
+		}).Code, ShouldBeGreaterThanOrEqualTo, http.StatusInternalServerError)
+	})
+
+	Convey("When a Pool has broken transport settings, materialization fails", t, func() {
+		_, err := NewPool(&PoolConfig{Members: []string{backend.URL}, TransportCertFile: certFile}).GetPool()
+		So(err, ShouldEqual, ErrPoolTransportCertWithoutKey)
+
+		_, err = NewPool(&PoolConfig{Members: []string{backend.URL}, TransportCAFile: keyFile}).GetPool()
+		So(err, ShouldEqual, ErrPoolTransportNoCAs)
+
+		_, err = NewPool(&PoolConfig{Members: []string{backend.URL}, TransportCAFile: filepath.Join(dir, "nope.pem")}).GetPool()
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPoolTransportStrain(t *testing.T) {
+
+	Convey("When a Pool is rematerialized, its transport is replaced, not added to", t, func() {
+		conf := &PoolConfig{Name: "transportstraintest", Members: []string{"http://localhost/"}}
+		_, err := NewPool(conf).GetPool()
+		So(err, ShouldBeNil)
+		first, _ := poolTransports.Load("transportstraintest")
+
+		_, err = NewPool(conf).GetPool()
+		So(err, ShouldBeNil)
+		second, _ := poolTransports.Load("transportstraintest")
+		So(second, ShouldNotEqual, first)
+
+		Convey("... unless the new Pool fails to materialize", func() {
+			for _, broken := range []*PoolConfig{
+				{Name: "transportstraintest", Members: []string{"http://localhost/"}, Buffered: true, Retries: 1},
+				{Name: "transportstraintest", Members: []string{"http://localhost/"}, LeastRequests: true, PeakEWMA: true},
+				{Name: "transportstraintest", Members: []string{"http://localhost/"}, MirrorPool: "transportstraintest"},
+				{Name: "transportstraintest", Members: []string{"fcgi://127.0.0.1:9000"}, FCGIDocumentRoot: "/var/www", FCGISplitPath: `^(.+\.php)`},
+			} {
+				_, err := NewPool(broken).GetPool()
+				So(err, ShouldNotBeNil)
+				again, _ := poolTransports.Load("transportstraintest")
+				So(again, ShouldEqual, second)
+			}
+
+			_, err := NewPool(&PoolConfig{Name: "transportfailtest", Members: []string{"http://localhost/"}, OverflowConcurrency: 1}).GetPool()
+			So(err, ShouldEqual, ErrPoolConfigOverflowWithoutFailover)
+			_, ok := poolTransports.Load("transportfailtest")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,94 @@
+package jar
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixHostSuffix ends the reserved hostnames that unix members are requested at. The rest of the name is the
+// hex-encoded socket path, so each socket gets its own idle connections.
+const unixHostSuffix = ".unix.invalid"
+
+func init() {
+	// Members that listen on a unix domain socket, e.g. unix:///run/app.sock
+	Materializers["unix"] = materializeHTTP
+	MemberBuilders["unix"] = append(MemberBuilders["unix"], unixMember)
+}
+
+// unixMember is a MemberBuilder that sets the Address of unix members to their socket path
+func unixMember(conf *PoolConfig, u *url.URL, m *Member) *Member {
+	if m == nil {
+		m = NewMember(u)
+	}
+	m.Address = u.Path
+	return m
+}
+
+// isUnixScheme returns true if the scheme is one of the unix domain socket schemes
+func isUnixScheme(scheme string) bool {
+	return scheme == "unix" || scheme == "fcgi+unix"
+}
+
+// memberHost returns what tells members apart: the host, or for unix members, the socket path
+func memberHost(u *url.URL) string {
+	if isUnixScheme(u.Scheme) {
+		return u.Path
+	}
+	return u.Host
+}
+
+// unixRequestURL returns the http URL that the unix member is requested at, via the Pool transport
+func unixRequestURL(u *url.URL) *url.URL {
+	return &url.URL{
+		Scheme: "http",
+		Host:   hex.EncodeToString([]byte(u.Path)) + unixHostSuffix,
+	}
+}
+
+// unixSocketPath returns the socket path from an address dialed for a unix member, and true, or false if it isn't one
+func unixSocketPath(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	enc, ok := strings.CutSuffix(host, unixHostSuffix)
+	if !ok {
+		return "", false
+	}
+	path, err := hex.DecodeString(enc)
+	if err != nil {
+		return "", false
+	}
+	return string(path), true
+}
+
+// unixDialContext returns a DialContext func that dials the socket for unix members, and uses next for everything else
+func unixDialContext(dialer *net.Dialer, next func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if path, ok := unixSocketPath(addr); ok {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		return next(ctx, network, addr)
+	}
+}
+
+// unixHandler is an unchainable handler that must be placed directly in front of the proxy, after the PoolManager has
+// chosen a member, requesting unix members over their socket
+func unixHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUnixScheme(r.URL.Scheme) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// make shallow copy of request, so the member URL is untouched for everyone else
+		newReq := *r
+		newReq.URL = unixRequestURL(r.URL)
+		newReq.URL.Path = "/"
+		next.ServeHTTP(w, &newReq)
+	})
+}
@@ -0,0 +1,103 @@
+package jar
+
+import (
+	"github.com/cognusion/go-jar/workers"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPoolUnix(t *testing.T) {
+
+	// Socket paths must be short, so not t.TempDir
+	dir, err := os.MkdirTemp("", "jarunix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listen := func(name string) (string, *httptest.Server) {
+		path := filepath.Join(dir, name+".sock")
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.Host + " " + r.URL.RequestURI()))
+		}))
+		s.Listener = l
+		s.Start()
+		return "unix://" + path, s
+	}
+	one, oneServer := listen("one")
+	defer oneServer.Close()
+	two, twoServer := listen("two")
+	defer twoServer.Close()
+
+	Convey("When a Pool has unix members, requests are proxied over their sockets", t, func() {
+		pool := NewPool(&PoolConfig{Name: "unixtest", Members: []string{one, two}, HealthCheckURI: "/health", HealthCheckShotgun: true})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		So(pool.ListMembers(), ShouldHaveLength, 2)
+
+		seen := make(map[string]bool)
+		for range 4 {
+			req := httptest.NewRequest("GET", "http://app.example.com/things?id=1", nil)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			seen[rr.Body.String()] = true
+		}
+		So(seen, ShouldContainKey, "one app.example.com /things?id=1")
+		So(seen, ShouldContainKey, "two app.example.com /things?id=1")
+
+		m := pool.GetMember(pool.ListMembers()[0])
+		So(m.Address, ShouldStartWith, dir)
+
+		Convey("... and health checked over them too", func() {
+			oldAW := AddWork
+			defer func() { AddWork = oldAW }()
+			var work []workers.Work
+			AddWork = func(w workers.Work) {
+				work = append(work, w)
+			}
+
+			pools := &Pools{pools: map[string]*Pool{"unixtest": pool}}
+			pools.tickFunc(nil)
+			So(work, ShouldHaveLength, 2)
+			for _, w := range work {
+				res, ok := w.Work().(HealthCheckResult)
+				So(ok, ShouldBeTrue)
+				So(res.StatusCode, ShouldEqual, http.StatusOK)
+			}
+		})
+	})
+
+	Convey("When a unix member's socket is gone, the request fails like any other unreachable member", t, func() {
+		pool := NewPool(&PoolConfig{Name: "unixgonetest", Members: []string{"unix://" + filepath.Join(dir, "gone.sock")}})
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		So(rr.Code, ShouldEqual, http.StatusBadGateway)
+	})
+
+	Convey("When a socket path is encoded as a host, it decodes, and other hosts don't", t, func() {
+		u := unixRequestURL(&url.URL{Scheme: "unix", Path: "/run/app.sock"})
+		path, ok := unixSocketPath(u.Host + ":80")
+		So(ok, ShouldBeTrue)
+		So(path, ShouldEqual, "/run/app.sock")
+
+		_, ok = unixSocketPath("example.com:80")
+		So(ok, ShouldBeFalse)
+		_, ok = unixSocketPath("nothex" + unixHostSuffix + ":80")
+		So(ok, ShouldBeFalse)
+	})
+}
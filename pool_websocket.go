@@ -0,0 +1,424 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocket frame opcodes. Anything below wsOpClose is data.
+const (
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+
+	// wsCloseGoingAway is the WebSocket close status for a server going away
+	wsCloseGoingAway = 1001
+)
+
+// webSocketKey is a type for WebSocketTracker context keys
+type webSocketKey int
+
+const (
+	// wsUpgradedKey is the context key for a func() called when the request's WebSocket is tracked
+	wsUpgradedKey webSocketKey = iota
+)
+
+func init() {
+	ConfigAdditions[ConfigPoolsWebSocketDrainTimeout] = 10 * time.Second
+}
+
+// isWebSocketRequest returns true if the request is asking to be upgraded to a WebSocket
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// WebSocketTracker keeps track of the upgraded WebSockets to each member of a Pool, so they can be counted,
+// kept alive, expired, and drained when their member is deleted.
+type WebSocketTracker struct {
+	// IdleTimeout is how long a WebSocket may go without data before it is closed. Zero disables.
+	IdleTimeout time.Duration
+	// MaxLifetime is how long a WebSocket may be open before it is closed. Zero disables.
+	MaxLifetime time.Duration
+	// PingInterval is how long a WebSocket may go without JAR writing to the client before it is pinged. Zero disables.
+	PingInterval time.Duration
+	// DrainTimeout is how long a WebSocket that has been told to go away has to close before it is closed for it
+	DrainTimeout time.Duration
+
+	name    string
+	lock    sync.Mutex
+	sockets map[string]map[*wsConn]struct{} // by member Host
+	open    metrics.Gauge
+}
+
+// NewWebSocketTracker returns a WebSocketTracker configured from the PoolConfig and global defaults.
+// The number of open WebSockets is registered with Metrics.
+func NewWebSocketTracker(pool *Pool) *WebSocketTracker {
+	return &WebSocketTracker{
+		IdleTimeout:  pool.Config.WebSocketIdleTimeout,
+		MaxLifetime:  pool.Config.WebSocketMaxLifetime,
+		PingInterval: pool.Config.WebSocketPingInterval,
+		DrainTimeout: Conf.GetDuration(ConfigPoolsWebSocketDrainTimeout),
+		name:         pool.Config.Name,
+		sockets:      make(map[string]map[*wsConn]struct{}),
+		open:         metrics.GetOrRegisterGauge(fmt.Sprintf("%s_WebSockets", pool.Config.Name), Metrics),
+	}
+}
+
+// Count returns the number of open WebSockets to the member
+func (wt *WebSocketTracker) Count(u *url.URL) int {
+	if wt == nil {
+		return 0
+	}
+
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	return len(wt.sockets[memberHost(u)])
+}
+
+// Drain asks each of the open WebSockets to the member to go away, closing any that haven't by DrainTimeout,
+// and returns how many there were
+func (wt *WebSocketTracker) Drain(u *url.URL) int {
+	if wt == nil {
+		return 0
+	}
+
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	for c := range wt.sockets[memberHost(u)] {
+		c.drain()
+	}
+	return len(wt.sockets[memberHost(u)])
+}
+
+// MemberHandler returns an http.Handler to go between the PoolManager and the proxy, which tracks the WebSockets
+// that requests are upgraded to
+func (wt *WebSocketTracker) MemberHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s := transportScheme(r.URL.Scheme); s != r.URL.Scheme {
+			// make shallow copy of request, so the member is requested over http(s)
+			newReq := *r
+			newReq.URL = CopyURL(r.URL)
+			newReq.URL.Scheme = s
+			r = &newReq
+		}
+
+		ww := &wsResponseWriter{ResponseWriter: w, wt: wt, r: r}
+		next.ServeHTTP(ww, r)
+		if ww.conn != nil {
+			// The proxy is done with it
+			wt.untrack(ww.conn)
+		}
+	})
+}
+
+// track starts tracking, and returns, the hijacked client connection to the member
+func (wt *WebSocketTracker) track(host string, conn net.Conn) *wsConn {
+	now := time.Now()
+	c := &wsConn{
+		Conn:    conn,
+		wt:      wt,
+		host:    host,
+		start:   now,
+		drainer: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	c.lastData.Store(now.UnixNano())
+	c.lastWrite = now
+
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	if wt.sockets[host] == nil {
+		wt.sockets[host] = make(map[*wsConn]struct{})
+	}
+	wt.sockets[host][c] = struct{}{}
+	wt.open.Update(wt.open.Value() + 1)
+	return c
+}
+
+// untrack stops tracking the connection
+func (wt *WebSocketTracker) untrack(c *wsConn) {
+	c.closeOnce.Do(func() { close(c.done) })
+
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	if _, ok := wt.sockets[c.host][c]; !ok {
+		return
+	}
+	delete(wt.sockets[c.host], c)
+	if len(wt.sockets[c.host]) == 0 {
+		delete(wt.sockets, c.host)
+	}
+	wt.open.Update(wt.open.Value() - 1)
+}
+
+// wsResponseWriter is an http.ResponseWriter that tracks the connection if it is hijacked
+type wsResponseWriter struct {
+	http.ResponseWriter
+	wt   *WebSocketTracker
+	r    *http.Request
+	conn *wsConn
+}
+
+// Hijack implements http.Hijacker, tracking the hijacked connection
+func (w *wsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+	w.conn = w.wt.track(memberHost(w.r.URL), conn)
+	if f, ok := w.r.Context().Value(wsUpgradedKey).(func()); ok {
+		f()
+	}
+	return w.conn, brw, nil
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController
+func (w *wsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// wsConn is the client side of a proxied WebSocket. It follows the frames going each way, so that it knows when
+// the socket is idle, and when it is safe to send the client a ping or a close of its own.
+type wsConn struct {
+	net.Conn
+	wt    *WebSocketTracker
+	host  string
+	start time.Time
+
+	keeping   sync.Once
+	drainer   chan struct{}
+	draining  sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
+	lastData  atomic.Int64 // UnixNano
+
+	wlock     sync.Mutex // serializes writes to the client, so our frames go between theirs
+	out       wsFrames
+	lastWrite time.Time
+	closing   bool // we've sent a close, so nothing more may be
+
+	in wsFrames // only touched by Read
+}
+
+// Read reads from the client
+func (c *wsConn) Read(p []byte) (int, error) {
+	// The proxy starts reading once the upgrade response is sent, and not before
+	c.keeping.Do(func() { go c.keep() })
+
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.in.Scan(p[:n]) {
+		c.lastData.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Write writes to the client
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.closing {
+		// The client has been told to go away, so it gets no more
+		return len(p), nil
+	}
+
+	n, err := c.Conn.Write(p)
+	if n > 0 && c.out.Scan(p[:n]) {
+		c.lastData.Store(time.Now().UnixNano())
+	}
+	c.lastWrite = time.Now()
+	return n, err
+}
+
+// control writes a control frame to the client, if it is between frames, returning true if it was written
+func (c *wsConn) control(opcode byte, payload []byte) bool {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.closing || !c.out.Boundary() {
+		return false
+	}
+
+	frame := append([]byte{0x80 | opcode, byte(len(payload))}, payload...)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return false
+	}
+	c.lastWrite = time.Now()
+	c.closing = opcode == wsOpClose
+	return true
+}
+
+// drain asks the connection to go away
+func (c *wsConn) drain() {
+	c.draining.Do(func() { close(c.drainer) })
+}
+
+// keep keeps the connection alive with pings, until it is idle, too old, or drained, and then sees it out
+func (c *wsConn) keep() {
+	var (
+		wt     = c.wt
+		check  <-chan time.Time
+		reason string
+	)
+
+	if period := minPositiveDuration(wt.IdleTimeout, wt.MaxLifetime, wt.PingInterval); period > 0 {
+		ticker := time.NewTicker(max(period/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	for reason == "" {
+		select {
+		case <-c.done:
+			return
+		case <-c.drainer:
+			reason = "member removed"
+		case now := <-check:
+			switch {
+			case wt.MaxLifetime > 0 && now.Sub(c.start) >= wt.MaxLifetime:
+				reason = "max lifetime reached"
+			case wt.IdleTimeout > 0 && now.Sub(time.Unix(0, c.lastData.Load())) >= wt.IdleTimeout:
+				reason = "idle"
+			case wt.PingInterval > 0 && now.Sub(c.lastWriteTime()) >= wt.PingInterval:
+				c.control(wsOpPing, nil)
+			}
+		}
+	}
+
+	DebugOut.Printf("Pool %s closing WebSocket to %s: %s\n", wt.name, c.host, reason)
+	c.goAway(reason)
+}
+
+// goAway tells the client to go away, and closes the connection if it hasn't by the DrainTimeout
+func (c *wsConn) goAway(reason string) {
+	timeout := time.NewTimer(c.wt.DrainTimeout)
+	defer timeout.Stop()
+
+	payload := binary.BigEndian.AppendUint16(nil, wsCloseGoingAway)
+	payload = append(payload, reason...)
+	retry := time.NewTicker(10 * time.Millisecond)
+	defer retry.Stop()
+	for !c.control(wsOpClose, payload) {
+		// Mid-frame, so wait for the frame to finish
+		select {
+		case <-c.done:
+			return
+		case <-timeout.C:
+			c.Conn.Close()
+			return
+		case <-retry.C:
+		}
+	}
+
+	select {
+	case <-c.done:
+	case <-timeout.C:
+		c.Conn.Close()
+	}
+}
+
+// lastWriteTime returns when the client was last written to
+func (c *wsConn) lastWriteTime() time.Time {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.lastWrite
+}
+
+// wsFrames follows a stream of WebSocket frames, going one way
+type wsFrames struct {
+	header [14]byte
+	hlen   int    // header bytes seen
+	remain uint64 // payload bytes left in the current frame
+	opcode byte
+}
+
+// Boundary returns true if the stream is between frames
+func (f *wsFrames) Boundary() bool {
+	return f.hlen == 0 && f.remain == 0
+}
+
+// Scan follows p through the frames, returning true if any of it belongs to data frames
+func (f *wsFrames) Scan(p []byte) bool {
+	var data bool
+	for len(p) > 0 {
+		if f.remain > 0 {
+			n := min(uint64(len(p)), f.remain)
+			f.remain -= n
+			p = p[n:]
+			data = data || f.opcode < wsOpClose
+			continue
+		}
+
+		f.header[f.hlen] = p[0]
+		f.hlen++
+		p = p[1:]
+		if f.hlen < f.headerLen() {
+			continue
+		}
+
+		// Header is complete
+		f.opcode = f.header[0] & 0x0f
+		f.remain = f.payloadLen()
+		f.hlen = 0
+		data = data || f.opcode < wsOpClose
+	}
+	return data
+}
+
+// headerLen returns the length of the current frame header, as far as is known
+func (f *wsFrames) headerLen() int {
+	if f.hlen < 2 {
+		return 2
+	}
+
+	n := 2
+	switch f.header[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if f.header[1]&0x80 != 0 {
+		// Masked
+		n += 4
+	}
+	return n
+}
+
+// payloadLen returns the payload length of the current frame, once its header is complete
+func (f *wsFrames) payloadLen() uint64 {
+	switch l := f.header[1] & 0x7f; l {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(f.header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(f.header[2:10])
+	default:
+		return uint64(l)
+	}
+}
+
+// minPositiveDuration returns the smallest of the durations that is greater than zero, or zero
+func minPositiveDuration(durations ...time.Duration) time.Duration {
+	var m time.Duration
+	for _, d := range durations {
+		if d > 0 && (m == 0 || d < m) {
+			m = d
+		}
+	}
+	return m
+}
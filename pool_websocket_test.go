@@ -0,0 +1,196 @@
+package jar
+
+import (
+	"github.com/rcrowley/go-metrics"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/websocket"
+
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWSBackend returns a server that says its name to each WebSocket, and then echoes
+func newWSBackend(name string) *httptest.Server {
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		ws.Write([]byte(name))
+		io.Copy(ws, ws)
+	}))
+}
+
+// wsMember returns the ws:// member URL for the server
+func wsMember(s *httptest.Server) string {
+	return strings.Replace(s.URL, "http://", "ws://", 1)
+}
+
+// wsDial opens a WebSocket to the server, returning it and the name of the backend that answered
+func wsDial(s *httptest.Server) (*websocket.Conn, string) {
+	ws, err := websocket.Dial(wsMember(s)+"/", "", "http://localhost/")
+	So(err, ShouldBeNil)
+	buf := make([]byte, 64)
+	n, err := ws.Read(buf)
+	So(err, ShouldBeNil)
+	return ws, string(buf[:n])
+}
+
+// wsClosed returns true if the WebSocket is closed by the other side within the timeout
+func wsClosed(ws *websocket.Conn, timeout time.Duration) bool {
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 64)
+	for {
+		if _, err := ws.Read(buf); err != nil {
+			return err == io.EOF
+		}
+	}
+}
+
+func TestPoolWebSockets(t *testing.T) {
+
+	one := newWSBackend("one")
+	defer one.Close()
+	two := newWSBackend("two")
+	defer two.Close()
+
+	serve := func(conf *PoolConfig) (*Pool, *httptest.Server) {
+		pool := NewPool(conf)
+		h, err := pool.GetPool()
+		So(err, ShouldBeNil)
+		return pool, httptest.NewServer(h)
+	}
+
+	Convey("When a Pool has ws:// members, WebSockets are proxied to them, and counted while they are open", t, func() {
+		pool, front := serve(&PoolConfig{Name: "wstest", Members: []string{wsMember(one)}})
+		defer front.Close()
+		member, _ := url.Parse(wsMember(one))
+
+		ws, name := wsDial(front)
+		So(name, ShouldEqual, "one")
+		ws.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		io.ReadFull(ws, buf)
+		So(string(buf), ShouldEqual, "hello")
+		So(pool.websockets.Count(member), ShouldEqual, 1)
+		So(Metrics.Get("wstest_WebSockets").(metrics.Gauge).Value(), ShouldEqual, 1)
+
+		ws.Close()
+		So(waitFor(time.Second, func() bool { return pool.websockets.Count(member) == 0 }), ShouldBeTrue)
+		So(Metrics.Get("wstest_WebSockets").(metrics.Gauge).Value(), ShouldEqual, 0)
+	})
+
+	Convey("When a member is deleted, its WebSockets are told to go away", t, func() {
+		pool, front := serve(&PoolConfig{Name: "wsdraintest", Members: []string{wsMember(one), wsMember(two)}})
+		defer front.Close()
+
+		ws, name := wsDial(front)
+		defer ws.Close()
+		So(pool.DeleteMember(map[string]string{"one": wsMember(one), "two": wsMember(two)}[name]), ShouldBeNil)
+		So(wsClosed(ws, time.Second), ShouldBeTrue)
+
+		Convey("... but the rest are not", func() {
+			ws, _ := wsDial(front)
+			defer ws.Close()
+			ws.Write([]byte("still here"))
+			So(wsClosed(ws, 100*time.Millisecond), ShouldBeFalse)
+		})
+	})
+
+	Convey("When a Pool has a WebSocketIdleTimeout, quiet WebSockets are closed", t, func() {
+		_, front := serve(&PoolConfig{Name: "wsidletest", Members: []string{wsMember(one)}, WebSocketIdleTimeout: 100 * time.Millisecond})
+		defer front.Close()
+
+		ws, _ := wsDial(front)
+		defer ws.Close()
+		start := time.Now()
+		So(wsClosed(ws, time.Second), ShouldBeTrue)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+	})
+
+	Convey("When a Pool has a WebSocketMaxLifetime, busy WebSockets are still closed", t, func() {
+		_, front := serve(&PoolConfig{Name: "wslifetimetest", Members: []string{wsMember(one)}, WebSocketMaxLifetime: 100 * time.Millisecond})
+		defer front.Close()
+
+		ws, _ := wsDial(front)
+		defer ws.Close()
+		go func() {
+			for {
+				if _, err := ws.Write([]byte("busy")); err != nil {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		So(wsClosed(ws, time.Second), ShouldBeTrue)
+	})
+
+	Convey("When a Pool has a WebSocketPingInterval, quiet WebSockets are pinged", t, func() {
+		_, front := serve(&PoolConfig{Name: "wspingtest", Members: []string{wsMember(one)}, WebSocketPingInterval: 50 * time.Millisecond})
+		defer front.Close()
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nOrigin: http://localhost/\r\n\r\n"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusSwitchingProtocols)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame := make([]byte, 5)
+		io.ReadFull(br, frame)
+		So(frame, ShouldResemble, []byte{0x81, 0x03, 'o', 'n', 'e'}) // the name
+		io.ReadFull(br, frame[:2])
+		So(frame[:2], ShouldResemble, []byte{0x80 | wsOpPing, 0x00})
+	})
+
+	Convey("When a Pool uses LeastRequests, open WebSockets count against their member, even if it is re-added", t, func() {
+		pool, front := serve(&PoolConfig{Name: "wsleasttest", Members: []string{wsMember(one), wsMember(two)}, LeastRequests: true})
+		defer front.Close()
+
+		ws, first := wsDial(front)
+		defer ws.Close()
+		members := map[string]string{"one": wsMember(one), "two": wsMember(two)}
+		So(pool.RemoveMember(members[first]), ShouldBeNil)
+		So(pool.AddMember(members[first]), ShouldBeNil)
+
+		for range 3 {
+			ws, second := wsDial(front)
+			So(second, ShouldNotEqual, first)
+			ws.Close()
+			So(waitFor(time.Second, func() bool {
+				u, _ := url.Parse(members[second])
+				return pool.websockets.Count(u) == 0
+			}), ShouldBeTrue)
+		}
+	})
+}
+
+func TestWSFrames(t *testing.T) {
+
+	Convey("When WebSocket frames are scanned, boundaries and data are noticed, even when split", t, func() {
+		var f wsFrames
+		So(f.Boundary(), ShouldBeTrue)
+
+		// masked text frame with a 2-byte extended length of 200
+		frame := append([]byte{0x81, 0x80 | 126, 0x00, 200, 1, 2, 3, 4}, make([]byte, 200)...)
+		So(f.Scan(frame[:3]), ShouldBeFalse)
+		So(f.Boundary(), ShouldBeFalse)
+		So(f.Scan(frame[3:100]), ShouldBeTrue)
+		So(f.Boundary(), ShouldBeFalse)
+		So(f.Scan(frame[100:]), ShouldBeTrue)
+		So(f.Boundary(), ShouldBeTrue)
+
+		// pong, then an empty binary frame
+		So(f.Scan([]byte{0x8A, 0x01, 'x'}), ShouldBeFalse)
+		So(f.Boundary(), ShouldBeTrue)
+		So(f.Scan([]byte{0x82, 0x00}), ShouldBeTrue)
+		So(f.Boundary(), ShouldBeTrue)
+	})
+}
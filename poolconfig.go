@@ -2,6 +2,7 @@ package jar
 
 import (
 	"strings"
+	"time"
 
 	"github.com/spf13/cast"
 	"github.com/vulcand/oxy/v2/roundrobin"
@@ -16,6 +17,8 @@ type PoolConfig struct {
 	Name string
 	// Members is a list of URIs you'd like in the pool
 	Members []string
+	// BackupMembers is a list of URIs that only receive traffic when every member in Members is unhealthy or pruned
+	BackupMembers []string
 	// Buffered refers to whether you'd like buffer all the requests, to possibly retry them in the even of a Member failure
 	Buffered bool
 	// BufferedFails is the number of failures to accept before giving up
@@ -24,14 +27,33 @@ type PoolConfig struct {
 	RemoveHeaders []string
 	// ConsistentHashing is mutually exclusive to Sticky, and enables automatic distributions
 	ConsistentHashing bool
-	// ConsistentHashSources is a list of "header", "cookie", or "request".
-	// For "header" and "cookie", it is paired with ConsistentHashName to choose which key from those maps is used.
+	// ConsistentHashSources is a list of "header", "cookie", "query", "path", "claim", or "request".
+	// For "header", "cookie", and "query", it is paired with ConsistentHashName to choose which key from those maps is used.
+	// For "path" it is paired with ConsistentHashName to choose a path segment index (0 is the first), or a regular
+	// expression whose first group is used.
+	// For "claim" it is paired with ConsistentHashName to choose a claim of the bearer JWT in the Authorization header.
 	// For "request" it is paired with ConsistentHashName to choose from one of "remoteaddr", "host", and "url".
 	// ConsistentHashSources ***must be balanced with ConsistentHashNames***.
 	ConsistentHashSources []string
-	// ConsistentHashNames is a list that sets the request part, header, or cookie name to pull the value from.
+	// ConsistentHashNames is a list that sets the request part, header, cookie, query parameter, path segment, or claim name
+	// to pull the value from.
 	// ConsistentHashSources ***must be balanced with ConsistentHashSources***.
 	ConsistentHashNames []string
+	// ConsistentHashFallbackSources is a list of sources, as ConsistentHashSources, tried in order when the key from
+	// ConsistentHashSources is empty. The first non-empty one is used.
+	// ConsistentHashFallbackSources ***must be balanced with ConsistentHashFallbackNames***.
+	ConsistentHashFallbackSources []string
+	// ConsistentHashFallbackNames is a list of names, as ConsistentHashNames, for ConsistentHashFallbackSources.
+	ConsistentHashFallbackNames []string
+	// ConsistentHashJWTKey is a shared secret, or a PEM-encoded RSA or ECDSA public key, used to verify the JWTs
+	// that "claim" sources are taken from. If unset, claims are used unverified.
+	ConsistentHashJWTKey string
+	// LeastRequests is mutually exclusive to Sticky and ConsistentHashing, and sends each request to the
+	// member with the fewest outstanding requests, relative to its weight
+	LeastRequests bool
+	// PeakEWMA is mutually exclusive to Sticky, ConsistentHashing, and LeastRequests, and sends each request
+	// to the better of two randomly-chosen members, based on a peak-sensitive moving average of their latency
+	PeakEWMA bool
 	// Sticky is mutually exclusive to ConsistentHashing, and enables cookie-based session routing
 	Sticky bool
 	// StickyCookieName overrides the name of the cookie used to handle sticky sessions
@@ -54,6 +76,119 @@ type PoolConfig struct {
 	ReplacePath string
 	// Prune removes members that fail healthcheck, until they pass again
 	Prune bool
+	// CircuitBreaker enables a circuit breaker on each member, removing it from the pool when too many
+	// requests to it fail, and returning it after CircuitBreakerOpenDuration to be probed
+	CircuitBreaker bool
+	// CircuitBreakerErrorRatio is the ratio (0.0-1.0) of failed requests that will open a member's circuit
+	CircuitBreakerErrorRatio float64
+	// CircuitBreakerLatency is how long a member may take to respond before the request is considered failed.
+	// Zero disables latency-based failures
+	CircuitBreakerLatency time.Duration
+	// CircuitBreakerOpenDuration is how long a member's circuit stays open before it is half-opened to be probed
+	CircuitBreakerOpenDuration time.Duration
+	// CircuitBreakerProbes is the number of consecutive successful requests a half-open member
+	// must serve before its circuit is closed
+	CircuitBreakerProbes int
+	// OutlierDetection enables passive healthchecking of members based on live traffic, ejecting members
+	// that fail too often for a period that backs off exponentially
+	OutlierDetection bool
+	// OutlierConsecutiveFailures is the number of consecutive failures that will eject a member. Zero disables.
+	OutlierConsecutiveFailures int
+	// OutlierFailureRate is the ratio (0.0-1.0) of failed requests that will eject a member. Zero disables.
+	OutlierFailureRate float64
+	// OutlierEjectionTime is how long a member is ejected the first time. Each subsequent ejection doubles it.
+	OutlierEjectionTime time.Duration
+	// OutlierMaxEjectionPercent is the maximum percentage of members that may be ejected at the same time.
+	// Regardless, the last member is never ejected.
+	OutlierMaxEjectionPercent int
+	// SlowStart is how long a member added to the pool after materialization (e.g. by PoolMemberAdder, or returning
+	// from Prune) takes to ramp up from a fraction of its weight to its full weight
+	SlowStart time.Duration
+	// SlowStartAggression shapes the SlowStart ramp: 1.0 (the default) is linear, larger values ramp up
+	// more quickly at first, and smaller values more slowly
+	SlowStartAggression float64
+	// Retries is the number of times a failed request may be retried on (possibly) other members.
+	// Mutually exclusive with Buffered. Zero disables.
+	Retries int
+	// RetryMethods is a list of request methods that may be retried. Defaults to the idempotent methods.
+	RetryMethods []string
+	// RetryStatuses is a list of response codes that will be retried. Defaults to 502, 503, and 504.
+	// Connection errors are 502s, and timeouts are 504s.
+	RetryStatuses []int
+	// RetryPerTryTimeout is how long each attempt may take. Zero disables.
+	RetryPerTryTimeout time.Duration
+	// RetryBackoff is the base wait between attempts, which doubles each retry, with jitter
+	RetryBackoff time.Duration
+	// RetryBudget is the percentage of in-flight requests to the pool that may be retries at any time
+	RetryBudget float64
+	// Hedge enables hedging of GET and HEAD requests: if a request is taking too long, the same request is sent
+	// to a different member, and whichever responds first wins
+	Hedge bool
+	// HedgeDelay is how long a request may take before it is hedged. If unset, the pool's observed p95 latency is used.
+	HedgeDelay time.Duration
+	// MaxConnsPerMember is the number of concurrent requests each member may handle. Zero disables.
+	MaxConnsPerMember int
+	// MaxQueue is the number of requests that may wait when every member is at MaxConnsPerMember.
+	// Zero rejects them immediately.
+	MaxQueue int
+	// QueueTimeout is how long a request may wait in the queue before it is rejected
+	QueueTimeout time.Duration
+	// FailoverPool is the name of a Pool that requests are sent to when this Pool has no members
+	FailoverPool string
+	// OverflowConcurrency is the number of concurrent requests above which requests overflow to the FailoverPool.
+	// Zero disables.
+	OverflowConcurrency int
+	// MirrorPool is the name of a shadow Pool that copies of requests are sent to, after they have been served.
+	// The shadow responses are discarded, and only compared with the real ones.
+	MirrorPool string
+	// MirrorPercent is the percentage of requests that are copied to the MirrorPool. Defaults to 100.
+	MirrorPercent float64
+	// MirrorMaxBodySize is the largest request body that will be held so the request can be copied to the MirrorPool.
+	// Requests with larger bodies are not copied. Defaults to pools.mirrormaxbodysize.
+	MirrorMaxBodySize int64
+	// MirrorMethods are the request methods that are copied to the MirrorPool. Defaults to GET and HEAD, as copies of
+	// other requests may change things a second time.
+	MirrorMethods []string
+	// TransportCAFile is a PEM bundle of CAs to verify https members with, instead of the system CAs
+	TransportCAFile string
+	// TransportCertFile is a PEM client certificate to present to https members. Requires TransportKeyFile.
+	TransportCertFile string
+	// TransportKeyFile is the PEM key for TransportCertFile
+	TransportKeyFile string
+	// TransportServerName overrides the name sent via SNI to, and verified against the certificates of, https members
+	TransportServerName string
+	// TransportInsecureSkipVerify disables verification of the certificates of https members. Dangerous.
+	TransportInsecureSkipVerify bool
+	// TransportDialTimeout is how long connecting to a member may take. Defaults to timeout.
+	TransportDialTimeout time.Duration
+	// TransportTLSHandshakeTimeout is how long the TLS handshake with a member may take
+	TransportTLSHandshakeTimeout time.Duration
+	// TransportResponseHeaderTimeout is how long a member may take to send response headers. Zero disables.
+	TransportResponseHeaderTimeout time.Duration
+	// TransportMaxIdleConnsPerHost is how many idle connections are kept to each member
+	TransportMaxIdleConnsPerHost int
+	// TransportHTTP2 enables HTTP/2 to https members that support it
+	TransportHTTP2 bool
+	// FCGIDocumentRoot is the document root of the scripts on FastCGI members, e.g. /var/www/html
+	FCGIDocumentRoot string
+	// FCGIScriptFilename, if set, is the script on FastCGI members that every request is sent to, with the request
+	// path as its PATH_INFO, e.g. a front controller like /var/www/html/index.php
+	FCGIScriptFilename string
+	// FCGIIndex is the script that requests for directories are sent to on FastCGI members. Defaults to index.php.
+	FCGIIndex string
+	// FCGISplitPath is a regular expression with two groups, that split the request path into the SCRIPT_NAME and
+	// PATH_INFO for FastCGI members. Defaults to splitting after the first ".php".
+	FCGISplitPath string
+	// FCGIParams are added to, and override, the params sent to FastCGI members
+	FCGIParams map[string]string
+	// WebSocketIdleTimeout is how long an upgraded WebSocket may go without sending or receiving data
+	// (pings and pongs aside) before it is closed. Zero disables.
+	WebSocketIdleTimeout time.Duration
+	// WebSocketMaxLifetime is how long an upgraded WebSocket may be open before it is closed. Zero disables.
+	WebSocketMaxLifetime time.Duration
+	// WebSocketPingInterval is how long JAR lets an upgraded WebSocket go without writing to the client before
+	// sending it a ping, to keep intermediaries from timing it out. Zero disables.
+	WebSocketPingInterval time.Duration
 	// EC2Affinity specifies whether an EC2-aware JAR should prefer a same-AZ member if available
 	EC2Affinity bool
 	// Options is a horrible, brittle map[string]interface{} that some PoolManagers
@@ -123,6 +258,21 @@ func (p *PoolOptions) GetFloat64(key string) float64 {
 	return -1
 }
 
+// GetDuration returns a Duration if *key* matches, otherwise zero-time
+func (p *PoolOptions) GetDuration(key string) (time.Duration, error) {
+	if p == nil {
+		return time.Duration(0), nil
+	}
+
+	lckey := strings.ToLower(key)
+	for k, v := range *p {
+		if lckey == strings.ToLower(k) {
+			return cast.ToDurationE(v)
+		}
+	}
+	return time.Duration(0), nil
+}
+
 // GetBool returns a bool value if *key* matches, otherwise false
 func (p *PoolOptions) GetBool(key string) bool {
 	if p == nil {
@@ -163,3 +313,23 @@ type PoolManager interface {
 	NextServer() (*url.URL, error)
 	Next() http.Handler
 }
+
+// MemberServer is a PoolManager that accounts for the requests it sends to each member, and can send a request
+// to a specific member with the same accounting, e.g. when it is hedged
+type MemberServer interface {
+	ServeMember(w http.ResponseWriter, req *http.Request, u *url.URL)
+}
+
+// serveMember sends the request to the specified member of the PoolManager, through its accounting if it is a
+// MemberServer, or else straight to its next Handler
+func serveMember(pm PoolManager, w http.ResponseWriter, r *http.Request, u *url.URL) {
+	if ms, ok := pm.(MemberServer); ok {
+		ms.ServeMember(w, r, u)
+		return
+	}
+
+	// make shallow copy of request
+	newReq := *r
+	newReq.URL = CopyURL(u)
+	pm.Next().ServeHTTP(w, &newReq)
+}
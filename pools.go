@@ -29,6 +29,37 @@ const (
 	ConfigPoolsDefaultConsistentHashPartitions        = ConfigKey("pools.defaultconsistenthashpartitions")
 	ConfigPoolsDefaultConsistentHashReplicationFactor = ConfigKey("pools.defaultconsistenthashreplicationfactor")
 	ConfigPoolsDefaultConsistentHashLoad              = ConfigKey("pools.defaultconsistenthashload")
+	ConfigPoolsDefaultPeakEWMADecay                   = ConfigKey("pools.defaultpeakewmadecay")
+	ConfigPoolsDefaultCircuitBreakerErrorRatio        = ConfigKey("pools.defaultcircuitbreakererrorratio")
+	ConfigPoolsDefaultCircuitBreakerOpenDuration      = ConfigKey("pools.defaultcircuitbreakeropenduration")
+	ConfigPoolsDefaultCircuitBreakerProbes            = ConfigKey("pools.defaultcircuitbreakerprobes")
+	ConfigPoolsCircuitBreakerWindow                   = ConfigKey("pools.circuitbreakerwindow")
+	ConfigPoolsCircuitBreakerMinRequests              = ConfigKey("pools.circuitbreakerminrequests")
+	ConfigPoolsDefaultOutlierConsecutiveFailures      = ConfigKey("pools.defaultoutlierconsecutivefailures")
+	ConfigPoolsDefaultOutlierEjectionTime             = ConfigKey("pools.defaultoutlierejectiontime")
+	ConfigPoolsDefaultOutlierMaxEjectionPercent       = ConfigKey("pools.defaultoutliermaxejectionpercent")
+	ConfigPoolsOutlierMaxEjectionTime                 = ConfigKey("pools.outliermaxejectiontime")
+	ConfigPoolsOutlierWindow                          = ConfigKey("pools.outlierwindow")
+	ConfigPoolsOutlierMinRequests                     = ConfigKey("pools.outlierminrequests")
+	ConfigPoolsDefaultRetryBackoff                    = ConfigKey("pools.defaultretrybackoff")
+	ConfigPoolsDefaultRetryBudget                     = ConfigKey("pools.defaultretrybudget")
+	ConfigPoolsRetryMaxBodySize                       = ConfigKey("pools.retrymaxbodysize")
+	ConfigPoolsDefaultHedgeDelay                      = ConfigKey("pools.defaulthedgedelay")
+	ConfigPoolsDefaultMaxIdleConns                    = ConfigKey("pools.defaultmaxidleconns")
+	ConfigPoolsDefaultQueueTimeout                    = ConfigKey("pools.defaultqueuetimeout")
+	ConfigPoolsDefaultTLSHandshakeTimeout             = ConfigKey("pools.defaulttlshandshaketimeout")
+	ConfigPoolsDNSInterval                            = ConfigKey("pools.dnsinterval")
+	ConfigPoolsDNSResolver                            = ConfigKey("pools.dnsresolver")
+	ConfigPoolsWebSocketDrainTimeout                  = ConfigKey("pools.websocketdraintimeout")
+	ConfigPoolsDefaultDrainTimeout                    = ConfigKey("pools.defaultdraintimeout")
+	ConfigPoolsDrainIdleTime                          = ConfigKey("pools.drainidletime")
+	ConfigPoolsStateFile                              = ConfigKey("pools.statefile")
+	ConfigPoolsStatePolicy                            = ConfigKey("pools.statepolicy")
+	ConfigPoolsSync                                   = ConfigKey("pools.sync")
+	ConfigPoolsSyncInterval                           = ConfigKey("pools.syncinterval")
+	ConfigPoolsSyncKey                                = ConfigKey("pools.synckey")
+	ConfigPoolsMirrorMaxBodySize                      = ConfigKey("pools.mirrormaxbodysize")
+	ConfigPoolsMirrorTimeout                          = ConfigKey("pools.mirrortimeout")
 )
 
 func init() {
@@ -223,56 +254,81 @@ func (p *Pools) tickFunc(rChan chan interface{}) {
 	p.RLock()
 	for _, pool := range p.pools {
 
-		f := func(u, m interface{}) bool {
-			murl := u.(url.URL)
-			//member := m.(*Member)
-
-			if !pool.Config.HealthCheckDisabled && pool.Config.HealthCheckURI != "" {
-				hcurl := fmt.Sprintf("%s://%s%s", murl.Scheme, murl.Host, pool.Config.HealthCheckURI)
-				if pool.Config.HealthCheckShotgun {
-					// Don't schedule it, just fire it off now
-					DebugOut.Printf("\tAdding immediate work for '%s'\n", hcurl)
-					AddWork(&HealthCheckWork{
-						PoolName:    pool.Config.Name,
-						Member:      murl.String(),
-						URL:         hcurl,
-						ReturnChan:  rChan,
-						Prune:       pool.Config.Prune,
-						ErrorStatus: pool.healthCheckErrorStatus,
-						Add:         pool.AddMember,
-						Remove:      pool.RemoveMember,
-					})
-				} else {
-					// Schedule it
-					DebugOut.Printf("\tAdding scheduled work for Pool %s : %s\n", pool.Config.Name, murl.String())
-					worklist = append(worklist, &HealthCheckWork{
-						PoolName:    pool.Config.Name,
-						Member:      murl.String(),
-						URL:         hcurl,
-						ReturnChan:  rChan,
-						Prune:       pool.Config.Prune,
-						ErrorStatus: pool.healthCheckErrorStatus,
-						Add:         pool.AddMember,
-						Remove:      pool.RemoveMember,
-					})
+		// Healthchecks need to talk to members the same way the Pool does
+		var transport http.RoundTripper
+		if pool.transport != nil {
+			transport = pool.transport
+		}
+
+		// check returns a func to add healthcheck work for each member in a member cache
+		check := func(poolName string, add, remove PruneFunc) func(u, m interface{}) bool {
+			return func(u, m interface{}) bool {
+				murl := u.(url.URL)
+				//member := m.(*Member)
+
+				if !pool.Config.HealthCheckDisabled && pool.Config.HealthCheckURI != "" {
+					hu := &murl
+					if isUnixScheme(murl.Scheme) {
+						// Checked over its socket, by the Pool transport
+						hu = unixRequestURL(&murl)
+					}
+					hcurl := fmt.Sprintf("%s://%s%s", transportScheme(hu.Scheme), hu.Host, pool.Config.HealthCheckURI)
+					if pool.Config.HealthCheckShotgun {
+						// Don't schedule it, just fire it off now
+						DebugOut.Printf("\tAdding immediate work for '%s'\n", hcurl)
+						AddWork(&HealthCheckWork{
+							PoolName:    poolName,
+							Member:      murl.String(),
+							URL:         hcurl,
+							ReturnChan:  rChan,
+							Prune:       pool.Config.Prune,
+							ErrorStatus: pool.healthCheckErrorStatus,
+							Add:         add,
+							Remove:      remove,
+							Transport:   transport,
+						})
+					} else {
+						// Schedule it
+						DebugOut.Printf("\tAdding scheduled work for Pool %s : %s\n", poolName, murl.String())
+						worklist = append(worklist, &HealthCheckWork{
+							PoolName:    poolName,
+							Member:      murl.String(),
+							URL:         hcurl,
+							ReturnChan:  rChan,
+							Prune:       pool.Config.Prune,
+							ErrorStatus: pool.healthCheckErrorStatus,
+							Add:         add,
+							Remove:      remove,
+							Transport:   transport,
+						})
+					}
 				}
+				return true
 			}
-			return true
 		}
 
 		// if the Pool is Materialized, the healthcheck is enabled, and the URI isn't empty...
 		if pool.IsMaterialized() && !pool.Config.HealthCheckDisabled && pool.Config.HealthCheckURI != "" {
-			if len(pool.ListMembers()) == 0 {
+			if len(pool.ListMembers()) > 0 {
+				if _, err := Status.Get(pool.Config.Name); err == nil {
+					// We had an empty pool, but it's all over now
+					Status.Remove(pool.Config.Name)
+				}
+			} else if pool.ListBackupMembers != nil && len(pool.ListBackupMembers()) > 0 {
+				// Not great, but not empty
+				Status.Add(pool.Config.Name, "WARNING", "Pool has no members, using backup members", nil)
+			} else {
 				// Never ever ever have an empty pool
 				Status.Add(pool.Config.Name, "CRITICAL", "Pool has no members", nil)
-			} else if _, err := Status.Get(pool.Config.Name); err == nil {
-				// We had an empty pool, but it's all over now
-				Status.Remove(pool.Config.Name)
 			}
 		}
 
 		// Iterate over the members
-		pool.members.Range(f)
+		pool.members.Range(check(pool.Config.Name, pool.healthCheckAdd, pool.healthCheckRemove))
+		if pool.AddBackupMember != nil {
+			// Backups are reported separately
+			pool.backupMembers.Range(check(pool.Config.Name+"_Backup", pool.AddBackupMember, pool.RemoveBackupMember))
+		}
 	}
 	p.RUnlock()
 
@@ -361,6 +417,8 @@ type HealthCheckWork struct {
 	ErrorStatus HealthCheckStatus
 	Add         PruneFunc
 	Remove      PruneFunc
+	// Transport is used for the HealthCheck, if set, so it matches the Pool's
+	Transport http.RoundTripper
 	// Return is an error, or the StatusCode int
 	ReturnChan chan interface{}
 }
@@ -368,7 +426,8 @@ type HealthCheckWork struct {
 // Work executes the HealthCheck and returns HealthCheckResult or HealthCheckError
 func (h *HealthCheckWork) Work() interface{} {
 	var workClient = &http.Client{
-		Timeout: time.Second * 2,
+		Timeout:   time.Second * 2,
+		Transport: h.Transport,
 	}
 
 	res, err := workClient.Get(h.URL)
@@ -0,0 +1,316 @@
+package jar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Constants for configuration key strings and Errors
+const (
+	ConfigStaticRoot          = ConfigKey("static.root")
+	ConfigStaticFS            = ConfigKey("static.fs")
+	ConfigStaticIndex         = ConfigKey("static.index")
+	ConfigStaticListing       = ConfigKey("static.listing")
+	ConfigStaticSPA           = ConfigKey("static.spa")
+	ConfigStaticPrecompressed = ConfigKey("static.precompressed")
+	ConfigStaticDotFiles      = ConfigKey("static.dotfiles")
+
+	// ErrStaticNoRoot is returned when a static Path has neither, or both, of static.root and static.fs set
+	ErrStaticNoRoot = Error("one of static.root or static.fs must be set in path options")
+
+	// ErrStaticNoSuchFS is returned when static.fs names a filesystem that isn't in StaticFileSystems
+	ErrStaticNoSuchFS = Error("static.fs is not the name of a filesystem in StaticFileSystems")
+)
+
+var (
+	// StaticFileSystems is a map of filesystems that static Paths may serve with static.fs, e.g. an embed.FS
+	// of assets built into JAR, added in an init()
+	StaticFileSystems = make(map[string]fs.FS)
+
+	// staticEncodings are the precompressed variants that are looked for, in order of preference
+	staticEncodings = []struct{ encoding, ext string }{
+		{"br", ".br"},
+		{"gzip", ".gz"},
+	}
+)
+
+func init() {
+	// Set up the static finishers
+	Finishers["static"] = nil
+	FinisherSetups["static"] = func(p *Path) (http.HandlerFunc, error) {
+		root := p.Options.GetString(ConfigStaticRoot)
+		fsName := p.Options.GetString(ConfigStaticFS)
+
+		var s *Static
+		switch {
+		case (root == "") == (fsName == ""):
+			return nil, ErrStaticNoRoot
+		case root != "":
+			info, err := os.Stat(root)
+			if err != nil {
+				return nil, err
+			} else if !info.IsDir() {
+				return nil, ErrConfigurationError{fmt.Sprintf("static.root '%s' is not a directory", root)}
+			}
+			s = NewStatic(os.DirFS(root))
+		default:
+			sfs, ok := StaticFileSystems[fsName]
+			if !ok {
+				return nil, ErrStaticNoSuchFS
+			}
+			s = NewStatic(sfs)
+		}
+
+		if index := p.Options.GetStringSlice(ConfigStaticIndex); len(index) > 0 {
+			s.Index = index
+		}
+		s.Listing = p.Options.GetBool(ConfigStaticListing)
+		s.SPA = p.Options.GetBool(ConfigStaticSPA)
+		s.DotFiles = p.Options.GetBool(ConfigStaticDotFiles)
+		if p.Options.Get(ConfigStaticPrecompressed) != nil {
+			s.Precompressed = p.Options.GetBool(ConfigStaticPrecompressed)
+		}
+
+		DebugOut.Printf("\tStatic: root '%s' fs '%s' index %v listing %t spa %t\n", root, fsName, s.Index, s.Listing, s.SPA)
+		return http.StripPrefix(p.Path, s).ServeHTTP, nil
+	}
+}
+
+// Static is an http.Handler that serves files from a filesystem, with support for Range requests, conditional
+// requests, precompressed variants, and single-page apps
+type Static struct {
+	// FS is the filesystem files are served from
+	FS fs.FS
+	// Index is a list of files that are served for requests for their directory, in order of preference
+	Index []string
+	// Listing enables listing of directories that have no Index file
+	Listing bool
+	// SPA serves the Index file of the root, instead of a 404, for requests for pages that don't exist
+	SPA bool
+	// Precompressed serves the .br or .gz variant of a file, if there is one, to clients that accept it
+	Precompressed bool
+	// DotFiles allows files and directories with names beginning with "." to be served
+	DotFiles bool
+
+	// etags caches the ETags of files without modification times, e.g. in an embed.FS, by name
+	etags sync.Map
+}
+
+// NewStatic returns a Static serving the filesystem, with the defaults set
+func NewStatic(fsys fs.FS) *Static {
+	return &Static{
+		FS:            fsys,
+		Index:         []string{"index.html"},
+		Precompressed: true,
+	}
+}
+
+// ServeHTTP serves the requested file
+func (s *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		RequestErrorResponse(r, w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	if !s.DotFiles && hasDotSegment(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	info, err := fs.Stat(s.FS, name)
+	if err != nil {
+		if s.SPA && (path.Ext(name) == "" || strings.Contains(r.Header.Get("Accept"), "text/html")) {
+			// Pages are the app's business, but missing assets are still missing
+			if index, iinfo := s.index("."); iinfo != nil {
+				s.serveFile(w, r, index, iinfo)
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if !info.IsDir() {
+		s.serveFile(w, r, name, info)
+		return
+	}
+
+	// Directories must end with a slash, so relative links work
+	reqPath, _, _ := strings.Cut(r.RequestURI, "?")
+	if reqPath == "" {
+		reqPath = r.URL.Path
+	}
+	if !strings.HasSuffix(reqPath, "/") {
+		target := path.Base(reqPath) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	if index, iinfo := s.index(name); iinfo != nil {
+		s.serveFile(w, r, index, iinfo)
+		return
+	}
+	if !s.Listing {
+		RequestErrorResponse(r, w, ErrForbiddenError.Error(), http.StatusForbidden)
+		return
+	}
+	s.list(w, r, name, reqPath)
+}
+
+// index returns the name and FileInfo of the first Index file in the directory, or a nil FileInfo if there isn't one
+func (s *Static) index(dir string) (string, fs.FileInfo) {
+	for _, index := range s.Index {
+		name := path.Join(dir, index)
+		if info, err := fs.Stat(s.FS, name); err == nil && info.Mode().IsRegular() {
+			return name, info
+		}
+	}
+	return "", nil
+}
+
+// serveFile serves the file, or a precompressed variant of it, handling Range and conditional requests
+func (s *Static) serveFile(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		// Set now, so precompressed variants aren't typed by their extension
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	if s.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, e := range staticEncodings {
+			if !acceptsEncoding(r, e.encoding) {
+				continue
+			}
+			if vinfo, err := fs.Stat(s.FS, name+e.ext); err == nil && vinfo.Mode().IsRegular() {
+				name, info = name+e.ext, vinfo
+				w.Header().Set("Content-Encoding", e.encoding)
+				break
+			}
+		}
+	}
+
+	f, err := s.FS.Open(name)
+	if err != nil {
+		ErrorOut.Printf("%s\n", ErrRequestError{r, fmt.Sprintf("error opening static file '%s': %s", name, err)})
+		RequestErrorResponse(r, w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		// Not every fs.File can seek, and ServeContent needs to
+		b, err := io.ReadAll(f)
+		if err != nil {
+			ErrorOut.Printf("%s\n", ErrRequestError{r, fmt.Sprintf("error reading static file '%s': %s", name, err)})
+			RequestErrorResponse(r, w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	etag, err := s.etag(name, info, content)
+	if err != nil {
+		ErrorOut.Printf("%s\n", ErrRequestError{r, fmt.Sprintf("error hashing static file '%s': %s", name, err)})
+	} else {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// etag returns the ETag of the file: from its modification time and size if it has one, otherwise from a hash of
+// its content, which is cached
+func (s *Static) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()), nil
+	}
+
+	key := fmt.Sprintf("%s:%d", name, info.Size())
+	if etag, ok := s.etags.Load(key); ok {
+		return etag.(string), nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+	s.etags.Store(key, etag)
+	return etag, nil
+}
+
+// list writes an HTML listing of the directory
+func (s *Static) list(w http.ResponseWriter, r *http.Request, name, reqPath string) {
+	entries, err := fs.ReadDir(s.FS, name)
+	if err != nil {
+		ErrorOut.Printf("%s\n", ErrRequestError{r, fmt.Sprintf("error listing static directory '%s': %s", name, err)})
+		RequestErrorResponse(r, w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	title := html.EscapeString(reqPath)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!doctype html>\n<html><head><meta charset=\"utf-8\"><title>Index of %s</title></head>\n<body><h1>Index of %s</h1>\n<pre>\n<a href=\"../\">../</a>\n", title, title)
+	for _, entry := range entries {
+		ename := entry.Name()
+		if !s.DotFiles && strings.HasPrefix(ename, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			ename += "/"
+		}
+		link := url.URL{Path: ename}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(link.String()), html.EscapeString(ename))
+	}
+	fmt.Fprint(w, "</pre>\n</body></html>\n")
+}
+
+// hasDotSegment returns true if any part of the slash-separated name begins with a "."
+func hasDotSegment(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part != "." && strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding returns true if the request's Accept-Encoding includes the encoding, with a non-zero quality
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(enc), encoding) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package jar
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStatic(t *testing.T) {
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":          "<h1>app</h1>",
+		"app.js":              "console.log('hello world, this is the app')",
+		"app.js.gz":           "gzipped",
+		"app.js.br":           "brotlied",
+		"css/site.css":        "body{}",
+		"docs/home.htm":       "docs",
+		".env":                "SECRET=1",
+		".well-known/example": "known",
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(h http.HandlerFunc, target string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		return rr
+	}
+
+	Convey("When a static Path serves a directory, files are served", t, func() {
+		h, err := HandleFinisher("Static", &Path{Path: "/assets/", Options: PathOptions{"static.root": dir}})
+		So(err, ShouldBeNil)
+
+		rr := get(h, "/assets/app.js")
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "console.log('hello world, this is the app')")
+		So(rr.Header().Get("Content-Type"), ShouldStartWith, "text/javascript")
+		So(rr.Header().Get("Last-Modified"), ShouldNotBeEmpty)
+		etag := rr.Header().Get("ETag")
+		So(etag, ShouldNotBeEmpty)
+
+		Convey("... with conditional 304s", func() {
+			So(get(h, "/assets/app.js", "If-None-Match", etag).Code, ShouldEqual, http.StatusNotModified)
+			So(get(h, "/assets/app.js", "If-Modified-Since", rr.Header().Get("Last-Modified")).Code, ShouldEqual, http.StatusNotModified)
+			So(get(h, "/assets/app.js", "If-None-Match", `"nope"`).Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("... with Range requests", func() {
+			rr := get(h, "/assets/app.js", "Range", "bytes=0-6")
+			So(rr.Code, ShouldEqual, http.StatusPartialContent)
+			So(rr.Body.String(), ShouldEqual, "console")
+			So(get(h, "/assets/app.js", "Range", "bytes=1000-").Code, ShouldEqual, http.StatusRequestedRangeNotSatisfiable)
+		})
+
+		Convey("... with precompressed variants, to clients that accept them", func() {
+			rr := get(h, "/assets/app.js", "Accept-Encoding", "gzip, br")
+			So(rr.Body.String(), ShouldEqual, "brotlied")
+			So(rr.Header().Get("Content-Encoding"), ShouldEqual, "br")
+			So(rr.Header().Get("Content-Type"), ShouldStartWith, "text/javascript")
+			So(rr.Header().Get("Vary"), ShouldEqual, "Accept-Encoding")
+			So(rr.Header().Get("ETag"), ShouldNotEqual, etag)
+
+			rr = get(h, "/assets/app.js", "Accept-Encoding", "gzip, br;q=0")
+			So(rr.Body.String(), ShouldEqual, "gzipped")
+			So(rr.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+		})
+
+		Convey("... with index files, and redirects for directories without a slash", func() {
+			rr := get(h, "/assets/")
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(rr.Body.String(), ShouldEqual, "<h1>app</h1>")
+
+			rr = get(h, "/assets/docs?x=1")
+			So(rr.Code, ShouldEqual, http.StatusMovedPermanently)
+			So(rr.Header().Get("Location"), ShouldEqual, "docs/?x=1")
+		})
+
+		Convey("... but not directory listings, dotfiles, missing files, or non-GETs", func() {
+			So(get(h, "/assets/docs/").Code, ShouldEqual, http.StatusForbidden)
+			So(get(h, "/assets/css/").Code, ShouldEqual, http.StatusForbidden)
+			So(get(h, "/assets/.env").Code, ShouldEqual, http.StatusNotFound)
+			So(get(h, "/assets/css/../.env").Code, ShouldEqual, http.StatusNotFound)
+			So(get(h, "/assets/nope.js").Code, ShouldEqual, http.StatusNotFound)
+			So(get(h, "/assets/some/page").Code, ShouldEqual, http.StatusNotFound)
+
+			rr := httptest.NewRecorder()
+			h(rr, httptest.NewRequest("POST", "/assets/app.js", nil))
+			So(rr.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(rr.Header().Get("Allow"), ShouldEqual, "GET, HEAD")
+		})
+	})
+
+	Convey("When a static Path has options set, they are honored", t, func() {
+		h, err := HandleFinisher("static", &Path{Path: "/", Options: PathOptions{"static.root": dir, "static.index": []string{"home.htm", "index.html"},
+			"static.listing": true, "static.spa": true, "static.precompressed": false, "static.dotfiles": true}})
+		So(err, ShouldBeNil)
+
+		So(get(h, "/docs/").Body.String(), ShouldEqual, "docs")
+		So(get(h, "/.well-known/example").Body.String(), ShouldEqual, "known")
+
+		rr := get(h, "/app.js", "Accept-Encoding", "br")
+		So(rr.Body.String(), ShouldStartWith, "console.log")
+		So(rr.Header().Get("Content-Encoding"), ShouldBeEmpty)
+
+		rr = get(h, "/css/")
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldContainSubstring, `<a href="site.css">site.css</a>`)
+
+		Convey("... including the single-page app fallback, for pages but not assets", func() {
+			rr := get(h, "/some/page")
+			So(rr.Code, ShouldEqual, http.StatusOK)
+			So(rr.Body.String(), ShouldEqual, "<h1>app</h1>")
+
+			So(get(h, "/users/jane.doe", "Accept", "text/html,*/*").Body.String(), ShouldEqual, "<h1>app</h1>")
+			So(get(h, "/nope.js").Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+
+	Convey("When a static Path serves a registered filesystem, files without modification times get content ETags", t, func() {
+		StaticFileSystems["testfs"] = fstest.MapFS{
+			"index.html": &fstest.MapFile{Data: []byte("embedded")},
+		}
+		defer delete(StaticFileSystems, "testfs")
+
+		h, err := HandleFinisher("static", &Path{Path: "/", Options: PathOptions{"static.fs": "testfs"}})
+		So(err, ShouldBeNil)
+
+		rr := get(h, "/")
+		So(rr.Code, ShouldEqual, http.StatusOK)
+		So(rr.Body.String(), ShouldEqual, "embedded")
+		So(rr.Header().Get("Last-Modified"), ShouldBeEmpty)
+		etag := rr.Header().Get("ETag")
+		So(etag, ShouldHaveLength, 34)
+		So(get(h, "/index.html", "If-None-Match", etag).Code, ShouldEqual, http.StatusNotModified)
+	})
+
+	Convey("When a static Path is misconfigured, it won't build", t, func() {
+		_, err := HandleFinisher("static", &Path{Path: "/"})
+		So(err, ShouldEqual, ErrStaticNoRoot)
+
+		_, err = HandleFinisher("static", &Path{Path: "/", Options: PathOptions{"static.root": dir, "static.fs": "testfs"}})
+		So(err, ShouldEqual, ErrStaticNoRoot)
+
+		_, err = HandleFinisher("static", &Path{Path: "/", Options: PathOptions{"static.fs": "nope"}})
+		So(err, ShouldEqual, ErrStaticNoSuchFS)
+
+		_, err = HandleFinisher("static", &Path{Path: "/", Options: PathOptions{"static.root": filepath.Join(dir, "app.js")}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When Accept-Encoding is checked, qualities are honored", t, func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip;q=0.5, br;q=0, deflate")
+		So(acceptsEncoding(req, "gzip"), ShouldBeTrue)
+		So(acceptsEncoding(req, "br"), ShouldBeFalse)
+		So(acceptsEncoding(req, "deflate"), ShouldBeTrue)
+		So(acceptsEncoding(req, "zstd"), ShouldBeFalse)
+	})
+}